@@ -122,6 +122,12 @@ func (b *Bot) IsBanned(addr net.Addr) bool {
 	return b.cfg.GetBanlist().Has(addr)
 }
 
+// GetDNSBL returns DNS blocklists with their scores and the reject threshold
+func (b *Bot) GetDNSBL() (map[string]int, int) {
+	cfg := b.cfg.GetBot()
+	return cfg.DNSBL(), cfg.DNSBLThreshold()
+}
+
 // IsTrusted checks if address is a trusted (proxy)
 func (b *Bot) IsTrusted(addr net.Addr) bool {
 	ip := utils.AddrIP(addr)
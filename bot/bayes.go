@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gitlab.com/etke.cc/linkpearl"
+	"maunium.net/go/mautrix/id"
+
+	"gitlab.com/etke.cc/postmoogle/bot/bayes"
+	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// bayesLabel is added to the emails classified as spam
+const bayesLabel = "spam"
+
+// IsSpam checks if the email should be rejected by the room's bayes spam classifier
+func (b *Bot) IsSpam(roomID id.RoomID, eml *email.Email) bool {
+	cfg, err := b.cfg.GetRoom(roomID)
+	if err != nil {
+		b.log.Error().Err(err).Msg("cannot retrieve room settings")
+		return false
+	}
+	if !cfg.BayesReject() {
+		return false
+	}
+
+	return b.bayesSpam(bayesStore(roomID, cfg), cfg, bayes.Tokens(eml))
+}
+
+// bayesStore returns name of the room's token store, empty if the classifier is disabled
+func bayesStore(roomID id.RoomID, cfg config.Room) string {
+	switch cfg.Bayes() {
+	case config.BayesStoreRoom:
+		return roomID.String()
+	case config.BayesStoreServer:
+		return bayes.ServerStore
+	default:
+		return ""
+	}
+}
+
+// sanitizeBayesStore allows only supported token stores
+func sanitizeBayesStore(value string) string {
+	if value == config.BayesStoreRoom || value == config.BayesStoreServer {
+		return value
+	}
+	return ""
+}
+
+// bayesSpam checks if spam probability of the email tokens is above the room's threshold
+func (b *Bot) bayesSpam(store string, cfg config.Room, tokens []string) bool {
+	if store == "" {
+		return false
+	}
+	score, ok, err := b.bs.Score(store, tokens)
+	if err != nil {
+		b.log.Error().Err(err).Str("store", store).Msg("cannot calculate spam score")
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	b.log.Debug().Str("store", store).Float64("score", score).Msg("spam score calculated")
+	return score*100 >= float64(cfg.BayesThreshold())
+}
+
+// bayesTrain trains the classifier with the email of the event
+func (b *Bot) bayesTrain(ctx context.Context, spam bool, eventID id.EventID) {
+	err := b.bs.Train(eventID.String(), spam)
+	if errors.Is(err, bayes.ErrNotFound) {
+		b.log.Debug().Str("eventID", eventID.String()).Msg("email is not available for spam classifier training")
+		return
+	}
+	if err != nil {
+		b.Error(ctx, "cannot train spam classifier: %v", err)
+	}
+}
+
+func (b *Bot) printBayesStats(ctx context.Context) {
+	evt := eventFromContext(ctx)
+	cfg, err := b.cfg.GetRoom(evt.RoomID)
+	if err != nil {
+		b.Error(ctx, "failed to retrieve settings: %v", err)
+		return
+	}
+	store := bayesStore(evt.RoomID, cfg)
+	if store == "" {
+		msg := fmt.Sprintf("spam classifier is disabled, kupo.\n"+
+			"To enable it, send a `%s %s %s` or `%s %s %s` command.",
+			b.prefix, config.RoomBayes, config.BayesStoreRoom, b.prefix, config.RoomBayes, config.BayesStoreServer)
+		b.lp.SendNotice(evt.RoomID, msg, linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+		return
+	}
+
+	spam, ham, err := b.bs.Stats(store)
+	if err != nil {
+		b.Error(ctx, "cannot get spam classifier stats: %v", err)
+		return
+	}
+	msg := fmt.Sprintf("Spam classifier uses the `%s` token store, trained with %d spam and %d non-spam emails.", cfg.Bayes(), spam, ham)
+	b.lp.SendNotice(evt.RoomID, msg, linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+}
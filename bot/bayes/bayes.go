@@ -0,0 +1,236 @@
+package bayes
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ServerStore is a name of the token store shared by all rooms of the server
+const ServerStore = "*"
+
+const (
+	// minLearns is the amount of both spam and ham emails required before the classification
+	minLearns = 10
+	// retention of the emails' tokens available for training
+	retention = 30 * 24 * time.Hour
+	// queryChunk is max amount of tokens queried at once
+	queryChunk = 500
+)
+
+// message classes
+const (
+	classNone = iota
+	classSpam
+	classHam
+)
+
+// ErrNotFound returned when email's tokens are not remembered (or already expired)
+var ErrNotFound = errors.New("email is not available for training")
+
+// Bayes is a naive Bayes spam classifier with per-room or per-server token stores
+type Bayes struct {
+	db  *sql.DB
+	log *zerolog.Logger
+}
+
+// New bayes classifier
+func New(db *sql.DB, log *zerolog.Logger) (*Bayes, error) {
+	bs := &Bayes{db: db, log: log}
+	if err := bs.migrate(); err != nil {
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+func (bs *Bayes) migrate() error {
+	tables := []string{
+		`CREATE TABLE IF NOT EXISTS bayes_stores (
+			store VARCHAR(255) PRIMARY KEY,
+			spam  INTEGER NOT NULL DEFAULT 0,
+			ham   INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS bayes_tokens (
+			store VARCHAR(255) NOT NULL,
+			token VARCHAR(255) NOT NULL,
+			spam  INTEGER NOT NULL DEFAULT 0,
+			ham   INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (store, token)
+		)`,
+		`CREATE TABLE IF NOT EXISTS bayes_messages (
+			id         VARCHAR(255) PRIMARY KEY,
+			store      VARCHAR(255) NOT NULL,
+			tokens     TEXT NOT NULL,
+			class      INTEGER NOT NULL DEFAULT 0,
+			created_at BIGINT NOT NULL
+		)`,
+	}
+	for _, table := range tables {
+		if _, err := bs.db.Exec(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns amount of spam and ham emails learned by the store
+func (bs *Bayes) Stats(store string) (spam, ham int, err error) {
+	err = bs.db.QueryRow("SELECT spam, ham FROM bayes_stores WHERE store = $1", store).Scan(&spam, &ham)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	return spam, ham, err
+}
+
+// Score returns spam probability (0..1) of the tokens,
+// ok is false when the store is not trained enough to classify emails
+func (bs *Bayes) Score(store string, tokens []string) (score float64, ok bool, err error) {
+	nspam, nham, err := bs.Stats(store)
+	if err != nil {
+		return 0, false, err
+	}
+	if nspam < minLearns || nham < minLearns {
+		return 0, false, nil
+	}
+
+	known := make(map[string]counts, len(tokens))
+	for start := 0; start < len(tokens); start += queryChunk {
+		end := start + queryChunk
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		if err := bs.counts(store, tokens[start:end], known); err != nil {
+			return 0, false, err
+		}
+	}
+
+	return classify(nspam, nham, known), true, nil
+}
+
+func (bs *Bayes) counts(store string, tokens []string, known map[string]counts) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(tokens)+1)
+	args = append(args, store)
+	placeholders := make([]string, 0, len(tokens))
+	for i, token := range tokens {
+		args = append(args, token)
+		placeholders = append(placeholders, "$"+strconv.Itoa(i+2))
+	}
+
+	rows, err := bs.db.Query("SELECT token, spam, ham FROM bayes_tokens WHERE store = $1 AND token IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token string
+		var count counts
+		if err := rows.Scan(&token, &count.spam, &count.ham); err != nil {
+			return err
+		}
+		known[token] = count
+	}
+	return rows.Err()
+}
+
+// Remember tokens of the email (by its matrix event ID) to train the store later
+func (bs *Bayes) Remember(id, store string, tokens []string) error {
+	_, err := bs.db.Exec(
+		"INSERT INTO bayes_messages (id, store, tokens, class, created_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING",
+		id, store, strings.Join(tokens, " "), classNone, time.Now().Unix(),
+	)
+	return err
+}
+
+// Train the store with the remembered email, re-training it if it was learned as the opposite class before
+func (bs *Bayes) Train(id string, spam bool) error {
+	class := classHam
+	if spam {
+		class = classSpam
+	}
+
+	tx, err := bs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck // no-op after commit
+
+	var store, tokenString string
+	var oldClass int
+	err = tx.QueryRow("SELECT store, tokens, class FROM bayes_messages WHERE id = $1", id).Scan(&store, &tokenString, &oldClass)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if oldClass == class {
+		return nil
+	}
+
+	tokens := strings.Fields(tokenString)
+	if oldClass != classNone {
+		if err = learn(tx, store, tokens, oldClass, true); err != nil {
+			return err
+		}
+	}
+	if err = learn(tx, store, tokens, class, false); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE bayes_messages SET class = $1 WHERE id = $2", class, id); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	bs.log.Info().Str("id", id).Str("store", store).Bool("spam", spam).Int("tokens", len(tokens)).Msg("bayes store has been trained")
+	return nil
+}
+
+// Prune emails' tokens that are not available for training anymore
+func (bs *Bayes) Prune() {
+	_, err := bs.db.Exec("DELETE FROM bayes_messages WHERE created_at < $1", time.Now().Add(-retention).Unix())
+	if err != nil {
+		bs.log.Error().Err(err).Msg("cannot prune bayes messages")
+	}
+}
+
+// learn adds tokens of the class to the store, or removes them if forget is true
+func learn(tx *sql.Tx, store string, tokens []string, class int, forget bool) error {
+	column := "ham"
+	if class == classSpam {
+		column = "spam"
+	}
+	storeQuery := "INSERT INTO bayes_stores (store, " + column + ") VALUES ($1, 1) " +
+		"ON CONFLICT (store) DO UPDATE SET " + column + " = bayes_stores." + column + " + 1"
+	tokenQuery := "INSERT INTO bayes_tokens (store, token, " + column + ") VALUES ($1, $2, 1) " +
+		"ON CONFLICT (store, token) DO UPDATE SET " + column + " = bayes_tokens." + column + " + 1"
+	if forget {
+		storeQuery = "UPDATE bayes_stores SET " + column + " = " + column + " - 1 WHERE store = $1 AND " + column + " > 0"
+		tokenQuery = "UPDATE bayes_tokens SET " + column + " = " + column + " - 1 WHERE store = $1 AND token = $2 AND " + column + " > 0"
+	}
+
+	if _, err := tx.Exec(storeQuery, store); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(tokenQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, token := range tokens {
+		if _, err := stmt.Exec(store, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
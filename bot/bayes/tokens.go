@@ -0,0 +1,121 @@
+package bayes
+
+import (
+	"math"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+const (
+	minTokenLength = 3
+	maxTokenLength = 40
+	maxTokens      = 1000
+	// interesting is an amount of the most significant tokens used to classify the email
+	interesting = 15
+	// strength and assumed probability of the unknown token (Robinson's smoothing)
+	strength = 1.0
+	assumed  = 0.5
+)
+
+// tokenHeaders are headers used as classification features, prefixed by the header name
+var tokenHeaders = []string{
+	"Reply-To",
+	"Return-Path",
+	"X-Mailer",
+	"User-Agent",
+	"List-Id",
+	"Content-Type",
+}
+
+var htmlTagRegex = regexp.MustCompile(`<[^>]*>`)
+
+// Tokens returns unique tokens of the email subject, body and headers
+func Tokens(eml *email.Email) []string {
+	seen := map[string]struct{}{}
+	tokens := []string{}
+	add := func(prefix, text string) {
+		for _, word := range words(text) {
+			token := prefix + word
+			if _, ok := seen[token]; ok || len(tokens) >= maxTokens {
+				continue
+			}
+			seen[token] = struct{}{}
+			tokens = append(tokens, token)
+		}
+	}
+
+	if eml.From != "" {
+		add("from:", utils.Hostname(eml.From))
+	}
+	add("subject:", eml.Subject)
+	for _, name := range tokenHeaders {
+		for _, value := range eml.Headers[textproto.CanonicalMIMEHeaderKey(name)] {
+			add(strings.ToLower(name)+":", value)
+		}
+	}
+	body := eml.Text
+	if body == "" {
+		body = htmlTagRegex.ReplaceAllString(eml.HTML, " ")
+	}
+	add("", body)
+
+	return tokens
+}
+
+// words splits text into lowercase words
+func words(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '!' && r != '\''
+	})
+	list := make([]string, 0, len(fields))
+	for _, field := range fields {
+		size := len([]rune(field))
+		if size < minTokenLength || size > maxTokenLength {
+			continue
+		}
+		list = append(list, field)
+	}
+	return list
+}
+
+// counts of the token in spam and ham emails
+type counts struct {
+	spam int
+	ham  int
+}
+
+// classify returns spam probability (0..1) using naive Bayes over the most significant tokens
+func classify(nspam, nham int, tokens map[string]counts) float64 {
+	probs := make([]float64, 0, len(tokens))
+	for _, count := range tokens {
+		spamFreq := math.Min(1, float64(count.spam)/float64(nspam))
+		hamFreq := math.Min(1, float64(count.ham)/float64(nham))
+		if spamFreq+hamFreq == 0 {
+			continue
+		}
+		n := float64(count.spam + count.ham)
+		p := (strength*assumed + n*spamFreq/(spamFreq+hamFreq)) / (strength + n)
+		probs = append(probs, math.Max(0.01, math.Min(0.99, p)))
+	}
+	if len(probs) == 0 {
+		return assumed
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > interesting {
+		probs = probs[:interesting]
+	}
+	var logSum float64
+	for _, p := range probs {
+		logSum += math.Log(1-p) - math.Log(p)
+	}
+	return 1 / (1 + math.Exp(logSum))
+}
@@ -0,0 +1,61 @@
+package bayes
+
+import (
+	"testing"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+func TestTokens(t *testing.T) {
+	eml := &email.Email{
+		From:    "Lottery <winner@spam.example.com>",
+		Subject: "You WON $1000000!",
+		HTML:    "<p>Claim your <b>prize</b> now, it's free</p>",
+		Headers: map[string][]string{"X-Mailer": {"MassMailer 3000"}},
+	}
+	expected := map[string]bool{
+		"from:spam":           true,
+		"subject:won":         true,
+		"subject:$1000000!":   true,
+		"x-mailer:massmailer": true,
+		"claim":               true,
+		"prize":               true,
+		"it's":                true,
+		"p":                   false,
+		"now":                 true,
+	}
+
+	tokens := map[string]bool{}
+	for _, token := range Tokens(eml) {
+		if tokens[token] {
+			t.Errorf("duplicated token %q", token)
+		}
+		tokens[token] = true
+	}
+	for token, ok := range expected {
+		if tokens[token] != ok {
+			t.Errorf("token %q: expected %t, got %t", token, ok, tokens[token])
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	known := map[string]counts{
+		"prize":   {spam: 20, ham: 1},
+		"lottery": {spam: 15, ham: 0},
+		"meeting": {spam: 1, ham: 18},
+		"agenda":  {spam: 0, ham: 12},
+	}
+
+	spam := classify(20, 20, map[string]counts{"prize": known["prize"], "lottery": known["lottery"]})
+	if spam < 0.9 {
+		t.Errorf("spam score is too low: %f", spam)
+	}
+	ham := classify(20, 20, map[string]counts{"meeting": known["meeting"], "agenda": known["agenda"]})
+	if ham > 0.1 {
+		t.Errorf("ham score is too high: %f", ham)
+	}
+	if unknown := classify(20, 20, map[string]counts{}); unknown != assumed {
+		t.Errorf("unknown tokens score is %f, expected %f", unknown, assumed)
+	}
+}
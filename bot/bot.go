@@ -11,7 +11,9 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"gitlab.com/etke.cc/postmoogle/bot/bayes"
 	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/bot/inbox"
 	"gitlab.com/etke.cc/postmoogle/bot/queue"
 	"gitlab.com/etke.cc/postmoogle/utils"
 )
@@ -35,18 +37,23 @@ type Bot struct {
 	commands                commandList
 	rooms                   sync.Map
 	proxies                 []string
-	sendmail                func(string, string, string) error
+	sendmail                func(string, []string, string) []error
 	cfg                     *config.Manager
 	log                     *zerolog.Logger
 	lp                      *linkpearl.Linkpearl
 	mu                      utils.Mutex
+	suppressionsMu          sync.Mutex // suppression list is changed by concurrent bounces
 	q                       *queue.Queue
+	ib                      *inbox.Inbox
+	bs                      *bayes.Bayes
 	handledMembershipEvents sync.Map
 }
 
 // New creates a new matrix bot
 func New(
 	q *queue.Queue,
+	ib *inbox.Inbox,
+	bs *bayes.Bayes,
 	lp *linkpearl.Linkpearl,
 	log *zerolog.Logger,
 	cfg *config.Manager,
@@ -68,6 +75,8 @@ func New(
 		lp:         lp,
 		mu:         utils.NewMutex(),
 		q:          q,
+		ib:         ib,
+		bs:         bs,
 	}
 	users, err := b.initBotUsers()
 	if err != nil {
@@ -13,6 +13,7 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/bot/queue"
 	"gitlab.com/etke.cc/postmoogle/email"
 	"gitlab.com/etke.cc/postmoogle/utils"
 )
@@ -25,11 +26,13 @@ const (
 	commandCatchAll       = config.BotCatchAll
 	commandUsers          = config.BotUsers
 	commandQueueBatch     = config.BotQueueBatch
-	commandQueueRetries   = config.BotQueueRetries
+	commandQueueLifetime  = config.BotQueueLifetime
 	commandSpamlist       = "spam:list"
 	commandSpamlistAdd    = "spam:add"
 	commandSpamlistRemove = "spam:remove"
 	commandSpamlistReset  = "spam:reset"
+	commandFilter         = "filter"
+	commandBayesStats     = "bayes:stats"
 	commandDelete         = "delete"
 	commandBanlist        = "banlist"
 	commandBanlistTotals  = "banlist:totals"
@@ -38,7 +41,18 @@ const (
 	commandBanlistAdd     = "banlist:add"
 	commandBanlistRemove  = "banlist:remove"
 	commandBanlistReset   = "banlist:reset"
+	commandDNSBL          = config.BotDNSBL
+	commandDNSBLAdd       = "dnsbl:add"
+	commandDNSBLRemove    = "dnsbl:remove"
+	commandDNSBLThreshold = config.BotDNSBLThreshold
 	commandMailboxes      = "mailboxes"
+	commandInbox          = "inbox"
+	commandInboxRetry     = "inbox:retry"
+	commandInboxRemove    = "inbox:remove"
+	commandSuppressions   = "suppress:list"
+	commandSuppressAdd    = "suppress:add"
+	commandSuppressRemove = "suppress:remove"
+	commandSuppressExpire = "suppress:expire"
 )
 
 type (
@@ -75,7 +89,7 @@ func (b *Bot) initCommands() commandList {
 		},
 		{
 			key:         commandSend,
-			description: "Send email",
+			description: "Send email (with optional `Cc:` and `Bcc:` lines)",
 			allowed:     b.allowSend,
 		},
 		{allowed: b.allowOwner, description: "mailbox ownership"}, // delimiter
@@ -134,6 +148,15 @@ func (b *Bot) initCommands() commandList {
 			sanitizer: utils.SanitizeBoolString,
 			allowed:   b.allowOwner,
 		},
+		{
+			key: config.RoomNoMirror,
+			description: fmt.Sprintf(
+				"Get or set `%s` of the room (`true` - don't post emails sent via SMTP submission; `false` - post emails sent via SMTP submission)",
+				config.RoomNoMirror,
+			),
+			sanitizer: utils.SanitizeBoolString,
+			allowed:   b.allowOwner,
+		},
 		{
 			key: config.RoomNoReplies,
 			description: fmt.Sprintf(
@@ -234,6 +257,12 @@ func (b *Bot) initCommands() commandList {
 			sanitizer:   utils.SanitizeBoolString,
 			allowed:     b.allowOwner,
 		},
+		{
+			key:         config.RoomSpamcheckDMARC,
+			description: "only accept emails that pass DMARC policy of the sender's domain (SPF or DKIM aligned with the From header), `p=quarantine` emails are delivered with a warning (`true` - enable, `false` - disable)",
+			sanitizer:   utils.SanitizeBoolString,
+			allowed:     b.allowOwner,
+		},
 		{
 			key:         config.RoomSpamcheckSMTP,
 			description: "only accept email from servers which seem prepared to receive it (those listening on an SMTP port) (`true` - enable, `false` - disable)",
@@ -249,7 +278,7 @@ func (b *Bot) initCommands() commandList {
 		},
 		{
 			key:         commandSpamlistAdd,
-			description: "Mark an email address (or pattern) as spam (or you can react to the email with emoji: ⛔️,🛑, or 🚫)",
+			description: "Mark an email address (or pattern) as spam (or you can react to the email with emoji: ⛔️,🛑, or 🚫, that also trains the spam classifier)",
 			allowed:     b.allowOwner,
 		},
 		{
@@ -262,6 +291,37 @@ func (b *Bot) initCommands() commandList {
 			description: "Reset spamlist",
 			allowed:     b.allowOwner,
 		},
+		{
+			key:         commandFilter,
+			description: "Manage Sieve-like filtering rules: `filter list`, `filter add RULE`, `filter remove NUMBER`",
+			allowed:     b.allowOwner,
+		},
+		{
+			key: config.RoomBayes,
+			description: fmt.Sprintf(
+				"Get or set token store of the spam classifier (`%s` - trained by this room only; `%s` - shared by all rooms of the server; `reset` - disable). React to the email with ⛔️,🛑, or 🚫 to train it as spam, or with ✅ as not spam",
+				config.BayesStoreRoom, config.BayesStoreServer,
+			),
+			sanitizer: sanitizeBayesStore,
+			allowed:   b.allowOwner,
+		},
+		{
+			key:         config.RoomBayesThreshold,
+			description: "Get or set min spam probability (in percents, default: 90) of the emails classified as spam",
+			sanitizer:   utils.SanitizeIntString,
+			allowed:     b.allowOwner,
+		},
+		{
+			key:         config.RoomBayesReject,
+			description: "Get or set action for the emails classified as spam (`true` - reject; `false` - deliver with the `spam` label)",
+			sanitizer:   utils.SanitizeBoolString,
+			allowed:     b.allowOwner,
+		},
+		{
+			key:         commandBayesStats,
+			description: "Show how many spam and non-spam emails the spam classifier has learned",
+			allowed:     b.allowOwner,
+		},
 		{allowed: b.allowAdmin, description: "server options"}, // delimiter
 		{
 			key:         config.BotAdminRoom,
@@ -290,8 +350,8 @@ func (b *Bot) initCommands() commandList {
 			allowed:     b.allowAdmin,
 		},
 		{
-			key:         commandQueueRetries,
-			description: "max amount of tries per email in queue before removal",
+			key:         commandQueueLifetime,
+			description: "max amount of hours an email stays in queue before removal (default: 120, 5 days)",
 			sanitizer:   utils.SanitizeIntString,
 			allowed:     b.allowAdmin,
 		},
@@ -300,6 +360,41 @@ func (b *Bot) initCommands() commandList {
 			description: "Show the list of all mailboxes",
 			allowed:     b.allowAdmin,
 		},
+		{
+			key:         commandInbox,
+			description: "Show incoming emails that are not delivered to matrix rooms yet",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandInboxRetry,
+			description: "Retry delivery of the incoming email immediately",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandInboxRemove,
+			description: "Remove incoming email from the inbox without delivery",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandSuppressions,
+			description: "Show the suppression list: recipients (email addresses or domains) emails will not be sent to, filled automatically by hard bounces",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandSuppressAdd,
+			description: "Add email addresses or domains to the suppression list",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandSuppressRemove,
+			description: "Remove email addresses or domains from the suppression list",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandSuppressExpire,
+			description: "Remove items older than the specified amount of days from the suppression list, e.g.: `suppress:expire 30`",
+			allowed:     b.allowAdmin,
+		},
 		{
 			key:         commandDelete,
 			description: "Delete specific mailbox",
@@ -311,6 +406,26 @@ func (b *Bot) initCommands() commandList {
 			description: "Set automatic greylisting duration in minutes (0 - disabled)",
 			allowed:     b.allowAdmin,
 		},
+		{
+			key:         commandDNSBL,
+			description: "Show DNS blocklists (DNSBL/RBL) used to check incoming connections",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandDNSBLAdd,
+			description: "Add DNS blocklist with score, e.g.: `dnsbl:add zen.spamhaus.org 10`",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandDNSBLRemove,
+			description: "Remove DNS blocklist",
+			allowed:     b.allowAdmin,
+		},
+		{
+			key:         commandDNSBLThreshold,
+			description: "Get or set min total score of DNS blocklists to reject the sender",
+			allowed:     b.allowAdmin,
+		},
 		{
 			key:         commandBanlist,
 			description: "Enable/disable banlist and show current values",
@@ -404,6 +519,10 @@ func (b *Bot) handle(ctx context.Context) {
 		b.runSpamlistRemove(ctx, commandSlice)
 	case commandSpamlistReset:
 		b.runSpamlistReset(ctx)
+	case commandFilter:
+		b.runFilter(ctx, commandSlice)
+	case commandBayesStats:
+		b.printBayesStats(ctx)
 	case config.BotAdminRoom:
 		b.runAdminRoom(ctx, commandSlice)
 	case commandUsers:
@@ -414,6 +533,14 @@ func (b *Bot) handle(ctx context.Context) {
 		b.runDelete(ctx, commandSlice)
 	case config.BotGreylist:
 		b.runGreylist(ctx, commandSlice)
+	case commandDNSBL:
+		b.printDNSBL(ctx)
+	case commandDNSBLAdd:
+		b.runDNSBLChange(ctx, "add", commandSlice)
+	case commandDNSBLRemove:
+		b.runDNSBLChange(ctx, "remove", commandSlice)
+	case commandDNSBLThreshold:
+		b.runDNSBLThreshold(ctx, commandSlice)
 	case commandBanlist:
 		b.runBanlist(ctx, commandSlice)
 	case commandBanlistAuth:
@@ -430,6 +557,20 @@ func (b *Bot) handle(ctx context.Context) {
 		b.runBanlistReset(ctx)
 	case commandMailboxes:
 		b.sendMailboxes(ctx)
+	case commandInbox:
+		b.sendInbox(ctx)
+	case commandInboxRetry:
+		b.runInboxChange(ctx, "retry", commandSlice)
+	case commandInboxRemove:
+		b.runInboxChange(ctx, "remove", commandSlice)
+	case commandSuppressions:
+		b.sendSuppressions(ctx)
+	case commandSuppressAdd:
+		b.runSuppressionsChange(ctx, "add", commandSlice)
+	case commandSuppressRemove:
+		b.runSuppressionsChange(ctx, "remove", commandSlice)
+	case commandSuppressExpire:
+		b.runSuppressionsExpire(ctx, commandSlice)
 	default:
 		b.handleOption(ctx, commandSlice)
 	}
@@ -533,7 +674,7 @@ func (b *Bot) sendHelp(ctx context.Context) {
 
 func (b *Bot) runSend(ctx context.Context) {
 	evt := eventFromContext(ctx)
-	to, subject, body, shouldSend := b.getSendDetails(ctx)
+	msg, shouldSend := b.getSendDetails(ctx)
 	if !shouldSend {
 		return
 	}
@@ -546,67 +687,77 @@ func (b *Bot) runSend(ctx context.Context) {
 
 	var htmlBody string
 	if !cfg.NoHTML() {
-		htmlBody = format.RenderMarkdown(body, true, true).FormattedBody
+		htmlBody = format.RenderMarkdown(msg.Body, true, true).FormattedBody
 	}
 
-	tos := strings.Split(to, ",")
-	b.runSendCommand(ctx, cfg, tos, subject, body, htmlBody)
+	b.runSendCommand(ctx, cfg, msg, htmlBody)
 }
 
-func (b *Bot) getSendDetails(ctx context.Context) (to, subject, body string, ok bool) {
+func (b *Bot) getSendDetails(ctx context.Context) (*utils.SendMessage, bool) {
 	evt := eventFromContext(ctx)
 	if !b.allowSend(evt.Sender, evt.RoomID) {
-		return "", "", "", false
+		return nil, false
 	}
 
 	cfg, err := b.cfg.GetRoom(evt.RoomID)
 	if err != nil {
 		b.Error(ctx, "failed to retrieve room settings: %v", err)
-		return "", "", "", false
+		return nil, false
 	}
 
 	commandSlice := b.parseCommand(evt.Content.AsMessage().Body, false)
-	to, subject, body, err = utils.ParseSend(commandSlice)
+	msg, err := utils.ParseSend(commandSlice)
 	if errors.Is(err, utils.ErrInvalidArgs) {
 		b.lp.SendNotice(evt.RoomID, fmt.Sprintf(
 			"Usage:\n"+
 				"```\n"+
-				"%s send someone@example.com\n"+
+				"%s send someone@example.com, someone.else@example.com\n"+
+				"Cc: copy@example.com\n"+
+				"Bcc: hidden.copy@example.com\n"+
 				"Subject goes here on a line of its own\n"+
 				"Email content goes here\n"+
 				"on as many lines\n"+
 				"as you want.\n"+
-				"```",
+				"```\n"+
+				"`Cc:` and `Bcc:` lines are optional, recipients may be listed on the `To:` line instead of the command line",
 			b.prefix),
 			linkpearl.RelatesTo(evt.ID, cfg.NoThreads()),
 		)
-		return "", "", "", false
+		return nil, false
 	}
 
 	mailbox := cfg.Mailbox()
 	if mailbox == "" {
 		b.lp.SendNotice(evt.RoomID, "mailbox is not configured, kupo", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
-		return "", "", "", false
+		return nil, false
 	}
 
 	signature := cfg.Signature()
 	if signature != "" {
-		body += "\n\n---\n" + signature
+		msg.Body += "\n\n---\n" + signature
 	}
 
-	return to, subject, body, true
+	return msg, true
 }
 
-func (b *Bot) runSendCommand(ctx context.Context, cfg config.Room, tos []string, subject, body, htmlBody string) {
+func (b *Bot) runSendCommand(ctx context.Context, cfg config.Room, msg *utils.SendMessage, htmlBody string) {
 	evt := eventFromContext(ctx)
 
 	// validate first
-	for _, to := range tos {
+	for _, to := range msg.Recipients() {
 		if !email.AddressValid(to) {
-			b.Error(ctx, "email address is not valid")
+			b.Error(ctx, "email address %s is not valid", to)
 			return
 		}
 	}
+	recipients, suppressed := b.filterSuppressed(msg.Recipients())
+	b.warnSuppressed(ctx, suppressed)
+	if len(recipients) == 0 {
+		return
+	}
+	msg.To = dropSuppressed(msg.To, suppressed)
+	msg.CC = dropSuppressed(msg.CC, suppressed)
+	msg.BCC = dropSuppressed(msg.BCC, suppressed)
 
 	b.lock(evt.RoomID, evt.ID)
 	defer b.unlock(evt.RoomID, evt.ID)
@@ -614,27 +765,50 @@ func (b *Bot) runSendCommand(ctx context.Context, cfg config.Room, tos []string,
 	domain := utils.SanitizeDomain(cfg.Domain())
 	from := cfg.Mailbox() + "@" + domain
 	ID := email.MessageID(evt.ID, domain)
-	for _, to := range tos {
-		recipients := []string{to}
-		eml := email.New(ID, "", " "+ID, subject, from, to, to, "", body, htmlBody, nil, nil)
-		data := eml.Compose(b.cfg.GetBot().DKIMPrivateKey())
-		if data == "" {
-			b.lp.SendNotice(evt.RoomID, "email body is empty", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
-			return
-		}
-		queued, err := b.Sendmail(evt.ID, from, to, data)
-		if queued {
-			b.log.Warn().Err(err).Msg("email has been queued")
-			b.saveSentMetadata(ctx, queued, evt.ID, recipients, eml, cfg)
-			continue
-		}
-		if err != nil {
-			b.Error(ctx, "cannot send email to %s: %v", to, err)
+	to := strings.Join(msg.To, ",")
+	eml := email.New(ID, "", " "+ID, msg.Subject, from, to, to, strings.Join(msg.CC, ","), msg.Body, htmlBody, nil, nil)
+	eml.BCC = msg.BCC
+	data := eml.Compose(b.cfg.GetBot().DKIMPrivateKey())
+	if data == "" {
+		b.lp.SendNotice(evt.RoomID, "email body is empty", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+		return
+	}
+
+	queued, failed := b.Sendmail(queue.Origin{RoomID: evt.RoomID, ThreadID: evt.ID, EventID: evt.ID, MessageID: ID}, from, recipients, data)
+	sent := make([]string, 0, len(recipients))
+	for _, rcpt := range recipients {
+		if err := failed[rcpt]; err != nil {
+			b.Error(ctx, "cannot send email to %s: %v", rcpt, err)
 			continue
 		}
-		b.saveSentMetadata(ctx, false, evt.ID, recipients, eml, cfg)
+		sent = append(sent, rcpt)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	text := "Email has been sent to " + sendGroups(msg)
+	if queued {
+		text = "Email to " + sendGroups(msg) + " has been queued"
+	}
+	b.saveSentMetadata(ctx, queued, evt.ID, sent, eml, cfg, text)
+}
+
+// sendGroups describes recipients of the email by groups, e.g.: a@example.com (cc: b@example.com; bcc: c@example.com)
+func sendGroups(msg *utils.SendMessage) string {
+	groups := strings.Join(msg.To, ", ")
+	var copies []string
+	if len(msg.CC) > 0 {
+		copies = append(copies, "cc: "+strings.Join(msg.CC, ", "))
+	}
+	if len(msg.BCC) > 0 {
+		copies = append(copies, "bcc: "+strings.Join(msg.BCC, ", "))
+	}
+	if len(copies) == 0 {
+		return groups
 	}
-	if len(tos) > 1 {
-		b.lp.SendNotice(evt.RoomID, "All emails were sent.", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+	if groups == "" {
+		return strings.Join(copies, "; ")
 	}
+	return groups + " (" + strings.Join(copies, "; ") + ")"
 }
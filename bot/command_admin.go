@@ -2,6 +2,7 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sort"
@@ -14,6 +15,7 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/bot/inbox"
 	"gitlab.com/etke.cc/postmoogle/utils"
 )
 
@@ -67,6 +69,138 @@ func (b *Bot) sendMailboxes(ctx context.Context) {
 	b.lp.SendNotice(evt.RoomID, msg.String(), linkpearl.RelatesTo(evt.ID))
 }
 
+func (b *Bot) sendInbox(ctx context.Context) {
+	evt := eventFromContext(ctx)
+	items, err := b.ib.List()
+	if err != nil {
+		b.Error(ctx, "cannot get inbox: %v", err)
+		return
+	}
+	if len(items) == 0 {
+		b.lp.SendNotice(evt.RoomID, "Inbox is empty, kupo!", linkpearl.RelatesTo(evt.ID))
+		return
+	}
+
+	var msg strings.Builder
+	msg.WriteString("The following incoming emails are not delivered yet:\n")
+	for _, item := range items {
+		msg.WriteString("* `")
+		msg.WriteString(item.ID)
+		msg.WriteString("` from ")
+		msg.WriteString(item.From)
+		msg.WriteString(" to ")
+		msg.WriteString(item.To)
+		msg.WriteString(", received ")
+		msg.WriteString(item.CreatedAt.UTC().Format(time.RFC1123))
+		if item.Attempts > 0 {
+			msg.WriteString(fmt.Sprintf(", %d attempts, next at %s, last error: `%s`", item.Attempts, item.NextAttempt.UTC().Format(time.RFC1123), item.LastError))
+		}
+		msg.WriteString("\n")
+	}
+
+	b.lp.SendNotice(evt.RoomID, msg.String(), linkpearl.RelatesTo(evt.ID))
+}
+
+func (b *Bot) runInboxChange(ctx context.Context, mode string, commandSlice []string) {
+	evt := eventFromContext(ctx)
+	if len(commandSlice) < 2 {
+		b.lp.SendNotice(evt.RoomID, fmt.Sprintf("Usage: `%s inbox:%s ID`", b.prefix, mode), linkpearl.RelatesTo(evt.ID))
+		return
+	}
+
+	var err error
+	switch mode {
+	case "retry":
+		err = b.ib.Retry(commandSlice[1])
+	case "remove":
+		err = b.ib.Remove(commandSlice[1])
+	}
+	if errors.Is(err, inbox.ErrNotFound) {
+		b.lp.SendNotice(evt.RoomID, "inbox item does not exists, kupo", linkpearl.RelatesTo(evt.ID))
+		return
+	}
+	if err != nil {
+		b.Error(ctx, "cannot %s inbox item: %v", mode, err)
+		return
+	}
+
+	b.lp.SendNotice(evt.RoomID, "inbox has been updated", linkpearl.RelatesTo(evt.ID))
+}
+
+func (b *Bot) sendSuppressions(ctx context.Context) {
+	evt := eventFromContext(ctx)
+	suppressions := b.cfg.GetSuppressions()
+	if len(suppressions) == 0 {
+		b.lp.SendNotice(evt.RoomID, "suppression list is empty, kupo.", linkpearl.RelatesTo(evt.ID))
+		return
+	}
+
+	for _, chunk := range utils.Chunks(suppressions.Slice(), 50) {
+		var msg strings.Builder
+		for _, item := range chunk {
+			reason, since, _ := suppressions.Get(item)
+			msg.WriteString("* `")
+			msg.WriteString(item)
+			msg.WriteString("` since ")
+			msg.WriteString(since.Format(time.RFC1123))
+			if reason != "" {
+				msg.WriteString(": ")
+				msg.WriteString(reason)
+			}
+			msg.WriteString("\n")
+		}
+		b.lp.SendNotice(evt.RoomID, msg.String(), linkpearl.RelatesTo(evt.ID))
+	}
+}
+
+func (b *Bot) runSuppressionsChange(ctx context.Context, mode string, commandSlice []string) {
+	evt := eventFromContext(ctx)
+	if len(commandSlice) < 2 {
+		b.lp.SendNotice(evt.RoomID, fmt.Sprintf("Usage: `%s suppress:%s ADDRESS_OR_DOMAIN1 ADDRESS_OR_DOMAIN2...`", b.prefix, mode), linkpearl.RelatesTo(evt.ID))
+		return
+	}
+	b.suppressionsMu.Lock()
+	defer b.suppressionsMu.Unlock()
+	suppressions := b.cfg.GetSuppressions()
+	for _, item := range commandSlice[1:] {
+		if mode == "remove" {
+			suppressions.Remove(item)
+			continue
+		}
+		suppressions.Add(item, "added by "+evt.Sender.String())
+	}
+
+	if err := b.cfg.SetSuppressions(suppressions); err != nil {
+		b.Error(ctx, "cannot set suppression list: %v", err)
+		return
+	}
+
+	b.lp.SendNotice(evt.RoomID, "suppression list has been updated, kupo", linkpearl.RelatesTo(evt.ID))
+}
+
+func (b *Bot) runSuppressionsExpire(ctx context.Context, commandSlice []string) {
+	evt := eventFromContext(ctx)
+	days := 0
+	if len(commandSlice) > 1 {
+		days = utils.Int(commandSlice[1])
+	}
+	if days <= 0 {
+		b.lp.SendNotice(evt.RoomID, fmt.Sprintf("Usage: `%s suppress:expire DAYS`", b.prefix), linkpearl.RelatesTo(evt.ID))
+		return
+	}
+
+	b.suppressionsMu.Lock()
+	defer b.suppressionsMu.Unlock()
+	suppressions := b.cfg.GetSuppressions()
+	expired := suppressions.Expire(time.Now().UTC().AddDate(0, 0, -days))
+	if err := b.cfg.SetSuppressions(suppressions); err != nil {
+		b.Error(ctx, "cannot set suppression list: %v", err)
+		return
+	}
+
+	b.lp.SendNotice(evt.RoomID, fmt.Sprintf("%d items have been removed from the suppression list, kupo", expired), linkpearl.RelatesTo(evt.ID))
+}
+
 func (b *Bot) runDelete(ctx context.Context, commandSlice []string) {
 	evt := eventFromContext(ctx)
 	if len(commandSlice) < 2 {
@@ -297,6 +431,96 @@ func (b *Bot) runGreylist(ctx context.Context, commandSlice []string) {
 	b.lp.SendNotice(evt.RoomID, "greylist duration has been updated", linkpearl.RelatesTo(evt.ID))
 }
 
+func (b *Bot) printDNSBL(ctx context.Context) {
+	evt := eventFromContext(ctx)
+	cfg := b.cfg.GetBot()
+	lists := cfg.DNSBL()
+	var msg strings.Builder
+	if len(lists) == 0 {
+		msg.WriteString("DNS blocklists are not configured.\n\n")
+	} else {
+		zones := make([]string, 0, len(lists))
+		for zone := range lists {
+			zones = append(zones, zone)
+		}
+		sort.Strings(zones)
+
+		msg.WriteString("Reject threshold: `")
+		msg.WriteString(strconv.Itoa(cfg.DNSBLThreshold()))
+		msg.WriteString("`\n\n")
+		for _, zone := range zones {
+			msg.WriteString("* `")
+			msg.WriteString(zone)
+			msg.WriteString("` - score: ")
+			msg.WriteString(strconv.Itoa(lists[zone]))
+			msg.WriteString("\n")
+		}
+		msg.WriteString("\n")
+	}
+	msg.WriteString("To add a blocklist: `")
+	msg.WriteString(b.prefix)
+	msg.WriteString(" dnsbl:add ZONE SCORE`, ")
+	msg.WriteString("senders with total score of all blocklists they are listed in equal or above the threshold will be rejected")
+
+	b.lp.SendNotice(evt.RoomID, msg.String(), linkpearl.RelatesTo(evt.ID))
+}
+
+func (b *Bot) runDNSBLChange(ctx context.Context, mode string, commandSlice []string) {
+	evt := eventFromContext(ctx)
+	if len(commandSlice) < 2 {
+		b.printDNSBL(ctx)
+		return
+	}
+	zone := strings.Trim(commandSlice[1], ".")
+	if !strings.Contains(zone, ".") || strings.ContainsAny(zone, ": ") {
+		b.lp.SendNotice(evt.RoomID, "invalid DNS blocklist zone, kupo", linkpearl.RelatesTo(evt.ID))
+		return
+	}
+	score := 1
+	if len(commandSlice) > 2 {
+		score = utils.Int(commandSlice[2])
+	}
+	if score <= 0 {
+		b.lp.SendNotice(evt.RoomID, "score must be a positive number, kupo", linkpearl.RelatesTo(evt.ID))
+		return
+	}
+
+	cfg := b.cfg.GetBot()
+	lists := cfg.DNSBL()
+	if mode == "remove" {
+		delete(lists, zone)
+	} else {
+		lists[zone] = score
+	}
+	items := make([]string, 0, len(lists))
+	for zone, score := range lists {
+		items = append(items, zone+":"+strconv.Itoa(score))
+	}
+	sort.Strings(items)
+	cfg.Set(config.BotDNSBL, strings.Join(items, " "))
+	if err := b.cfg.SetBot(cfg); err != nil {
+		b.Error(ctx, "cannot set bot config: %v", err)
+		return
+	}
+
+	b.lp.SendNotice(evt.RoomID, "DNS blocklists have been updated, kupo", linkpearl.RelatesTo(evt.ID))
+}
+
+func (b *Bot) runDNSBLThreshold(ctx context.Context, commandSlice []string) {
+	evt := eventFromContext(ctx)
+	cfg := b.cfg.GetBot()
+	if len(commandSlice) < 2 {
+		b.lp.SendNotice(evt.RoomID, "Currently: `"+strconv.Itoa(cfg.DNSBLThreshold())+"`", linkpearl.RelatesTo(evt.ID))
+		return
+	}
+	cfg.Set(config.BotDNSBLThreshold, utils.SanitizeIntString(commandSlice[1]))
+	if err := b.cfg.SetBot(cfg); err != nil {
+		b.Error(ctx, "cannot set bot config: %v", err)
+		return
+	}
+	b.lp.SendNotice(evt.RoomID, "DNS blocklists threshold has been updated", linkpearl.RelatesTo(evt.ID))
+}
+
 func (b *Bot) runBanlist(ctx context.Context, commandSlice []string) {
 	evt := eventFromContext(ctx)
 	cfg := b.cfg.GetBot()
@@ -11,6 +11,7 @@ import (
 	"golang.org/x/exp/slices"
 
 	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/bot/filter"
 	"gitlab.com/etke.cc/postmoogle/utils"
 )
 
@@ -292,3 +293,77 @@ func (b *Bot) runSpamlistReset(ctx context.Context) {
 
 	b.lp.SendNotice(evt.RoomID, "spamlist has been reset, kupo.", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
 }
+
+func (b *Bot) runFilter(ctx context.Context, commandSlice []string) {
+	evt := eventFromContext(ctx)
+	cfg, err := b.cfg.GetRoom(evt.RoomID)
+	if err != nil {
+		b.Error(ctx, "cannot get room settings: %v", err)
+		return
+	}
+	if len(commandSlice) < 2 {
+		commandSlice = append(commandSlice, "list")
+	}
+
+	filters := cfg.Filters()
+	switch commandSlice[1] {
+	case "add":
+		// get original value, without forced lower case
+		src := strings.Join(b.parseCommand(evt.Content.AsMessage().Body, false)[2:], " ")
+		rule, perr := filter.Parse(src)
+		if perr != nil {
+			b.lp.SendNotice(evt.RoomID, fmt.Sprintf("cannot parse the rule: %v", perr), linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+			return
+		}
+		filters = append(filters, rule.Source)
+	case "remove":
+		idx := 0
+		if len(commandSlice) > 2 {
+			idx = utils.Int(commandSlice[2])
+		}
+		if idx < 1 || idx > len(filters) {
+			b.lp.SendNotice(evt.RoomID, "there is no filtering rule with that number, kupo", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+			return
+		}
+		filters = append(filters[:idx-1], filters[idx:]...)
+	default:
+		b.sendFilters(ctx, filters, cfg.NoThreads())
+		return
+	}
+
+	cfg.Set(config.RoomFilters, strings.Join(filters, "\n"))
+	err = b.cfg.SetRoom(evt.RoomID, cfg)
+	if err != nil {
+		b.Error(ctx, "cannot store room settings: %v", err)
+		return
+	}
+
+	b.lp.SendNotice(evt.RoomID, "filtering rules have been updated, kupo", linkpearl.RelatesTo(evt.ID, cfg.NoThreads()))
+}
+
+func (b *Bot) sendFilters(ctx context.Context, filters []string, noThreads bool) {
+	evt := eventFromContext(ctx)
+	var msg strings.Builder
+	if len(filters) == 0 {
+		msg.WriteString("There are no filtering rules yet.\n\n")
+	} else {
+		msg.WriteString("Filtering rules of this room (applied in order):\n\n")
+		for i, rule := range filters {
+			msg.WriteString(strconv.Itoa(i + 1))
+			msg.WriteString(". `")
+			msg.WriteString(rule)
+			msg.WriteString("`\n")
+		}
+		msg.WriteString("\n")
+	}
+	msg.WriteString("To add a rule, send `")
+	msg.WriteString(b.prefix)
+	msg.WriteString(" filter add RULE`, e.g.: `")
+	msg.WriteString(b.prefix)
+	msg.WriteString(` filter add if header :contains "list-id" "announce" { addflag "news"; noautoreply; }`)
+	msg.WriteString("`\nTo remove a rule, send `")
+	msg.WriteString(b.prefix)
+	msg.WriteString(" filter remove NUMBER`")
+
+	b.lp.SendNotice(evt.RoomID, msg.String(), linkpearl.RelatesTo(evt.ID, noThreads))
+}
@@ -19,11 +19,13 @@ const (
 	BotDKIMSignature       = "dkim.pub"
 	BotDKIMPrivateKey      = "dkim.pem"
 	BotQueueBatch          = "queue:batch"
-	BotQueueRetries        = "queue:retries"
+	BotQueueLifetime       = "queue:lifetime"
 	BotBanlistEnabled      = "banlist:enabled"
 	BotBanlistAuto         = "banlist:auto"
 	BotBanlistAuth         = "banlist:auth"
 	BotGreylist            = "greylist"
+	BotDNSBL               = "dnsbl"
+	BotDNSBLThreshold      = "dnsbl:threshold"
 	BotMautrix015Migration = "mautrix015migration"
 )
 
@@ -89,6 +91,30 @@ func (s Bot) Greylist() int {
 	return utils.Int(s.Get(BotGreylist))
 }
 
+// DNSBL option (map of DNS blocklist zone and its score)
+func (s Bot) DNSBL() map[string]int {
+	lists := map[string]int{}
+	for _, item := range strings.Fields(s.Get(BotDNSBL)) {
+		zone, score, _ := strings.Cut(item, ":")
+		lists[zone] = utils.Int(score)
+		if lists[zone] <= 0 {
+			lists[zone] = 1
+		}
+	}
+
+	return lists
+}
+
+// DNSBLThreshold option (min total score to reject)
+func (s Bot) DNSBLThreshold() int {
+	threshold := utils.Int(s.Get(BotDNSBLThreshold))
+	if threshold <= 0 {
+		return 1
+	}
+
+	return threshold
+}
+
 // DKIMSignature (DNS TXT record)
 func (s Bot) DKIMSignature() string {
 	return s.Get(BotDKIMSignature)
@@ -104,7 +130,7 @@ func (s Bot) QueueBatch() int {
 	return utils.Int(s.Get(BotQueueBatch))
 }
 
-// QueueRetries option
-func (s Bot) QueueRetries() int {
-	return utils.Int(s.Get(BotQueueRetries))
+// QueueLifetime option (hours)
+func (s Bot) QueueLifetime() int {
+	return utils.Int(s.Get(BotQueueLifetime))
 }
@@ -114,3 +114,30 @@ func (m *Manager) GetGreylist() List {
 func (m *Manager) SetGreylist(cfg List) error {
 	return m.lp.SetAccountData(acGreylistKey, cfg)
 }
+
+// GetSuppressions config
+func (m *Manager) GetSuppressions() Suppressions {
+	m.mu.Lock("suppressions")
+	defer m.mu.Unlock("suppressions")
+	config, err := m.lp.GetAccountData(acSuppressionsKey)
+	if err != nil {
+		m.log.Error().Err(err).Msg("cannot get suppression list")
+	}
+	if config == nil {
+		config = make(Suppressions, 0)
+		return config
+	}
+
+	return config
+}
+
+// SetSuppressions config
+func (m *Manager) SetSuppressions(cfg Suppressions) error {
+	m.mu.Lock("suppressions")
+	defer m.mu.Unlock("suppressions")
+	if cfg == nil {
+		cfg = make(Suppressions, 0)
+	}
+
+	return m.lp.SetAccountData(acSuppressionsKey, cfg)
+}
@@ -30,16 +30,31 @@ const (
 	RoomNoRecipient = "norecipient"
 	RoomNoReplies   = "noreplies"
 	RoomNoSend      = "nosend"
+	RoomNoMirror    = "nomirror"
 	RoomNoSender    = "nosender"
 	RoomNoSubject   = "nosubject"
 	RoomNoThreads   = "nothreads"
 
-	RoomSpamcheckDKIM = "spamcheck:dkim"
-	RoomSpamcheckMX   = "spamcheck:mx"
-	RoomSpamcheckSMTP = "spamcheck:smtp"
-	RoomSpamcheckSPF  = "spamcheck:spf"
+	RoomSpamcheckDKIM  = "spamcheck:dkim"
+	RoomSpamcheckDMARC = "spamcheck:dmarc"
+	RoomSpamcheckMX    = "spamcheck:mx"
+	RoomSpamcheckSMTP  = "spamcheck:smtp"
+	RoomSpamcheckSPF   = "spamcheck:spf"
 
 	RoomSpamlist = "spamlist"
+	RoomFilters  = "filters"
+
+	RoomBayes          = "bayes"
+	RoomBayesThreshold = "bayes:threshold"
+	RoomBayesReject    = "bayes:reject"
+)
+
+// bayes token stores
+const (
+	BayesStoreRoom   = "room"
+	BayesStoreServer = "server"
+
+	defaultBayesThreshold = 90
 )
 
 // Get option
@@ -116,6 +131,11 @@ func (s Room) NoThreads() bool {
 	return utils.Bool(s.Get(RoomNoThreads))
 }
 
+// NoMirror returns true if emails sent via SMTP submission should not be posted into the room
+func (s Room) NoMirror() bool {
+	return utils.Bool(s.Get(RoomNoMirror))
+}
+
 func (s Room) NoFiles() bool {
 	return utils.Bool(s.Get(RoomNoFiles))
 }
@@ -140,6 +160,29 @@ func (s Room) SpamcheckMX() bool {
 	return utils.Bool(s.Get(RoomSpamcheckMX))
 }
 
+func (s Room) SpamcheckDMARC() bool {
+	return utils.Bool(s.Get(RoomSpamcheckDMARC))
+}
+
+// Bayes returns token store of the bayes spam classifier (room or server), empty if disabled
+func (s Room) Bayes() string {
+	return s.Get(RoomBayes)
+}
+
+// BayesThreshold returns min spam probability (in percents) of the spam emails
+func (s Room) BayesThreshold() int {
+	threshold := utils.Int(s.Get(RoomBayesThreshold))
+	if threshold <= 0 || threshold > 100 {
+		return defaultBayesThreshold
+	}
+	return threshold
+}
+
+// BayesReject returns true if spam emails should be rejected instead of being flagged
+func (s Room) BayesReject() bool {
+	return s.Bayes() != "" && utils.Bool(s.Get(RoomBayesReject))
+}
+
 func (s Room) Spamlist() []string {
 	return utils.StringSlice(s.Get(RoomSpamlist))
 }
@@ -202,11 +245,24 @@ func (s Room) ContentOptions() *email.ContentOptions {
 
 		ToKey:         "cc.etke.postmoogle.to",
 		CcKey:         "cc.etke.postmoogle.cc",
+		BccKey:        "cc.etke.postmoogle.bcc",
 		FromKey:       "cc.etke.postmoogle.from",
 		RcptToKey:     "cc.etke.postmoogle.rcptTo",
 		SubjectKey:    "cc.etke.postmoogle.subject",
 		InReplyToKey:  "cc.etke.postmoogle.inReplyTo",
 		MessageIDKey:  "cc.etke.postmoogle.messageID",
 		ReferencesKey: "cc.etke.postmoogle.references",
+		AuthKey:       "cc.etke.postmoogle.auth",
+		ScanKey:       "cc.etke.postmoogle.scan",
 	}
 }
+
+// Filters option (list of filtering rules)
+func (s Room) Filters() []string {
+	value := s.Get(RoomFilters)
+	if value == "" {
+		return []string{}
+	}
+
+	return strings.Split(value, "\n")
+}
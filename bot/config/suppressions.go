@@ -0,0 +1,71 @@
+package config
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// account data key
+const acSuppressionsKey = "cc.etke.postmoogle.suppressions"
+
+// Suppressions is a list of recipients (email addresses or whole domains) that emails must not be sent to,
+// value is "<RFC1123Z time>; <reason>"
+type Suppressions map[string]string
+
+// Slice returns sorted slice of suppressed recipients
+func (s Suppressions) Slice() []string {
+	slice := make([]string, 0, len(s))
+	for item := range s {
+		slice = append(slice, item)
+	}
+	sort.Strings(slice)
+
+	return slice
+}
+
+// Get reason and time of the recipient's suppression (by email address or its domain)
+func (s Suppressions) Get(addr string) (reason string, since time.Time, ok bool) {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	value, ok := s[addr]
+	if !ok {
+		value, ok = s[utils.Hostname(addr)]
+	}
+	if !ok {
+		return "", time.Time{}, false
+	}
+
+	ts, reason, _ := strings.Cut(value, ";")
+	since, _ = time.Parse(time.RFC1123Z, ts) //nolint:errcheck // zero time is fine
+	return strings.TrimSpace(reason), since, true
+}
+
+// Add recipient (email address or domain) to the suppression list
+func (s Suppressions) Add(item, reason string) {
+	key := strings.ToLower(strings.TrimSpace(item))
+	if _, ok := s[key]; ok {
+		return
+	}
+
+	s[key] = time.Now().UTC().Format(time.RFC1123Z) + "; " + reason
+}
+
+// Remove recipient (email address or domain) from the suppression list
+func (s Suppressions) Remove(item string) {
+	delete(s, strings.ToLower(strings.TrimSpace(item)))
+}
+
+// Expire removes recipients suppressed before the specified time, returns amount of removed items
+func (s Suppressions) Expire(before time.Time) int {
+	var expired int
+	for item := range s {
+		if _, since, _ := s.Get(item); since.Before(before) {
+			delete(s, item)
+			expired++
+		}
+	}
+
+	return expired
+}
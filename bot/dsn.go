@@ -0,0 +1,118 @@
+package bot
+
+import (
+	"strings"
+
+	"gitlab.com/etke.cc/linkpearl"
+	"golang.org/x/exp/slices"
+	"maunium.net/go/mautrix/id"
+
+	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// acSentNoticePrefix is a prefix of the account data key with event ID of the "Email has been sent" notice
+const acSentNoticePrefix = "cc.etke.postmoogle.sent"
+
+// reactionFailed marks the sent email's notice as failed
+const reactionFailed = "❌"
+
+// handleDSN posts delivery status notification (bounce) into the thread of the original email,
+// returns false if the email is not a bounce of the email sent from the room.
+// Bounces are matched by Message-Id of the original email only, VERP return paths are not used
+func (b *Bot) handleDSN(roomID id.RoomID, cfg config.Room, eml *email.Email) bool {
+	if eml.MailFrom != "" { // bounces are sent with null reverse-path
+		return false
+	}
+	b.mu.Lock(roomID.String())
+	defer b.mu.Unlock(roomID.String())
+
+	messageID := eml.DSN.MessageID
+	if messageID == "" {
+		messageID = eml.InReplyTo
+	}
+	noticeID, sentTo := b.getSentNotice(roomID, messageID)
+	if noticeID == "" {
+		return false
+	}
+	threadID := b.getThreadID(roomID, messageID, "")
+	if threadID == "" {
+		return false
+	}
+
+	var text strings.Builder
+	var failed bool
+	for _, rcpt := range eml.DSN.Recipients {
+		if !slices.Contains(sentTo, strings.ToLower(rcpt.Recipient)) {
+			b.log.Warn().Str("roomID", roomID.String()).Str("rcpt", rcpt.Recipient).Msg("delivery status of the unknown recipient, skipping")
+			continue
+		}
+		if rcpt.Permanent() && suppressible(rcpt.Status) {
+			b.suppress(rcpt.Recipient, strings.TrimSpace(rcpt.Status+" "+rcpt.Diagnostic))
+		}
+		switch rcpt.Action {
+		case email.DSNFailed:
+			failed = true
+			text.WriteString("Email delivery to " + rcpt.Recipient + " failed")
+		case email.DSNDelayed:
+			text.WriteString("Email delivery to " + rcpt.Recipient + " is delayed")
+		default:
+			continue
+		}
+		if rcpt.Status != "" {
+			text.WriteString(" (" + rcpt.Status + ")")
+		}
+		if rcpt.Diagnostic != "" {
+			text.WriteString(": " + rcpt.Diagnostic)
+		}
+		text.WriteString("\n\n")
+	}
+	if text.Len() == 0 {
+		return true
+	}
+
+	b.log.Info().Str("roomID", roomID.String()).Str("messageID", eml.DSN.MessageID).Msg("delivery status notification has been received")
+	b.lp.SendNotice(roomID, strings.TrimSpace(text.String()), linkpearl.RelatesTo(threadID, cfg.NoThreads()))
+	if !failed {
+		return true
+	}
+	if _, err := b.lp.GetClient().SendReaction(roomID, noticeID, reactionFailed); err != nil {
+		b.log.Error().Err(err).Str("roomID", roomID.String()).Str("eventID", noticeID.String()).Msg("cannot mark sent email as failed")
+	}
+	return true
+}
+
+func (b *Bot) getSentNoticeID(roomID id.RoomID, messageID string) id.EventID {
+	noticeID, _ := b.getSentNotice(roomID, messageID)
+	return noticeID
+}
+
+// getSentNotice returns event ID of the sent email's notice and recipients of the email
+func (b *Bot) getSentNotice(roomID id.RoomID, messageID string) (id.EventID, []string) {
+	if messageID == "" {
+		return "", nil
+	}
+	key := acSentNoticePrefix + "." + messageID
+	data, err := b.lp.GetRoomAccountData(roomID, key)
+	if err != nil {
+		b.log.Error().Err(err).Str("key", key).Msg("cannot retrieve sent notice ID")
+		return "", nil
+	}
+	var recipients []string
+	if data["recipients"] != "" {
+		recipients = strings.Split(data["recipients"], ",")
+	}
+	return id.EventID(data["eventID"]), recipients
+}
+
+func (b *Bot) setSentNoticeID(roomID id.RoomID, messageID string, eventID id.EventID, recipients []string) {
+	key := acSentNoticePrefix + "." + messageID
+	addrs := make([]string, 0, len(recipients))
+	for _, rcpt := range recipients {
+		addrs = append(addrs, strings.ToLower(email.Address(rcpt)))
+	}
+	err := b.lp.SetRoomAccountData(roomID, key, map[string]string{"eventID": eventID.String(), "recipients": strings.Join(addrs, ",")})
+	if err != nil {
+		b.log.Error().Err(err).Str("key", key).Msg("cannot save sent notice ID")
+	}
+}
@@ -3,14 +3,24 @@ package bot
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
 	"strings"
+	"time"
 
 	"gitlab.com/etke.cc/linkpearl"
+	"golang.org/x/exp/slices"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
+	"gitlab.com/etke.cc/postmoogle/bot/bayes"
 	"gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/bot/filter"
+	"gitlab.com/etke.cc/postmoogle/bot/inbox"
+	"gitlab.com/etke.cc/postmoogle/bot/queue"
 	"gitlab.com/etke.cc/postmoogle/email"
 	"gitlab.com/etke.cc/postmoogle/utils"
 )
@@ -29,47 +39,158 @@ const (
 	eventFromKey       = "cc.etke.postmoogle.from"
 	eventToKey         = "cc.etke.postmoogle.to"
 	eventCcKey         = "cc.etke.postmoogle.cc"
+
+	// inbox delivery progress steps
+	progressFiltered = "filtered"
+	progressPosted   = "posted"
 )
 
-var ErrNoRoom = errors.New("room not found")
+var (
+	ErrNoRoom   = errors.New("room not found")
+	ErrNotOwner = errors.New("room has another owner")
+)
 
 // SetSendmail sets mail sending func to the bot
-func (b *Bot) SetSendmail(sendmail func(string, string, string) error) {
+func (b *Bot) SetSendmail(sendmail func(string, []string, string) []error) {
 	b.sendmail = sendmail
 	b.q.SetSendmail(sendmail)
+	b.q.SetExpired(b.expiredEmail)
+	b.q.SetFailed(b.suppressFailed)
 }
 
-func (b *Bot) shouldQueue(msg string) bool {
-	errs := strings.Split(msg, ";")
-	for _, err := range errs {
-		errParts := strings.Split(strings.TrimSpace(err), ":")
-		if len(errParts) < 2 {
+// shouldQueue checks if delivery error is temporary: 4xx SMTP reply or network failure
+func (b *Bot) shouldQueue(err error) bool {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Sendmail tries to send email to the recipients immediately, but recipients that got temporary error (e.g. greylisting)
+// will be added to the queue and retried until the queue lifetime expires, then the origin is notified about the failure.
+// Returns true if any recipient has been queued and errors of the recipients that cannot be delivered
+func (b *Bot) Sendmail(origin queue.Origin, from string, tos []string, data string) (bool, map[string]error) {
+	qid := origin.EventID.String()
+	if qid == "" {
+		qid = strings.Trim(origin.MessageID, "<>")
+	}
+	log := b.log.With().Str("from", from).Str("id", qid).Logger()
+	log.Info().Strs("to", tos).Msg("attempting to deliver email")
+	if !origin.Submitted { // submitted emails are sealed by the SMTP session, with the authentication result
+		data = b.sealARC(from, data)
+	}
+	var queued bool
+	failed := map[string]error{}
+	for i, err := range b.sendmail(from, tos, data) {
+		to := tos[i]
+		if err == nil {
+			log.Info().Str("to", to).Msg("email delivery succeeded")
 			continue
 		}
-		if strings.HasPrefix(strings.TrimSpace(errParts[1]), "4") {
-			return true
+		if b.shouldQueue(err) {
+			log.Info().Err(err).Str("to", to).Msg("email has been added to the queue")
+			if qerr := b.q.Add(qid+"."+to, from, to, data, origin); qerr != nil {
+				failed[to] = qerr
+				continue
+			}
+			queued = true
+			continue
 		}
+		log.Warn().Err(err).Str("to", to).Msg("email delivery failed")
+		b.suppressFailed(to, err)
+		failed[to] = err
 	}
-	return false
+
+	return queued, failed
 }
 
-// Sendmail tries to send email immediately, but if it gets 4xx error (greylisting),
-// the email will be added to the queue and retried several times after that
-func (b *Bot) Sendmail(eventID id.EventID, from, to, data string) (bool, error) {
-	log := b.log.With().Str("from", from).Str("to", to).Str("eventID", eventID.String()).Logger()
-	log.Info().Msg("attempting to deliver email")
-	err := b.sendmail(from, to, data)
-	if err != nil {
-		if b.shouldQueue(err.Error()) {
-			log.Info().Err(err).Msg("email has been added to the queue")
-			return true, b.q.Add(eventID.String(), from, to, data)
+// sealARC adds ARC set to the outgoing email, so it can be trusted when the recipient's server forwards it further
+func (b *Bot) sealARC(from, data string) string {
+	domain := utils.Hostname(from)
+	if domain == "" { // null reverse-path of bounces
+		domain = b.domains[0]
+	}
+	lookupTXT := func(name string) ([]string, error) {
+		return net.DefaultResolver.LookupTXT(context.Background(), name)
+	}
+	return email.SealARC(data, domain, b.cfg.GetBot().DKIMPrivateKey(), b.domains[0], nil, lookupTXT)
+}
+
+// SubmitEmail sends email submitted via SMTP, recipients with temporary errors are queued
+// and the sender gets a bounce if the email cannot be delivered until the queue lifetime expires
+func (b *Bot) SubmitEmail(roomID id.RoomID, messageID, from string, tos []string, data string) (bool, map[string]error) {
+	return b.Sendmail(queue.Origin{RoomID: roomID, MessageID: messageID, Submitted: true}, from, tos, data)
+}
+
+// BounceEmail sends a bounce about the recipient that cannot receive the SMTP-submitted email to its sender
+func (b *Bot) BounceEmail(from, rcpt string, err error, data string) {
+	status := enhancedStatus(err)
+	if status == "" || status[0] != '5' {
+		status = "5.0.0"
+	}
+	b.bounce(from, rcpt, status, err.Error(), data)
+}
+
+// bounce sends (or queues) delivery status notification about the failed recipient to the sender of the email
+func (b *Bot) bounce(from, rcpt, status, reason, data string) {
+	bounce := email.NewBounce(utils.Hostname(from), b.cfg.GetBot().DKIMPrivateKey(), from, rcpt, status, reason, data)
+	var messageID string
+	if msg, err := mail.ReadMessage(strings.NewReader(bounce)); err == nil {
+		messageID = msg.Header.Get("Message-Id")
+	}
+	b.log.Info().Str("to", from).Str("rcpt", rcpt).Msg("sending bounce")
+	if _, failed := b.Sendmail(queue.Origin{MessageID: messageID}, "", []string{from}, bounce); failed[from] != nil {
+		b.log.Warn().Err(failed[from]).Str("to", from).Msg("cannot send bounce")
+	}
+}
+
+// expiredEmail notifies the room about the email dropped from the queue (after its lifetime or permanent failure).
+// Emails submitted via SMTP are bounced to the sender instead, the bounce is posted into the room as any other bounce
+func (b *Bot) expiredEmail(item *queue.Item, permanent bool) {
+	origin := item.Origin
+	reason := item.LastError
+	if reason == "" {
+		reason = "unknown error"
+	}
+	if origin.Submitted {
+		status := "4.4.7" // delivery time expired
+		if permanent {
+			status = "5.0.0"
 		}
-		log.Warn().Err(err).Msg("email delivery failed")
-		return false, err
+		b.bounce(item.From, item.To, status, reason, item.Data)
+		return
+	}
+	if origin.RoomID == "" { // enqueued before origin was tracked
+		return
 	}
 
-	log.Warn().Err(err).Msg("email delivery succeeded")
-	return false, nil
+	cfg, err := b.cfg.GetRoom(origin.RoomID)
+	if err != nil {
+		b.log.Error().Err(err).Str("roomID", origin.RoomID.String()).Msg("cannot retrieve room settings")
+	}
+	threadID := origin.ThreadID
+	if threadID == "" && origin.MessageID != "" {
+		threadID = b.getThreadID(origin.RoomID, origin.MessageID, "")
+	}
+	text := fmt.Sprintf(
+		"Email to %s has been dropped from the queue: it could not be delivered in %d attempts since %s, the last error: %s",
+		item.To, item.Attempts+1, item.CreatedAt.UTC().Format(time.RFC1123), reason,
+	)
+	if permanent {
+		text = fmt.Sprintf("Email to %s has been dropped from the queue: it cannot be delivered, the error: %s", item.To, reason)
+	}
+	b.lp.SendNotice(origin.RoomID, text, linkpearl.RelatesTo(threadID, cfg.NoThreads()))
+	if noticeID := b.getSentNoticeID(origin.RoomID, origin.MessageID); noticeID != "" {
+		if _, err := b.lp.GetClient().SendReaction(origin.RoomID, noticeID, reactionFailed); err != nil {
+			b.log.Error().Err(err).Str("roomID", origin.RoomID.String()).Str("eventID", noticeID.String()).Msg("cannot mark sent email as failed")
+		}
+	}
 }
 
 // GetDKIMprivkey returns DKIM private key
@@ -115,19 +236,50 @@ func (b *Bot) GetIFOptions(roomID id.RoomID) email.IncomingFilteringOptions {
 	return cfg
 }
 
-// IncomingEmail sends incoming email to matrix room
-//
-//nolint:gocognit // TODO
+// IncomingEmail applies room's filters and sends incoming email to matrix room
 func (b *Bot) IncomingEmail(ctx context.Context, eml *email.Email) error {
 	roomID, ok := b.GetMapping(eml.Mailbox(true))
 	if !ok {
-		return ErrNoRoom
+		return inbox.Permanent(ErrNoRoom)
 	}
 	cfg, err := b.cfg.GetRoom(roomID)
 	if err != nil {
 		b.Error(ctx, "cannot get settings: %v", err)
 	}
+	if eml.DSN != nil && b.handleDSN(roomID, cfg, eml) {
+		return nil
+	}
 
+	result := filter.Evaluate(b.getFilters(roomID, cfg), eml)
+	eml.Labels = result.Flags
+	if eml.Scan.Spam() {
+		eml.Labels = append(eml.Labels, bayesLabel)
+	}
+	// rejection notice and redirects are sent once, even if posting into the room is retried
+	progress := inbox.ProgressFromContext(ctx)
+	if progress.Get(progressFiltered) == "" {
+		if result.Rejected {
+			b.rejectEmail(eml, result.Reject)
+		}
+		for _, target := range result.Redirect {
+			if rerr := b.redirectEmail(ctx, cfg, target, eml); rerr != nil {
+				b.log.Warn().Err(rerr).Str("roomID", roomID.String()).Str("target", target).Msg("cannot redirect email")
+			}
+		}
+		progress.Set(progressFiltered, "true")
+	}
+	if !result.Keep {
+		b.log.Info().Str("roomID", roomID.String()).Str("messageID", eml.MessageID).Msg("email has been filtered out")
+		return nil
+	}
+
+	return b.postEmail(ctx, roomID, cfg, eml, !result.NoAutoreply)
+}
+
+// postEmail sends email to matrix room
+//
+//nolint:gocognit // TODO
+func (b *Bot) postEmail(ctx context.Context, roomID id.RoomID, cfg config.Room, eml *email.Email, autoreply bool) error {
 	b.mu.Lock(roomID.String())
 	defer b.mu.Unlock(roomID.String())
 
@@ -141,14 +293,37 @@ func (b *Bot) IncomingEmail(ctx context.Context, eml *email.Email) error {
 			b.setThreadID(roomID, eml.MessageID, threadID)
 		}
 	}
-	content := eml.Content(threadID, cfg.ContentOptions())
-	eventID, serr := b.lp.Send(roomID, content)
-	if serr != nil {
-		if !strings.Contains(serr.Error(), "M_UNKNOWN") { // if it's not an unknown event error
-			return serr
+	var tokens []string
+	store := bayesStore(roomID, cfg)
+	if store != "" {
+		tokens = bayes.Tokens(eml)
+		if b.bayesSpam(store, cfg, tokens) && !slices.Contains(eml.Labels, bayesLabel) {
+			labels := eml.Labels
+			eml.Labels = append(labels[:len(labels):len(labels)], bayesLabel)
+			defer func() { eml.Labels = labels }() // the same email may be posted into other rooms
+		}
+	}
+	// the email is not posted again if the next steps failed and delivery is retried
+	progress := inbox.ProgressFromContext(ctx)
+	postedKey := progressPosted + "." + roomID.String()
+	eventID := id.EventID(progress.Get(postedKey))
+	if eventID == "" {
+		var serr error
+		content := eml.Content(threadID, cfg.ContentOptions())
+		eventID, serr = b.lp.Send(roomID, content)
+		if serr != nil {
+			if !strings.Contains(serr.Error(), "M_UNKNOWN") { // if it's not an unknown event error
+				return serr
+			}
+			threadID = "" // unknown event edge case - remove existing thread ID to avoid complications
+			newThread = true
+		}
+		if store != "" && eventID != "" {
+			if rerr := b.bs.Remember(eventID.String(), store, tokens); rerr != nil {
+				b.log.Error().Err(rerr).Str("roomID", roomID.String()).Msg("cannot remember email tokens")
+			}
 		}
-		threadID = "" // unknown event edge case - remove existing thread ID to avoid complications
-		newThread = true
+		progress.Set(postedKey, eventID.String())
 	}
 	if threadID == "" {
 		threadID = eventID
@@ -173,13 +348,86 @@ func (b *Bot) IncomingEmail(ctx context.Context, eml *email.Email) error {
 		b.sendFiles(ctx, roomID, eml.Files, cfg.NoThreads(), threadID)
 	}
 
-	if newThread && cfg.Autoreply() != "" {
+	if autoreply && newThread && cfg.Autoreply() != "" {
 		b.sendAutoreply(roomID, threadID)
 	}
 
 	return nil
 }
 
+// getFilters returns parsed filtering rules of the room, invalid rules are skipped
+func (b *Bot) getFilters(roomID id.RoomID, cfg config.Room) []*filter.Rule {
+	rules := []*filter.Rule{}
+	for _, src := range cfg.Filters() {
+		rule, err := filter.Parse(src)
+		if err != nil {
+			b.log.Warn().Err(err).Str("roomID", roomID.String()).Str("rule", src).Msg("cannot parse filtering rule")
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// redirectEmail sends email to another mailbox or room, without filtering and autoreply.
+// Rooms can be targeted by their IDs only if they have the same owner as the source room
+func (b *Bot) redirectEmail(ctx context.Context, source config.Room, target string, eml *email.Email) error {
+	roomID := id.RoomID(target)
+	if !strings.HasPrefix(target, "!") {
+		var ok bool
+		roomID, ok = b.GetMapping(utils.Mailbox(target))
+		if !ok {
+			return ErrNoRoom
+		}
+	}
+	cfg, err := b.cfg.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if cfg.Mailbox() == "" {
+		return ErrNoRoom
+	}
+	if strings.HasPrefix(target, "!") && (source.Owner() == "" || cfg.Owner() != source.Owner()) {
+		return ErrNotOwner
+	}
+
+	return b.postEmail(ctx, roomID, cfg, eml, false)
+}
+
+// rejectEmail sends rejection notice to the envelope sender, unless the email is a bounce or sent automatically.
+// The notice is sent with null reverse-path, so it cannot cause mail loops
+func (b *Bot) rejectEmail(eml *email.Email, reason string) {
+	log := b.log.With().Str("from", eml.RcptTo).Str("to", eml.MailFrom).Logger()
+	if eml.MailFrom == "" || eml.Automatic() {
+		log.Info().Msg("email is sent automatically, rejection notice will not be sent")
+		return
+	}
+	recipients, suppressed := b.filterSuppressed([]string{eml.MailFrom})
+	if len(recipients) == 0 {
+		log.Info().Str("reason", suppressed[eml.MailFrom]).Msg("rejection notice will not be sent to suppressed recipient")
+		return
+	}
+	if reason == "" {
+		reason = "rejected by the recipient's filtering rules"
+	}
+	domain := utils.Hostname(eml.RcptTo)
+	messageID := email.RandomMessageID(domain)
+	subject := "Rejected: " + eml.Subject
+	text := "Your message to " + eml.RcptTo + " was rejected: " + reason
+	reply := email.New(messageID, eml.MessageID, eml.MessageID, subject, eml.RcptTo, eml.MailFrom, eml.MailFrom, "", text, "", nil, nil)
+	reply.AutoSubmitted = "auto-replied"
+	data := reply.Compose(b.cfg.GetBot().DKIMPrivateKey())
+	if data == "" {
+		return
+	}
+
+	log.Info().Msg("sending rejection notice")
+	_, failed := b.Sendmail(queue.Origin{MessageID: messageID}, "", recipients, data)
+	if err := failed[eml.MailFrom]; err != nil {
+		log.Warn().Err(err).Msg("cannot send rejection notice")
+	}
+}
+
 //nolint:gocognit // TODO
 func (b *Bot) sendAutoreply(roomID id.RoomID, threadID id.EventID) {
 	cfg, err := b.cfg.GetRoom(roomID)
@@ -246,24 +494,28 @@ func (b *Bot) sendAutoreply(roomID id.RoomID, threadID id.EventID) {
 		return
 	}
 
-	var queued bool
 	ctx := newContext(threadEvt)
-	recipients := meta.Recipients
-	for _, to := range recipients {
-		queued, err = b.Sendmail(evt.ID, meta.From, to, data)
-		if queued {
-			b.log.Info().Err(err).Str("from", meta.From).Str("to", to).Msg("email has been queued")
-			b.saveSentMetadata(ctx, queued, meta.ThreadID, recipients, eml, cfg, "Autoreply has been sent (queued)")
-			continue
-		}
-
-		if err != nil {
-			b.Error(ctx, "cannot send email: %v", err)
-			continue
-		}
+	recipients, suppressed := b.filterSuppressed(meta.Recipients)
+	if len(suppressed) > 0 {
+		b.log.Info().Strs("to", utils.MapKeys(suppressed)).Msg("automatic reply will not be sent to suppressed recipients")
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	origin := queue.Origin{RoomID: roomID, ThreadID: meta.ThreadID, EventID: evt.ID, MessageID: eml.MessageID}
+	queued, failed := b.Sendmail(origin, meta.From, recipients, data)
+	for to, ferr := range failed {
+		b.Error(ctx, "cannot send email to %s: %v", to, ferr)
+	}
+	if len(failed) == len(recipients) {
+		return
 	}
 
-	b.saveSentMetadata(ctx, queued, meta.ThreadID, recipients, eml, cfg, "Autoreply has been sent")
+	notice := "Autoreply has been sent"
+	if queued {
+		notice += " (queued)"
+	}
+	b.saveSentMetadata(ctx, queued, meta.ThreadID, recipients, eml, cfg, notice)
 }
 
 func (b *Bot) canReply(ctx context.Context) bool {
@@ -331,23 +583,26 @@ func (b *Bot) SendEmailReply(ctx context.Context) {
 		return
 	}
 
-	var queued bool
-	recipients := meta.Recipients
+	recipients, suppressed := b.filterSuppressed(meta.Recipients)
+	b.warnSuppressed(ctx, suppressed)
+	if len(recipients) == 0 {
+		return
+	}
+	origin := queue.Origin{RoomID: evt.RoomID, ThreadID: meta.ThreadID, EventID: evt.ID, MessageID: eml.MessageID}
+	queued, failed := b.Sendmail(origin, meta.From, recipients, data)
+	sent := make([]string, 0, len(recipients))
 	for _, to := range recipients {
-		queued, err = b.Sendmail(evt.ID, meta.From, to, data)
-		if queued {
-			b.log.Info().Err(err).Str("from", meta.From).Str("to", to).Msg("email has been queued")
-			b.saveSentMetadata(ctx, queued, meta.ThreadID, recipients, eml, cfg)
-			continue
-		}
-
-		if err != nil {
-			b.Error(ctx, "cannot send email: %v", err)
+		if ferr := failed[to]; ferr != nil {
+			b.Error(ctx, "cannot send email to %s: %v", to, ferr)
 			continue
 		}
+		sent = append(sent, to)
+	}
+	if len(sent) == 0 {
+		return
 	}
 
-	b.saveSentMetadata(ctx, queued, meta.ThreadID, recipients, eml, cfg)
+	b.saveSentMetadata(ctx, queued, meta.ThreadID, sent, eml, cfg)
 }
 
 type parentEmail struct {
@@ -522,33 +777,76 @@ func (b *Bot) saveSentMetadata(ctx context.Context, queued bool, threadID id.Eve
 	}
 
 	evt := eventFromContext(ctx)
+	msgID, err := b.sendSentNotice(evt.RoomID, threadID, text, eml, cfg)
+	if err != nil {
+		b.Error(ctx, "cannot send notice: %v", err)
+		return
+	}
+	domain := utils.SanitizeDomain(cfg.Domain())
+	b.setThreadID(evt.RoomID, email.MessageID(evt.ID, domain), threadID)
+	b.setThreadID(evt.RoomID, email.MessageID(msgID, domain), threadID)
+	b.setLastEventID(evt.RoomID, threadID, msgID)
+	b.setSentNoticeID(evt.RoomID, eml.MessageID, msgID, recipients)
+}
+
+// sendSentNotice sends notice with the sent email's metadata
+func (b *Bot) sendSentNotice(roomID id.RoomID, threadID id.EventID, text string, eml *email.Email, cfg config.Room) (id.EventID, error) {
 	content := eml.Content(threadID, cfg.ContentOptions())
 	notice := format.RenderMarkdown(text, true, true)
 	msgContent, ok := content.Parsed.(*event.MessageEventContent)
 	if !ok {
-		b.Error(ctx, "cannot parse message")
-		return
+		return "", errors.New("cannot parse message")
 	}
 	msgContent.MsgType = event.MsgNotice
 	msgContent.Body = notice.Body
 	msgContent.FormattedBody = notice.FormattedBody
 	msgContent.RelatesTo = linkpearl.RelatesTo(threadID, cfg.NoThreads())
 	content.Parsed = msgContent
-	msgID, err := b.lp.Send(evt.RoomID, content)
+	return b.lp.Send(roomID, content)
+}
+
+// SubmittedEmail mirrors email sent via SMTP submission into the mailbox's room, so replies are threaded
+func (b *Bot) SubmittedEmail(roomID id.RoomID, recipients []string, eml *email.Email) {
+	cfg, err := b.cfg.GetRoom(roomID)
 	if err != nil {
-		b.Error(ctx, "cannot send notice: %v", err)
+		b.log.Error().Err(err).Str("roomID", roomID.String()).Msg("cannot retrieve room settings")
 		return
 	}
-	domain := utils.SanitizeDomain(cfg.Domain())
-	b.setThreadID(evt.RoomID, email.MessageID(evt.ID, domain), threadID)
-	b.setThreadID(evt.RoomID, email.MessageID(msgID, domain), threadID)
-	b.setLastEventID(evt.RoomID, threadID, msgID)
+	if cfg.NoMirror() {
+		return
+	}
+
+	b.mu.Lock(roomID.String())
+	defer b.mu.Unlock(roomID.String())
+
+	var threadID id.EventID
+	if eml.InReplyTo != "" || eml.References != "" {
+		threadID = b.getThreadID(roomID, eml.InReplyTo, eml.References)
+	}
+	text := "Email has been sent to " + strings.Join(recipients, ", ")
+	msgID, err := b.sendSentNotice(roomID, threadID, text, eml, cfg)
+	if err != nil {
+		b.log.Error().Err(err).Str("roomID", roomID.String()).Msg("cannot send notice of the submitted email")
+		return
+	}
+	if threadID == "" {
+		threadID = msgID
+	}
+	b.setThreadID(roomID, eml.MessageID, threadID)
+	b.setThreadID(roomID, email.MessageID(msgID, utils.SanitizeDomain(cfg.Domain())), threadID)
+	b.setLastEventID(roomID, threadID, msgID)
+	b.setSentNoticeID(roomID, eml.MessageID, msgID, recipients)
 }
 
 func (b *Bot) sendFiles(ctx context.Context, roomID id.RoomID, files []*utils.File, noThreads bool, parentID id.EventID) {
 	for _, file := range files {
-		req := file.Convert()
-		err := b.lp.SendFile(roomID, req, file.MsgType, linkpearl.RelatesTo(parentID, noThreads))
+		req, err := file.Convert()
+		if err != nil {
+			b.Error(ctx, "cannot read file %s: %v", file.Name, err)
+			continue
+		}
+		err = b.lp.SendFile(roomID, req, file.MsgType, linkpearl.RelatesTo(parentID, noThreads))
+		file.Close()
 		if err != nil {
 			b.Error(ctx, "cannot upload file %s: %v", req.FileName, err)
 		}
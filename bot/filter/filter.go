@@ -0,0 +1,242 @@
+package filter
+
+import (
+	"net/textproto"
+	"strings"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// ActionType of the filtering rule
+type ActionType string
+
+// supported actions
+const (
+	ActionKeep        ActionType = "keep"
+	ActionDiscard     ActionType = "discard"
+	ActionReject      ActionType = "reject"
+	ActionRedirect    ActionType = "redirect"
+	ActionAddFlag     ActionType = "addflag"
+	ActionNoAutoreply ActionType = "noautoreply"
+	ActionStop        ActionType = "stop"
+)
+
+// Rule is a parsed filtering rule
+type Rule struct {
+	Source  string
+	Test    Test
+	Actions []*Action
+}
+
+// Action of the rule
+type Action struct {
+	Type     ActionType
+	Argument string
+}
+
+// Test (condition) of the rule
+type Test interface {
+	Match(eml *email.Email) bool
+}
+
+// Result of the filtering
+type Result struct {
+	// Keep the email in the room
+	Keep bool
+	// Reject reason, if the email was rejected
+	Reject string
+	// Rejected email
+	Rejected bool
+	// Redirect email to other mailboxes or rooms
+	Redirect []string
+	// Flags (labels) of the email
+	Flags []string
+	// NoAutoreply disables autoreply
+	NoAutoreply bool
+}
+
+// Evaluate rules against the email
+func Evaluate(rules []*Rule, eml *email.Email) *Result {
+	result := &Result{}
+	implicitKeep := true
+	for _, rule := range rules {
+		if !rule.Test.Match(eml) {
+			continue
+		}
+		for _, action := range rule.Actions {
+			switch action.Type {
+			case ActionKeep:
+				result.Keep = true
+			case ActionDiscard:
+				implicitKeep = false
+			case ActionReject:
+				implicitKeep = false
+				result.Rejected = true
+				result.Reject = action.Argument
+			case ActionRedirect:
+				implicitKeep = false
+				result.Redirect = append(result.Redirect, action.Argument)
+			case ActionAddFlag:
+				result.Flags = append(result.Flags, action.Argument)
+			case ActionNoAutoreply:
+				result.NoAutoreply = true
+			case ActionStop:
+				result.Keep = result.Keep || implicitKeep
+				return result
+			}
+		}
+	}
+	result.Keep = result.Keep || implicitKeep
+	return result
+}
+
+type matchType int
+
+const (
+	matchIs matchType = iota
+	matchContains
+	matchMatches
+)
+
+// match value against any of the keys, case-insensitive
+func (m matchType) match(value string, keys []string) bool {
+	value = strings.ToLower(value)
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		switch m {
+		case matchIs:
+			if value == key {
+				return true
+			}
+		case matchContains:
+			if strings.Contains(value, key) {
+				return true
+			}
+		case matchMatches:
+			if wildcard([]rune(key), []rune(value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wildcard matches value against pattern with "*" (any sequence) and "?" (any single character).
+// On mismatch it backtracks to the last "*" only, so it works in linear-ish time with any amount of "*"
+func wildcard(pattern, value []rune) bool {
+	var p, v int
+	star, mark := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, v
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case star >= 0:
+			mark++
+			p, v = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+type constTest bool
+
+func (t constTest) Match(_ *email.Email) bool {
+	return bool(t)
+}
+
+type notTest struct {
+	test Test
+}
+
+func (t *notTest) Match(eml *email.Email) bool {
+	return !t.test.Match(eml)
+}
+
+type listTest struct {
+	all   bool
+	tests []Test
+}
+
+func (t *listTest) Match(eml *email.Email) bool {
+	for _, test := range t.tests {
+		if test.Match(eml) != t.all {
+			return !t.all
+		}
+	}
+	return t.all
+}
+
+type headerTest struct {
+	address bool
+	match   matchType
+	names   []string
+	keys    []string
+}
+
+func (t *headerTest) Match(eml *email.Email) bool {
+	for _, name := range t.names {
+		for _, value := range eml.Headers[textproto.CanonicalMIMEHeaderKey(name)] {
+			values := []string{value}
+			if t.address {
+				values = email.AddressList(value)
+			}
+			for _, value := range values {
+				if t.match.match(value, t.keys) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+type existsTest struct {
+	names []string
+}
+
+func (t *existsTest) Match(eml *email.Email) bool {
+	for _, name := range t.names {
+		if len(eml.Headers[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (t *sizeTest) Match(eml *email.Email) bool {
+	if t.over {
+		return eml.Size > t.limit
+	}
+	return eml.Size < t.limit
+}
+
+type attachmentTest struct {
+	match matchType
+	keys  []string
+}
+
+func (t *attachmentTest) Match(eml *email.Email) bool {
+	if len(t.keys) == 0 {
+		return len(eml.Files) > 0
+	}
+	for _, file := range eml.Files {
+		if t.match.match(file.Name, t.keys) {
+			return true
+		}
+	}
+	return false
+}
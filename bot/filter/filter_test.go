@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+func TestEvaluate(t *testing.T) {
+	eml := &email.Email{
+		Headers: map[string][]string{
+			"From":    {"Newsletter <news@example.com>"},
+			"Subject": {"Weekly Digest"},
+			"List-Id": {"<weekly.example.com>"},
+		},
+		Size:  2048,
+		Files: []*utils.File{{Name: "invoice.PDF"}},
+	}
+	tests := []struct {
+		rule     string
+		keep     bool
+		rejected bool
+		flags    int
+		redirect int
+	}{
+		{rule: `if header :contains "subject" "digest" { addflag "news"; }`, keep: true, flags: 1},
+		{rule: `if address :matches "from" "*@example.com" { discard; }`, keep: false},
+		{rule: `if address "from" "news@example.org" { discard; }`, keep: true},
+		{rule: `if allof (exists "list-id", size :over 1K) { redirect "news@example.com"; }`, keep: false, redirect: 1},
+		{rule: `if anyof (size :under 1K, false) { reject "too small"; }`, keep: true},
+		{rule: `if attachment :matches "*.pdf" { reject; }`, keep: false, rejected: true},
+		{rule: `if not attachment { discard; }`, keep: true},
+		{rule: `if true { redirect "!room:example.com"; keep; }`, keep: true, redirect: 1},
+	}
+
+	for _, test := range tests {
+		rule, err := Parse(test.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", test.rule, err)
+		}
+		result := Evaluate([]*Rule{rule}, eml)
+		if result.Keep != test.keep || result.Rejected != test.rejected || len(result.Flags) != test.flags || len(result.Redirect) != test.redirect {
+			t.Errorf("%s: unexpected result %+v", test.rule, result)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	rules := []string{
+		`header "subject" "test" { discard; }`,
+		`if header "subject" "test" { }`,
+		`if header "subject" "test" { fileinto "x"; }`,
+		`if size 10 { discard; }`,
+		`if header "subject "test" { discard; }`,
+		`if true { discard; } extra`,
+	}
+	for _, rule := range rules {
+		if _, err := Parse(rule); err == nil {
+			t.Errorf("%s: error expected", rule)
+		}
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{pattern: "*@example.com", value: "news@example.com", match: true},
+		{pattern: "*@example.com", value: "news@example.org", match: false},
+		{pattern: "n?ws@*", value: "news@example.com", match: true},
+		{pattern: "*", value: "", match: true},
+		{pattern: "?", value: "", match: false},
+		{pattern: "a*b*c", value: "aXbYbZc", match: true},
+		{pattern: "a*b*c", value: "aXbYbZ", match: false},
+		{pattern: "**a**", value: "bab", match: true},
+		// exponential with backtracking on every "*"
+		{pattern: strings.Repeat("a*", 30) + "b", value: strings.Repeat("a", 100), match: false},
+	}
+	for _, test := range tests {
+		if wildcard([]rune(test.pattern), []rune(test.value)) != test.match {
+			t.Errorf("%q against %q: expected %t", test.value, test.pattern, test.match)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrSyntax returned when rule cannot be parsed
+var ErrSyntax = errors.New("syntax error")
+
+type tokenKind int
+
+const (
+	tokenIdentifier tokenKind = iota
+	tokenTag
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// tokenize splits the rule into tokens
+func tokenize(src string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(src)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case unicode.IsSpace(ch):
+			continue
+		case strings.ContainsRune("(){}[],;", ch):
+			tokens = append(tokens, token{tokenSymbol, string(ch)})
+		case ch == '"':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrSyntax)
+			}
+			tokens = append(tokens, token{tokenString, value.String()})
+		case ch == ':' || unicode.IsLetter(ch) || unicode.IsDigit(ch):
+			start := i
+			for i+1 < len(runes) && (unicode.IsLetter(runes[i+1]) || unicode.IsDigit(runes[i+1]) || runes[i+1] == '_' || runes[i+1] == '-') {
+				i++
+			}
+			value := strings.ToLower(string(runes[start : i+1]))
+			kind := tokenIdentifier
+			if ch == ':' {
+				kind = tokenTag
+			} else if unicode.IsDigit(ch) {
+				kind = tokenNumber
+			}
+			tokens = append(tokens, token{kind, value})
+		default:
+			return nil, fmt.Errorf("%w: unexpected character %q", ErrSyntax, ch)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses the rule, e.g.: if header :contains "subject" "invoice" { addflag "finance"; stop; }
+func Parse(src string) (*Rule, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if !p.accept(tokenIdentifier, "if") {
+		return nil, fmt.Errorf("%w: rule must start with `if`", ErrSyntax)
+	}
+	test, err := p.test()
+	if err != nil {
+		return nil, err
+	}
+	actions, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q after the rule", ErrSyntax, p.tokens[p.pos].value)
+	}
+
+	return &Rule{Source: strings.Join(strings.Fields(src), " "), Test: test, Actions: actions}, nil
+}
+
+func (p *parser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *parser) accept(kind tokenKind, value string) bool {
+	tok := p.peek()
+	if tok == nil || tok.kind != kind || (value != "" && tok.value != value) {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *parser) expect(kind tokenKind, value string) error {
+	if p.accept(kind, value) {
+		return nil
+	}
+	if tok := p.peek(); tok != nil {
+		return fmt.Errorf("%w: expected %q, got %q", ErrSyntax, value, tok.value)
+	}
+	return fmt.Errorf("%w: expected %q, got end of the rule", ErrSyntax, value)
+}
+
+func (p *parser) test() (Test, error) {
+	tok := p.peek()
+	if tok == nil || tok.kind != tokenIdentifier {
+		return nil, fmt.Errorf("%w: test expected", ErrSyntax)
+	}
+	p.pos++
+
+	switch tok.value {
+	case "true":
+		return constTest(true), nil
+	case "false":
+		return constTest(false), nil
+	case "not":
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		return &notTest{test}, nil
+	case "allof", "anyof":
+		tests, err := p.testList()
+		if err != nil {
+			return nil, err
+		}
+		return &listTest{all: tok.value == "allof", tests: tests}, nil
+	case "header", "address":
+		match := p.matchType()
+		names, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		keys, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		return &headerTest{address: tok.value == "address", match: match, names: names, keys: keys}, nil
+	case "exists":
+		names, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		return &existsTest{names: names}, nil
+	case "size":
+		return p.sizeTest()
+	case "attachment":
+		match := p.matchType()
+		var keys []string
+		if tok := p.peek(); tok != nil && (tok.kind == tokenString || tok.value == "[") {
+			var err error
+			if keys, err = p.stringList(); err != nil {
+				return nil, err
+			}
+		}
+		return &attachmentTest{match: match, keys: keys}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown test %q", ErrSyntax, tok.value)
+	}
+}
+
+func (p *parser) testList() ([]Test, error) {
+	if err := p.expect(tokenSymbol, "("); err != nil {
+		return nil, err
+	}
+	tests := []Test{}
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if !p.accept(tokenSymbol, ",") {
+			break
+		}
+	}
+	return tests, p.expect(tokenSymbol, ")")
+}
+
+func (p *parser) matchType() matchType {
+	switch {
+	case p.accept(tokenTag, ":contains"):
+		return matchContains
+	case p.accept(tokenTag, ":matches"):
+		return matchMatches
+	default:
+		p.accept(tokenTag, ":is")
+		return matchIs
+	}
+}
+
+func (p *parser) sizeTest() (Test, error) {
+	var over bool
+	switch {
+	case p.accept(tokenTag, ":over"):
+		over = true
+	case p.accept(tokenTag, ":under"):
+	default:
+		return nil, fmt.Errorf("%w: size requires :over or :under", ErrSyntax)
+	}
+	tok := p.peek()
+	if tok == nil || tok.kind != tokenNumber {
+		return nil, fmt.Errorf("%w: size limit expected", ErrSyntax)
+	}
+	p.pos++
+
+	value := tok.value
+	multiplier := int64(1)
+	switch value[len(value)-1] {
+	case 'k':
+		multiplier = 1 << 10
+	case 'm':
+		multiplier = 1 << 20
+	case 'g':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid size %q", ErrSyntax, tok.value)
+	}
+	return &sizeTest{over: over, limit: limit * multiplier}, nil
+}
+
+func (p *parser) stringList() ([]string, error) {
+	if tok := p.peek(); tok != nil && tok.kind == tokenString {
+		p.pos++
+		return []string{tok.value}, nil
+	}
+	if err := p.expect(tokenSymbol, "["); err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for {
+		tok := p.peek()
+		if tok == nil || tok.kind != tokenString {
+			return nil, fmt.Errorf("%w: string expected", ErrSyntax)
+		}
+		p.pos++
+		list = append(list, tok.value)
+		if !p.accept(tokenSymbol, ",") {
+			break
+		}
+	}
+	return list, p.expect(tokenSymbol, "]")
+}
+
+func (p *parser) block() ([]*Action, error) {
+	if err := p.expect(tokenSymbol, "{"); err != nil {
+		return nil, err
+	}
+	actions := []*Action{}
+	for !p.accept(tokenSymbol, "}") {
+		action, err := p.action()
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("%w: at least one action expected", ErrSyntax)
+	}
+	return actions, nil
+}
+
+func (p *parser) action() (*Action, error) {
+	tok := p.peek()
+	if tok == nil || tok.kind != tokenIdentifier {
+		return nil, fmt.Errorf("%w: action expected", ErrSyntax)
+	}
+	p.pos++
+
+	action := &Action{Type: ActionType(tok.value)}
+	switch action.Type {
+	case ActionKeep, ActionDiscard, ActionStop, ActionNoAutoreply:
+	case ActionReject:
+		if tok := p.peek(); tok != nil && tok.kind == tokenString {
+			p.pos++
+			action.Argument = tok.value
+		}
+	case ActionRedirect, ActionAddFlag:
+		tok := p.peek()
+		if tok == nil || tok.kind != tokenString {
+			return nil, fmt.Errorf("%w: %s requires an argument", ErrSyntax, action.Type)
+		}
+		p.pos++
+		action.Argument = tok.value
+	default:
+		return nil, fmt.Errorf("%w: unknown action %q", ErrSyntax, tok.value)
+	}
+	return action, p.expect(tokenSymbol, ";")
+}
@@ -0,0 +1,176 @@
+package inbox
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+)
+
+const selectItems = "SELECT id, mail_from, rcpt_to, path, attempts, last_error, next_attempt, created_at, progress FROM inbox"
+
+// ErrNotFound returned when inbox item doesn't exist
+var ErrNotFound = errors.New("inbox item not found")
+
+// Item is a spooled email addressed to the single recipient
+type Item struct {
+	ID          string
+	From        string
+	To          string
+	Path        string
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+	CreatedAt   time.Time
+	Progress    Progress
+}
+
+func (ib *Inbox) migrate() error {
+	_, err := ib.db.Exec(`CREATE TABLE IF NOT EXISTS inbox (
+		id           VARCHAR(255) PRIMARY KEY,
+		mail_from    TEXT NOT NULL,
+		rcpt_to      TEXT NOT NULL,
+		path         TEXT NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		last_error   TEXT NOT NULL DEFAULT '',
+		next_attempt BIGINT NOT NULL,
+		created_at   BIGINT NOT NULL,
+		progress     TEXT NOT NULL DEFAULT ''
+	)`)
+	return err
+}
+
+// Add spooled email file to the inbox, one item per recipient
+func (ib *Inbox) Add(from string, tos []string, path string) error {
+	if err := ib.add(from, tos, path); err != nil {
+		return err
+	}
+
+	go ib.Process()
+	return nil
+}
+
+func (ib *Inbox) add(from string, tos []string, path string) error {
+	tx, err := ib.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, to := range tos {
+		_, err = tx.Exec(
+			"INSERT INTO inbox (id, mail_from, rcpt_to, path, next_attempt, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+			newID(), from, to, path, now, now,
+		)
+		if err != nil {
+			tx.Rollback() //nolint:errcheck // the original error is more important
+			ib.log.Error().Err(err).Str("from", from).Str("to", to).Msg("cannot add email to inbox")
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// List all inbox items
+func (ib *Inbox) List() ([]*Item, error) {
+	return ib.query(selectItems + " ORDER BY created_at")
+}
+
+// Retry schedules immediate delivery attempt of the item
+func (ib *Inbox) Retry(id string) error {
+	result, err := ib.db.Exec("UPDATE inbox SET next_attempt = $1 WHERE id = $2", time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 { //nolint:errcheck // both supported drivers return it
+		return ErrNotFound
+	}
+
+	go ib.Process()
+	return nil
+}
+
+// Remove item from inbox without delivery
+func (ib *Inbox) Remove(id string) error {
+	items, err := ib.query(selectItems+" WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return ErrNotFound
+	}
+
+	return ib.remove(items[0])
+}
+
+// due returns items ready for the next delivery attempt
+func (ib *Inbox) due(limit int) ([]*Item, error) {
+	return ib.query(selectItems+" WHERE next_attempt <= $1 ORDER BY next_attempt LIMIT $2", time.Now().Unix(), limit)
+}
+
+// expired returns items older than the lifetime
+func (ib *Inbox) expired(lifetime time.Duration) ([]*Item, error) {
+	return ib.query(selectItems+" WHERE created_at < $1", time.Now().Add(-lifetime).Unix())
+}
+
+func (ib *Inbox) query(query string, args ...any) ([]*Item, error) {
+	rows, err := ib.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*Item{}
+	for rows.Next() {
+		var nextAttempt, createdAt int64
+		var progress string
+		item := &Item{}
+		if err := rows.Scan(&item.ID, &item.From, &item.To, &item.Path, &item.Attempts, &item.LastError, &nextAttempt, &createdAt, &progress); err != nil {
+			return nil, err
+		}
+		item.NextAttempt = time.Unix(nextAttempt, 0)
+		item.CreatedAt = time.Unix(createdAt, 0)
+		item.Progress = parseProgress(progress)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// postpone the next delivery attempt of the item, saving its delivery progress
+func (ib *Inbox) postpone(item *Item, reason error) error {
+	attempts := item.Attempts + 1
+	next := time.Now().Add(backoff(attempts)).Unix()
+	_, err := ib.db.Exec(
+		"UPDATE inbox SET attempts = $1, last_error = $2, next_attempt = $3, progress = $4 WHERE id = $5",
+		attempts, reason.Error(), next, item.Progress.String(), item.ID,
+	)
+	return err
+}
+
+// remove item from inbox and its spool file, if no other recipients use it
+func (ib *Inbox) remove(item *Item) error {
+	if _, err := ib.db.Exec("DELETE FROM inbox WHERE id = $1", item.ID); err != nil {
+		return err
+	}
+
+	var refs int
+	err := ib.db.QueryRow("SELECT COUNT(*) FROM inbox WHERE path = $1", item.Path).Scan(&refs)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+	if err := os.Remove(item.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b) //nolint:errcheck // crypto/rand never fails
+	return hex.EncodeToString(b)
+}
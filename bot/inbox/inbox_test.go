@@ -0,0 +1,193 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+const testEmail = "From: sender@example.com\r\nTo: rcpt@example.org\r\nSubject: test\r\n\r\nhello\r\n"
+
+func newTestInbox(t *testing.T) *Inbox {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // each connection has its own in-memory database
+	t.Cleanup(func() { db.Close() })
+
+	log := zerolog.Nop()
+	ib, err := New(db, t.TempDir(), &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ib
+}
+
+// spool writes test email into the inbox dir
+func spool(t *testing.T, ib *Inbox, name string) string {
+	t.Helper()
+	path := filepath.Join(ib.Dir(), name)
+	if err := os.WriteFile(path, []byte(testEmail), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAddRemove(t *testing.T) {
+	ib := newTestInbox(t)
+	path := spool(t, ib, "shared.eml")
+	if err := ib.add("sender@example.com", []string{"a@example.org", "b@example.org"}, path); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ib.due(10)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("expected 2 due items, got %d (%v)", len(items), err)
+	}
+	if items[0].From != "sender@example.com" || items[0].Path != path || items[0].ID == items[1].ID {
+		t.Errorf("unexpected items %+v %+v", items[0], items[1])
+	}
+
+	if err = ib.Remove(items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("spool file is removed while used by another recipient: %v", err)
+	}
+	if err = ib.Remove(items[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spool file is not removed: %v", err)
+	}
+	if err = ib.Remove(items[1].ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestProcessDrainsBacklog(t *testing.T) {
+	ib := newTestInbox(t)
+	total := defaultBatch*2 + 3
+	for i := 0; i < total; i++ {
+		if err := ib.add("sender@example.com", []string{"rcpt@example.org"}, spool(t, ib, strconv.Itoa(i)+".eml")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received int
+	ib.SetReceiver(func(_ context.Context, eml *email.Email) error {
+		if eml.Subject != "test" || eml.MailFrom != "sender@example.com" {
+			t.Errorf("unexpected email %+v", eml)
+		}
+		received++
+		return nil
+	})
+	ib.Process()
+
+	if received != total {
+		t.Errorf("expected %d received emails, got %d", total, received)
+	}
+	items, err := ib.List()
+	if err != nil || len(items) != 0 {
+		t.Errorf("expected empty inbox, got %d items (%v)", len(items), err)
+	}
+}
+
+func TestProcessRetry(t *testing.T) {
+	ib := newTestInbox(t)
+	if err := ib.add("sender@example.com", []string{"rcpt@example.org"}, spool(t, ib, "retry.eml")); err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts int32
+	ib.SetReceiver(func(ctx context.Context, _ *email.Email) error {
+		attempt := atomic.AddInt32(&attempts, 1)
+		progress := ProgressFromContext(ctx)
+		if attempt > 1 && progress.Get("posted") != "$event" {
+			t.Errorf("progress is not restored: %v", progress)
+		}
+		progress.Set("posted", "$event")
+		if attempt == 1 {
+			return errors.New("homeserver is down")
+		}
+		return nil
+	})
+	ib.Process()
+	ib.Process() // not due yet
+
+	items, err := ib.List()
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 postponed item, got %d (%v)", len(items), err)
+	}
+	item := items[0]
+	if atomic.LoadInt32(&attempts) != 1 || item.Attempts != 1 || item.LastError != "homeserver is down" || time.Until(item.NextAttempt) < minBackoff/2 {
+		t.Errorf("item is not postponed: %+v", item)
+	}
+
+	// retry processes the inbox in background
+	if err = ib.Retry(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&attempts) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ib.mu.Lock()   // wait for the processing to finish
+	ib.mu.Unlock() //nolint:staticcheck // empty critical section is intended
+	if items, err = ib.List(); err != nil || len(items) != 0 || atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("item is not delivered on retry: %d attempts, %d items (%v)", atomic.LoadInt32(&attempts), len(items), err)
+	}
+}
+
+func TestProcessDrop(t *testing.T) {
+	ib := newTestInbox(t)
+	permanent := spool(t, ib, "permanent.eml")
+	expired := spool(t, ib, "expired.eml")
+	for _, path := range []string{permanent, expired} {
+		if err := ib.add("sender@example.com", []string{"rcpt@example.org"}, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-defaultLifetime - time.Hour).Unix()
+	if _, err := ib.db.Exec("UPDATE inbox SET created_at = $1, next_attempt = $2 WHERE path = $3", old, time.Now().Add(time.Hour).Unix(), expired); err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts int
+	ib.SetReceiver(func(context.Context, *email.Email) error {
+		attempts++
+		return Permanent(errors.New("room not found"))
+	})
+	ib.Process()
+
+	items, err := ib.List()
+	if err != nil || len(items) != 0 || attempts != 1 {
+		t.Errorf("expected empty inbox after 1 attempt, got %d items after %d attempts (%v)", len(items), attempts, err)
+	}
+	for _, path := range []string{permanent, expired} {
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("spool file %s is not removed: %v", path, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{1: minBackoff, 2: 2 * minBackoff, 3: 4 * minBackoff, 10: maxBackoff, 100: maxBackoff}
+	for attempts, expected := range tests {
+		if delay := backoff(attempts); delay != expected {
+			t.Errorf("attempt %d: expected %s, got %s", attempts, expected, delay)
+		}
+	}
+}
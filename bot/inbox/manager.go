@@ -0,0 +1,179 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+const (
+	defaultBatch    = 10
+	defaultLifetime = 120 * time.Hour
+	minBackoff      = time.Minute
+	maxBackoff      = time.Hour
+)
+
+// Inbox is a durable spool of incoming emails, waiting for delivery into matrix rooms
+type Inbox struct {
+	mu       sync.Mutex
+	db       *sql.DB
+	dir      string
+	lifetime time.Duration
+	log      *zerolog.Logger
+	receive  func(context.Context, *email.Email) error
+}
+
+// New inbox
+func New(db *sql.DB, dir string, log *zerolog.Logger) (*Inbox, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	ib := &Inbox{
+		db:       db,
+		dir:      dir,
+		lifetime: defaultLifetime,
+		log:      log,
+	}
+	if err := ib.migrate(); err != nil {
+		return nil, err
+	}
+
+	return ib, nil
+}
+
+// SetReceiver sets func that delivers email into matrix room
+func (ib *Inbox) SetReceiver(receive func(context.Context, *email.Email) error) {
+	ib.receive = receive
+}
+
+// Dir returns spool directory
+func (ib *Inbox) Dir() string {
+	return ib.dir
+}
+
+// Process inbox
+func (ib *Inbox) Process() {
+	if ib.receive == nil {
+		return
+	}
+	if !ib.mu.TryLock() {
+		ib.log.Debug().Msg("inbox is already being processed")
+		return
+	}
+	defer ib.mu.Unlock()
+
+	ib.log.Debug().Msg("staring inbox processing...")
+	ib.expire()
+	// process batches until nothing is due, so a backlog (e.g. after homeserver downtime) is drained at once.
+	// Failed items are postponed, seen is a safeguard against endless loop if postponing fails
+	seen := map[string]bool{}
+	for {
+		items, err := ib.due(defaultBatch)
+		if err != nil {
+			ib.log.Error().Err(err).Msg("cannot get inbox items")
+			return
+		}
+		var processed int
+		for _, item := range items {
+			if seen[item.ID] {
+				continue
+			}
+			seen[item.ID] = true
+			processed++
+			ib.try(item)
+		}
+		if processed == 0 || len(items) < defaultBatch {
+			break
+		}
+	}
+	ib.log.Debug().Msg("ended inbox processing")
+}
+
+// try to deliver email into matrix room
+func (ib *Inbox) try(item *Item) {
+	log := ib.log.With().Str("id", item.ID).Str("from", item.From).Str("to", item.To).Logger()
+	err := ib.deliver(item)
+	if err == nil {
+		log.Info().Msg("email from inbox was delivered")
+		if err = ib.remove(item); err != nil {
+			log.Error().Err(err).Msg("cannot remove email from inbox")
+		}
+		return
+	}
+
+	if isPermanent(err) {
+		log.Error().Err(err).Msg("cannot deliver email from inbox, dropping it")
+		if err = ib.remove(item); err != nil {
+			log.Error().Err(err).Msg("cannot remove email from inbox")
+		}
+		return
+	}
+
+	log.Warn().Err(err).Int("attempts", item.Attempts+1).Msg("cannot deliver email from inbox")
+	if err = ib.postpone(item, err); err != nil {
+		log.Error().Err(err).Msg("cannot update inbox item")
+	}
+}
+
+// expire drops items that could not be delivered during the inbox lifetime
+func (ib *Inbox) expire() {
+	items, err := ib.expired(ib.lifetime)
+	if err != nil {
+		ib.log.Error().Err(err).Msg("cannot get expired inbox items")
+		return
+	}
+	for _, item := range items {
+		log := ib.log.With().Str("id", item.ID).Str("from", item.From).Str("to", item.To).Logger()
+		log.Error().Int("attempts", item.Attempts).Str("error", item.LastError).Msg("email has expired in inbox, dropping it")
+		if err := ib.remove(item); err != nil {
+			log.Error().Err(err).Msg("cannot remove email from inbox")
+		}
+	}
+}
+
+// deliver email into matrix room, the delivery progress is recorded in the item
+func (ib *Inbox) deliver(item *Item) error {
+	fh, err := os.Open(item.Path)
+	if os.IsNotExist(err) {
+		return Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	eml, err := email.FromSpool(item.To, fh, ib.dir)
+	if err != nil {
+		return err
+	}
+	eml.MailFrom = item.From
+	defer eml.Cleanup()
+
+	if item.Progress == nil {
+		item.Progress = Progress{}
+	}
+	ctx := sentry.SetHubOnContext(context.Background(), sentry.CurrentHub().Clone())
+	ctx = progressToContext(ctx, item.Progress)
+	return ib.receive(ctx, eml)
+}
+
+// backoff returns delay before the next attempt
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
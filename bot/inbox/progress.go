@@ -0,0 +1,76 @@
+package inbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+type ctxkey int
+
+const ctxProgress ctxkey = iota
+
+// Progress of the item delivery, saved between attempts, so completed steps are not repeated on retry
+type Progress map[string]string
+
+// Get value of the completed step, empty if the step is not completed yet
+func (p Progress) Get(step string) string {
+	return p[step]
+}
+
+// Set step as completed with the value (e.g. ID of the posted event)
+func (p Progress) Set(step, value string) {
+	p[step] = value
+}
+
+// ProgressFromContext returns delivery progress of the inbox item,
+// emails delivered outside of the inbox get an empty progress
+func ProgressFromContext(ctx context.Context) Progress {
+	if progress, ok := ctx.Value(ctxProgress).(Progress); ok {
+		return progress
+	}
+	return Progress{}
+}
+
+func progressToContext(ctx context.Context, progress Progress) context.Context {
+	return context.WithValue(ctx, ctxProgress, progress)
+}
+
+func parseProgress(data string) Progress {
+	progress := Progress{}
+	if data != "" {
+		json.Unmarshal([]byte(data), &progress) //nolint:errcheck // progress is lost, the email will be delivered from scratch
+	}
+	return progress
+}
+
+func (p Progress) String() string {
+	if len(p) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(p) //nolint:errcheck // map of strings
+	return string(data)
+}
+
+// permanentError will not go away on retry, so the inbox item is dropped right away
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks delivery error as permanent, the email will not be retried
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var perr *permanentError
+	return errors.As(err, &perr)
+}
@@ -1,79 +1,209 @@
 package queue
 
 import (
+	"database/sql"
+	"errors"
+	"math/rand"
+	"net/textproto"
+	"sync"
+	"time"
+
 	"github.com/rs/zerolog"
 	"gitlab.com/etke.cc/linkpearl"
+	"maunium.net/go/mautrix/id"
 
 	"gitlab.com/etke.cc/postmoogle/bot/config"
-	"gitlab.com/etke.cc/postmoogle/utils"
 )
 
 const (
-	acQueueKey          = "cc.etke.postmoogle.mailqueue"
-	defaultQueueBatch   = 10
-	defaultQueueRetries = 100
+	acQueueKey           = "cc.etke.postmoogle.mailqueue" // used before the SQL queue, imported on start
+	defaultQueueBatch    = 10
+	defaultQueueLifetime = 120 * time.Hour
+	minBackoff           = 5 * time.Minute
+	maxBackoff           = 2 * time.Hour
 )
 
+// accountData of the bot, used to import the queue stored before the SQL queue
+type accountData interface {
+	GetAccountData(name string) (map[string]string, error)
+	SetAccountData(name string, data map[string]string) error
+}
+
 // Queue manager
 type Queue struct {
-	mu       utils.Mutex
-	lp       *linkpearl.Linkpearl
+	mu       sync.Mutex
+	imported bool
+	db       *sql.DB
+	lp       accountData
 	cfg      *config.Manager
 	log      *zerolog.Logger
-	sendmail func(string, string, string) error
+	sendmail func(string, []string, string) []error
+	expired  func(*Item, bool)
+	failed   func(string, error)
+}
+
+// Origin of the queued email, used to report delivery failure
+type Origin struct {
+	RoomID    id.RoomID
+	ThreadID  id.EventID
+	EventID   id.EventID
+	MessageID string
+	// Submitted via SMTP, the sender should get a bounce on failure
+	Submitted bool
+}
+
+// Item of the queue, dropped after its lifetime
+type Item struct {
+	ID          string
+	From        string
+	To          string
+	Data        string
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+	CreatedAt   time.Time
+	Origin      Origin
 }
 
 // New queue
-func New(lp *linkpearl.Linkpearl, cfg *config.Manager, log *zerolog.Logger) *Queue {
-	return &Queue{
-		mu:  utils.Mutex{},
+func New(db *sql.DB, lp *linkpearl.Linkpearl, cfg *config.Manager, log *zerolog.Logger) (*Queue, error) {
+	q := &Queue{
+		db:  db,
 		lp:  lp,
 		cfg: cfg,
 		log: log,
 	}
+	if err := q.migrate(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
 }
 
 // SetSendmail func
-func (q *Queue) SetSendmail(function func(string, string, string) error) {
+func (q *Queue) SetSendmail(function func(string, []string, string) []error) {
 	q.sendmail = function
 }
 
+// SetExpired sets func that reports emails dropped from the queue after its lifetime
+// or after permanent delivery failure (the second argument)
+func (q *Queue) SetExpired(function func(*Item, bool)) {
+	q.expired = function
+}
+
+// SetFailed sets func that handles permanent delivery failure of the recipient, e.g. suppresses unknown users
+func (q *Queue) SetFailed(function func(string, error)) {
+	q.failed = function
+}
+
 // Process queue
 func (q *Queue) Process() {
+	if !q.mu.TryLock() {
+		q.log.Debug().Msg("queue is already being processed")
+		return
+	}
+	defer q.mu.Unlock()
+
 	q.log.Debug().Msg("staring queue processing...")
-	cfg := q.cfg.GetBot()
+	if !q.imported {
+		if err := q.importAccountData(); err != nil {
+			q.log.Error().Err(err).Msg("cannot import queue from account data")
+		} else {
+			q.imported = true
+		}
+	}
 
+	cfg := q.cfg.GetBot()
 	batchSize := cfg.QueueBatch()
 	if batchSize == 0 {
 		batchSize = defaultQueueBatch
 	}
+	lifetime := time.Duration(cfg.QueueLifetime()) * time.Hour
+	if lifetime == 0 {
+		lifetime = defaultQueueLifetime
+	}
 
-	maxRetries := cfg.QueueRetries()
-	if maxRetries == 0 {
-		maxRetries = defaultQueueRetries
+	q.expire(lifetime)
+	items, err := q.due(batchSize)
+	if err != nil {
+		q.log.Error().Err(err).Msg("cannot get queue items")
+		return
 	}
+	for _, item := range items {
+		q.try(item)
+	}
+	q.log.Debug().Msg("ended queue processing")
+}
 
-	q.mu.Lock(acQueueKey)
-	defer q.mu.Unlock(acQueueKey)
-	index, err := q.lp.GetAccountData(acQueueKey)
+// expire removes items older than lifetime from the queue and reports them
+func (q *Queue) expire(lifetime time.Duration) {
+	items, err := q.query(selectItems+" WHERE created_at < $1", time.Now().Add(-lifetime).Unix())
 	if err != nil {
-		q.log.Error().Err(err).Msg("cannot get queue index")
+		q.log.Error().Err(err).Msg("cannot get expired queue items")
+		return
+	}
+	for _, item := range items {
+		q.log.Warn().Str("id", item.ID).Str("from", item.From).Str("to", item.To).Int("attempts", item.Attempts).Str("error", item.LastError).Msg("email has expired in queue")
+		if err := q.Remove(item.ID); err != nil {
+			q.log.Error().Err(err).Str("id", item.ID).Msg("cannot dequeue email")
+			continue
+		}
+		if q.expired != nil {
+			q.expired(item, false)
+		}
+	}
+}
+
+// try to send email
+func (q *Queue) try(item *Item) {
+	log := q.log.With().Str("id", item.ID).Str("from", item.From).Str("to", item.To).Logger()
+	err := q.sendmail(item.From, []string{item.To}, item.Data)[0]
+	if err == nil {
+		log.Info().Msg("email from queue was delivered")
+		if err = q.Remove(item.ID); err != nil {
+			log.Error().Err(err).Msg("cannot dequeue email")
+		}
+		return
 	}
 
-	i := 0
-	for id, itemkey := range index {
-		if i > batchSize {
-			q.log.Debug().Msg("finished re-deliveries from queue")
+	if permanent(err) {
+		log.Warn().Err(err).Msg("email from queue cannot be delivered")
+		if rerr := q.Remove(item.ID); rerr != nil {
+			log.Error().Err(rerr).Msg("cannot dequeue email")
 			return
 		}
-		if dequeue := q.try(itemkey, maxRetries); dequeue {
-			q.log.Info().Str("id", id).Msg("email has been delivered")
-			err = q.Remove(id)
-			if err != nil {
-				q.log.Error().Err(err).Str("id", id).Msg("cannot dequeue email")
-			}
+		if q.failed != nil {
+			q.failed(item.To, err)
 		}
-		i++
+		item.LastError = err.Error()
+		if q.expired != nil {
+			q.expired(item, true)
+		}
+		return
 	}
-	q.log.Debug().Msg("ended queue processing")
+
+	next := time.Now().Add(backoff(item.Attempts + 1))
+	log.Info().Err(err).Time("next_attempt", next).Msg("attempted to deliver email, but it's not ready yet")
+	if err = q.postpone(item, next, err); err != nil {
+		log.Error().Err(err).Msg("cannot update queue item")
+	}
+}
+
+// permanent checks if delivery error is permanent (5xx SMTP reply), so the email should not be retried
+func permanent(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
+
+// backoff returns delay before the next attempt: exponential, with up to 20% jitter,
+// so emails queued at the same time (e.g. greylisted by the same server) are not retried all at once
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/5))) //nolint:gosec // jitter doesn't need crypto
 }
@@ -2,100 +2,171 @@ package queue
 
 import (
 	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix/id"
 )
 
-// Add to queue
-func (q *Queue) Add(id, from, to, data string) error {
-	itemkey := acQueueKey + "." + id
-	item := map[string]string{
-		"attempts": "0",
-		"data":     data,
-		"from":     from,
-		"to":       to,
-		"id":       id,
-	}
+const selectItems = "SELECT id, mail_from, rcpt_to, data, attempts, last_error, next_attempt, created_at, room_id, thread_id, event_id, message_id, submitted FROM mailqueue"
 
-	q.mu.Lock(itemkey)
-	defer q.mu.Unlock(itemkey)
-	err := q.lp.SetAccountData(itemkey, item)
+func (q *Queue) migrate() error {
+	_, err := q.db.Exec(`CREATE TABLE IF NOT EXISTS mailqueue (
+		id           VARCHAR(255) PRIMARY KEY,
+		mail_from    TEXT NOT NULL,
+		rcpt_to      TEXT NOT NULL,
+		data         TEXT NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		last_error   TEXT NOT NULL DEFAULT '',
+		next_attempt BIGINT NOT NULL,
+		created_at   BIGINT NOT NULL,
+		room_id      TEXT NOT NULL DEFAULT '',
+		thread_id    TEXT NOT NULL DEFAULT '',
+		event_id     TEXT NOT NULL DEFAULT '',
+		message_id   TEXT NOT NULL DEFAULT '',
+		submitted    BOOLEAN NOT NULL DEFAULT FALSE
+	)`)
 	if err != nil {
-		q.log.Error().Err(err).Str("id", id).Msg("cannot enqueue email")
-		return err
-	}
-
-	q.mu.Lock(acQueueKey)
-	defer q.mu.Unlock(acQueueKey)
-	queueIndex, err := q.lp.GetAccountData(acQueueKey)
-	if err != nil {
-		q.log.Error().Err(err).Msg("cannot get queue index")
-		return err
-	}
-	queueIndex[id] = itemkey
-	err = q.lp.SetAccountData(acQueueKey, queueIndex)
-	if err != nil {
-		q.log.Error().Err(err).Msg("cannot save queue index")
 		return err
 	}
+	_, err = q.db.Exec("CREATE INDEX IF NOT EXISTS mailqueue_next_attempt ON mailqueue (next_attempt)")
+	return err
+}
 
-	return nil
+// Add to queue
+func (q *Queue) Add(id, from, to, data string, origin Origin) error {
+	now := time.Now()
+	return q.insert(&Item{
+		ID:          id,
+		From:        from,
+		To:          to,
+		Data:        data,
+		NextAttempt: now.Add(backoff(1)),
+		CreatedAt:   now,
+		Origin:      origin,
+	})
 }
 
 // Remove from queue
 func (q *Queue) Remove(id string) error {
-	index, err := q.lp.GetAccountData(acQueueKey)
-	if err != nil {
-		q.log.Error().Err(err).Msg("cannot get queue index")
-		return err
-	}
-	itemkey := index[id]
-	if itemkey == "" {
-		itemkey = acQueueKey + "." + id
-	}
-	delete(index, id)
-	err = q.lp.SetAccountData(acQueueKey, index)
+	_, err := q.db.Exec("DELETE FROM mailqueue WHERE id = $1", id)
+	return err
+}
+
+func (q *Queue) insert(item *Item) error {
+	_, err := q.db.Exec(
+		"INSERT INTO mailqueue (id, mail_from, rcpt_to, data, attempts, last_error, next_attempt, created_at, room_id, thread_id, event_id, message_id, submitted) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT (id) DO NOTHING",
+		item.ID, item.From, item.To, item.Data, item.Attempts, item.LastError, item.NextAttempt.Unix(), item.CreatedAt.Unix(),
+		item.Origin.RoomID.String(), item.Origin.ThreadID.String(), item.Origin.EventID.String(), item.Origin.MessageID, item.Origin.Submitted,
+	)
 	if err != nil {
-		q.log.Error().Err(err).Msg("cannot update queue index")
-		return err
+		q.log.Error().Err(err).Str("id", item.ID).Msg("cannot enqueue email")
 	}
+	return err
+}
 
-	q.mu.Lock(itemkey)
-	defer q.mu.Unlock(itemkey)
-	return q.lp.SetAccountData(itemkey, map[string]string{})
+// due returns items ready for the next delivery attempt
+func (q *Queue) due(limit int) ([]*Item, error) {
+	return q.query(selectItems+" WHERE next_attempt <= $1 ORDER BY next_attempt LIMIT $2", time.Now().Unix(), limit)
 }
 
-// try to send email
-func (q *Queue) try(itemkey string, maxRetries int) bool {
-	q.mu.Lock(itemkey)
-	defer q.mu.Unlock(itemkey)
+// postpone the next delivery attempt of the item
+func (q *Queue) postpone(item *Item, next time.Time, reason error) error {
+	_, err := q.db.Exec(
+		"UPDATE mailqueue SET attempts = $1, last_error = $2, next_attempt = $3 WHERE id = $4",
+		item.Attempts+1, reason.Error(), next.Unix(), item.ID,
+	)
+	return err
+}
 
-	item, err := q.lp.GetAccountData(itemkey)
+func (q *Queue) query(query string, args ...any) ([]*Item, error) {
+	rows, err := q.db.Query(query, args...)
 	if err != nil {
-		q.log.Error().Err(err).Str("id", itemkey).Msg("cannot retrieve a queue item")
-		return false
+		return nil, err
 	}
-	q.log.Debug().Any("item", item).Msg("processing queue item")
-	attempts, err := strconv.Atoi(item["attempts"])
+	defer rows.Close()
+
+	items := []*Item{}
+	for rows.Next() {
+		var nextAttempt, createdAt int64
+		var roomID, threadID, eventID string
+		item := &Item{}
+		err := rows.Scan(
+			&item.ID, &item.From, &item.To, &item.Data, &item.Attempts, &item.LastError, &nextAttempt, &createdAt,
+			&roomID, &threadID, &eventID, &item.Origin.MessageID, &item.Origin.Submitted,
+		)
+		if err != nil {
+			return nil, err
+		}
+		item.NextAttempt = time.Unix(nextAttempt, 0)
+		item.CreatedAt = time.Unix(createdAt, 0)
+		item.Origin.RoomID = id.RoomID(roomID)
+		item.Origin.ThreadID = id.EventID(threadID)
+		item.Origin.EventID = id.EventID(eventID)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// importAccountData moves items of the account data queue into the database
+func (q *Queue) importAccountData() error {
+	index, err := q.lp.GetAccountData(acQueueKey)
 	if err != nil {
-		q.log.Error().Err(err).Str("id", itemkey).Msg("cannot parse attempts")
-		return false
+		return err
 	}
-	if attempts > maxRetries {
-		return true
+	if len(index) == 0 {
+		return nil
 	}
 
-	err = q.sendmail(item["from"], item["to"], item["data"])
-	if err == nil {
-		q.log.Info().Str("id", itemkey).Msg("email from queue was delivered")
-		return true
+	q.log.Info().Int("items", len(index)).Msg("importing queue from account data")
+	for itemID, itemkey := range index {
+		data, err := q.lp.GetAccountData(itemkey)
+		if err != nil {
+			return err
+		}
+		if data["data"] != "" {
+			if err := q.insert(accountDataItem(itemID, data)); err != nil {
+				return err
+			}
+		}
+		if err := q.lp.SetAccountData(itemkey, map[string]string{}); err != nil {
+			return err
+		}
 	}
 
-	q.log.Info().Str("id", itemkey).Str("from", item["from"]).Str("to", item["to"]).Err(err).Msg("attempted to deliver email, but it's not ready yet")
-	attempts++
-	item["attempts"] = strconv.Itoa(attempts)
-	err = q.lp.SetAccountData(itemkey, item)
-	if err != nil {
-		q.log.Error().Err(err).Str("id", itemkey).Msg("cannot update attempt count on email")
+	return q.lp.SetAccountData(acQueueKey, map[string]string{})
+}
+
+// accountDataItem converts account data of the queue item
+func accountDataItem(itemID string, data map[string]string) *Item {
+	attempts, _ := strconv.Atoi(data["attempts"])                    //nolint:errcheck // 0 is fine
+	submitted, _ := strconv.ParseBool(data["submitted"])             //nolint:errcheck // false is fine
+	createdAt, _ := strconv.ParseInt(data["created_at"], 10, 64)     //nolint:errcheck // now is used instead
+	nextAttempt, _ := strconv.ParseInt(data["next_attempt"], 10, 64) //nolint:errcheck // now is used instead
+	now := time.Now().Unix()
+	if createdAt == 0 {
+		createdAt = now
+	}
+	if nextAttempt == 0 {
+		nextAttempt = now
 	}
 
-	return false
+	return &Item{
+		ID:          itemID,
+		From:        data["from"],
+		To:          data["to"],
+		Data:        data["data"],
+		Attempts:    attempts,
+		LastError:   data["last_error"],
+		NextAttempt: time.Unix(nextAttempt, 0),
+		CreatedAt:   time.Unix(createdAt, 0),
+		Origin: Origin{
+			RoomID:    id.RoomID(data["room_id"]),
+			ThreadID:  id.EventID(data["thread_id"]),
+			EventID:   id.EventID(data["event_id"]),
+			MessageID: data["message_id"],
+			Submitted: submitted,
+		},
+	}
 }
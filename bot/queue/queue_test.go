@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"database/sql"
+	"net/textproto"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+)
+
+// fakeAccountData is in-memory account data of the bot
+type fakeAccountData map[string]map[string]string
+
+func (f fakeAccountData) GetAccountData(name string) (map[string]string, error) {
+	return f[name], nil
+}
+
+func (f fakeAccountData) SetAccountData(name string, data map[string]string) error {
+	f[name] = data
+	return nil
+}
+
+func newTestQueue(t *testing.T, lp fakeAccountData) *Queue {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // each connection has its own in-memory database
+	t.Cleanup(func() { db.Close() })
+
+	log := zerolog.Nop()
+	q := &Queue{db: db, lp: lp, log: &log}
+	if err := q.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func testItem(itemID string, nextAttempt, createdAt time.Time) *Item {
+	return &Item{
+		ID:          itemID,
+		From:        "sender@example.com",
+		To:          "rcpt@example.org",
+		Data:        "Subject: test\r\n\r\nhello\r\n",
+		NextAttempt: nextAttempt,
+		CreatedAt:   createdAt,
+		Origin:      Origin{RoomID: "!room:example.com", MessageID: "<test@example.com>", Submitted: true},
+	}
+}
+
+func TestInsertDue(t *testing.T) {
+	q := newTestQueue(t, fakeAccountData{})
+	now := time.Now()
+	if err := q.Add("later", "sender@example.com", "rcpt@example.org", "data", Origin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.insert(testItem("due", now.Add(-time.Minute), now.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	// duplicate is ignored
+	if err := q.insert(testItem("due", now.Add(time.Hour), now)); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := q.due(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 due item, got %d", len(items))
+	}
+	item := items[0]
+	expected := testItem("due", now.Add(-time.Minute), now.Add(-time.Hour))
+	if item.ID != expected.ID || item.From != expected.From || item.To != expected.To || item.Data != expected.Data || item.Origin != expected.Origin {
+		t.Errorf("unexpected item %+v", item)
+	}
+	if item.NextAttempt.Unix() != expected.NextAttempt.Unix() || item.CreatedAt.Unix() != expected.CreatedAt.Unix() {
+		t.Errorf("unexpected item times %+v", item)
+	}
+
+	if items, err = q.due(0); err != nil || len(items) != 0 {
+		t.Errorf("expected no items with zero limit, got %d (%v)", len(items), err)
+	}
+}
+
+func TestPostpone(t *testing.T) {
+	q := newTestQueue(t, fakeAccountData{})
+	now := time.Now()
+	item := testItem("item", now.Add(-time.Minute), now)
+	if err := q.insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.postpone(item, now.Add(time.Hour), sql.ErrConnDone); err != nil {
+		t.Fatal(err)
+	}
+	items, err := q.due(10)
+	if err != nil || len(items) != 0 {
+		t.Fatalf("expected no due items, got %d (%v)", len(items), err)
+	}
+	items, err = q.query(selectItems)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 item, got %d (%v)", len(items), err)
+	}
+	if items[0].Attempts != 1 || items[0].LastError != sql.ErrConnDone.Error() || items[0].NextAttempt.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("item is not postponed: %+v", items[0])
+	}
+}
+
+func TestExpire(t *testing.T) {
+	q := newTestQueue(t, fakeAccountData{})
+	now := time.Now()
+	for _, item := range []*Item{testItem("old", now, now.Add(-2*time.Hour)), testItem("new", now, now)} {
+		if err := q.insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expired []string
+	q.SetExpired(func(item *Item, permanent bool) {
+		if permanent {
+			t.Errorf("%s is reported as permanent failure", item.ID)
+		}
+		expired = append(expired, item.ID)
+	})
+
+	q.expire(time.Hour)
+	if len(expired) != 1 || expired[0] != "old" {
+		t.Errorf("unexpected expired items: %v", expired)
+	}
+	items, err := q.query(selectItems)
+	if err != nil || len(items) != 1 || items[0].ID != "new" {
+		t.Errorf("unexpected items left in the queue: %+v (%v)", items, err)
+	}
+}
+
+func TestPermanentFailure(t *testing.T) {
+	q := newTestQueue(t, fakeAccountData{})
+	item := testItem("failed", time.Now(), time.Now())
+	if err := q.insert(item); err != nil {
+		t.Fatal(err)
+	}
+	sendErr := &textproto.Error{Code: 550, Msg: "5.1.1 user unknown"}
+	q.SetSendmail(func(string, []string, string) []error {
+		return []error{sendErr}
+	})
+	var failed, expired string
+	var failedErr error
+	q.SetFailed(func(to string, err error) {
+		failed = to
+		failedErr = err
+	})
+	q.SetExpired(func(item *Item, permanent bool) {
+		if !permanent {
+			t.Errorf("%s is not reported as permanent failure", item.ID)
+		}
+		expired = item.ID
+	})
+
+	q.try(item)
+	if failed != "rcpt@example.org" || failedErr != sendErr || expired != "failed" { //nolint:errorlint // exact error is passed
+		t.Errorf("permanent failure is not reported: %q (%v), %q", failed, failedErr, expired)
+	}
+	items, err := q.query(selectItems)
+	if err != nil || len(items) != 0 {
+		t.Errorf("failed item is left in the queue: %+v (%v)", items, err)
+	}
+}
+
+func TestImportAccountData(t *testing.T) {
+	lp := fakeAccountData{
+		acQueueKey: {"item": acQueueKey + ".item", "sent": acQueueKey + ".sent"},
+		acQueueKey + ".item": {
+			"from":         "sender@example.com",
+			"to":           "rcpt@example.org",
+			"data":         "Subject: test\r\n\r\nhello\r\n",
+			"attempts":     "3",
+			"last_error":   "451 greylisted",
+			"next_attempt": "1700000000",
+			"created_at":   "1690000000",
+			"room_id":      "!room:example.com",
+			"message_id":   "<test@example.com>",
+			"submitted":    "true",
+		},
+		acQueueKey + ".sent": {}, // already delivered
+	}
+	q := newTestQueue(t, lp)
+	original := lp[acQueueKey+".item"]
+
+	if err := q.importAccountData(); err != nil {
+		t.Fatal(err)
+	}
+	items, err := q.query(selectItems)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 imported item, got %d (%v)", len(items), err)
+	}
+	item := items[0]
+	if item.ID != "item" || item.From != "sender@example.com" || item.To != "rcpt@example.org" || item.Attempts != 3 || item.LastError != "451 greylisted" ||
+		item.NextAttempt.Unix() != 1700000000 || item.CreatedAt.Unix() != 1690000000 ||
+		item.Origin != (Origin{RoomID: "!room:example.com", MessageID: "<test@example.com>", Submitted: true}) {
+		t.Errorf("unexpected imported item %+v", item)
+	}
+	if len(lp[acQueueKey]) != 0 || len(lp[acQueueKey+".item"]) != 0 {
+		t.Errorf("account data is not cleared: %+v", lp)
+	}
+
+	// nothing to import
+	if err = q.importAccountData(); err != nil {
+		t.Fatal(err)
+	}
+	// interrupted import left the account data as is, the item is imported only once
+	lp[acQueueKey] = map[string]string{"item": acQueueKey + ".item"}
+	original["attempts"] = "4"
+	lp[acQueueKey+".item"] = original
+	if err = q.importAccountData(); err != nil {
+		t.Fatal(err)
+	}
+	items, err = q.query(selectItems)
+	if err != nil || len(items) != 1 || items[0].Attempts != 3 {
+		t.Errorf("item is imported again: %+v (%v)", items, err)
+	}
+}
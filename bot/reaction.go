@@ -6,11 +6,16 @@ import (
 	"gitlab.com/etke.cc/linkpearl"
 )
 
+// reactionNotSpam trains the spam classifier with non-spam email
+const reactionNotSpam = "notspam"
+
 var supportedReactions = map[string]string{
-	"⛔️":   commandSpamlistAdd,
-	"🛑":    commandSpamlistAdd,
-	"🚫":    commandSpamlistAdd,
-	"spam": commandSpamlistAdd,
+	"⛔️":       commandSpamlistAdd,
+	"🛑":        commandSpamlistAdd,
+	"🚫":        commandSpamlistAdd,
+	"spam":     commandSpamlistAdd,
+	"✅":        reactionNotSpam,
+	"not spam": reactionNotSpam,
 }
 
 func (b *Bot) handleReaction(ctx context.Context) {
@@ -20,6 +25,11 @@ func (b *Bot) handleReaction(ctx context.Context) {
 	if !ok { // cannot do anything with it
 		return
 	}
+	// spam classifier is shared by the room, so only owners can train it
+	owner := b.allowOwner(evt.Sender, evt.RoomID)
+	if action == reactionNotSpam && !owner {
+		return
+	}
 
 	srcID := content.GetRelatesTo().EventID
 	srcEvt, err := b.lp.GetClient().GetEvent(evt.RoomID, srcID)
@@ -38,7 +48,15 @@ func (b *Bot) handleReaction(ctx context.Context) {
 	ctx = threadIDToContext(ctx, threadID)
 	linkpearl.ParseContent(evt, b.log)
 
+	if action == reactionNotSpam {
+		b.bayesTrain(ctx, false, srcID)
+		return
+	}
+
 	if action == commandSpamlistAdd {
+		if owner {
+			b.bayesTrain(ctx, true, srcID)
+		}
 		sender := linkpearl.EventField[string](&srcEvt.Content, eventFromKey)
 		if sender == "" {
 			b.Error(ctx, "cannot get sender of the email")
@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// enhancedStatusRegex matches enhanced status code (RFC 3463) of the SMTP reply, e.g.: 5.1.1
+var enhancedStatusRegex = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// unknownUserRegex matches SMTP reply text about nonexistent recipient, used when the reply has no enhanced status code
+var unknownUserRegex = regexp.MustCompile(`(?i)(user unknown|unknown user|no such (user|mailbox|recipient)|mailbox (does not exist|not found)|recipient (does not exist|not found))`)
+
+// suppressible checks if the enhanced status code means that the recipient doesn't exist or is disabled (hard bounce).
+// Other permanent failures (e.g. 5.7.1, rejected by policy) are about the email, not the recipient
+func suppressible(status string) bool {
+	return strings.HasPrefix(status, "5.1.") || status == "5.2.1"
+}
+
+// enhancedStatus returns enhanced status code of the SMTP error, empty if the error has none
+func enhancedStatus(err error) string {
+	var smtpErr *textproto.Error
+	if !errors.As(err, &smtpErr) {
+		return ""
+	}
+	if fields := strings.Fields(smtpErr.Msg); len(fields) > 0 && enhancedStatusRegex.MatchString(fields[0]) {
+		return fields[0]
+	}
+	return ""
+}
+
+// shouldSuppress checks if the recipient should be suppressed because of the permanent SMTP error
+func shouldSuppress(err error) bool {
+	var smtpErr *textproto.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code < 500 {
+		return false
+	}
+	if status := enhancedStatus(err); status != "" {
+		return suppressible(status)
+	}
+	// basic reply codes (e.g. 550) are used for policy rejections too, so only the explicit reason is trusted
+	return unknownUserRegex.MatchString(smtpErr.Msg)
+}
+
+// suppressFailed suppresses the recipient of failed delivery, if the error says it doesn't exist
+func (b *Bot) suppressFailed(to string, err error) {
+	if shouldSuppress(err) {
+		b.suppress(to, err.Error())
+	}
+}
+
+// suppress adds the recipient to the suppression list
+func (b *Bot) suppress(addr, reason string) {
+	b.suppressionsMu.Lock()
+	defer b.suppressionsMu.Unlock()
+
+	suppressions := b.cfg.GetSuppressions()
+	if _, _, ok := suppressions.Get(addr); ok {
+		return
+	}
+	b.log.Info().Str("addr", addr).Str("reason", reason).Msg("adding recipient to the suppression list")
+	suppressions.Add(addr, reason)
+	if err := b.cfg.SetSuppressions(suppressions); err != nil {
+		b.log.Error().Err(err).Str("addr", addr).Msg("cannot update suppression list")
+	}
+}
+
+// filterSuppressed returns recipients that are not suppressed and reasons of the suppressed ones
+func (b *Bot) filterSuppressed(recipients []string) (allowed []string, suppressed map[string]string) {
+	suppressions := b.cfg.GetSuppressions()
+	allowed = make([]string, 0, len(recipients))
+	suppressed = map[string]string{}
+	for _, rcpt := range recipients {
+		if reason, _, ok := suppressions.Get(rcpt); ok {
+			suppressed[rcpt] = reason
+			continue
+		}
+		allowed = append(allowed, rcpt)
+	}
+	return allowed, suppressed
+}
+
+// warnSuppressed notifies about suppressed recipients the email will not be sent to
+func (b *Bot) warnSuppressed(ctx context.Context, suppressed map[string]string) {
+	for _, addr := range utils.MapKeys(suppressed) {
+		b.Error(ctx, "email will not be sent to %s, because it is in the suppression list: %s", addr, suppressed[addr])
+	}
+}
+
+// dropSuppressed removes suppressed recipients from the list
+func dropSuppressed(addrs []string, suppressed map[string]string) []string {
+	if len(suppressed) == 0 {
+		return addrs
+	}
+	filtered := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := suppressed[addr]; !ok {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
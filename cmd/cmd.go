@@ -19,7 +19,9 @@ import (
 	"gitlab.com/etke.cc/linkpearl"
 
 	"gitlab.com/etke.cc/postmoogle/bot"
+	"gitlab.com/etke.cc/postmoogle/bot/bayes"
 	mxconfig "gitlab.com/etke.cc/postmoogle/bot/config"
+	"gitlab.com/etke.cc/postmoogle/bot/inbox"
 	"gitlab.com/etke.cc/postmoogle/bot/queue"
 	"gitlab.com/etke.cc/postmoogle/config"
 	"gitlab.com/etke.cc/postmoogle/smtp"
@@ -28,6 +30,8 @@ import (
 
 var (
 	q     *queue.Queue
+	ib    *inbox.Inbox
+	bs    *bayes.Bayes
 	hc    *healthchecks.Client
 	mxc   *mxconfig.Manager
 	mxb   *bot.Bot
@@ -115,32 +119,87 @@ func initMatrix(cfg *config.Config) {
 	}
 
 	mxc = mxconfig.New(lp, &log)
-	q = queue.New(lp, mxc, &log)
-	mxb, err = bot.New(q, lp, &log, mxc, cfg.Proxies, cfg.Prefix, cfg.Domains, cfg.Admins, bot.MBXConfig(cfg.Mailboxes))
+	q, err = queue.New(db, lp, mxc, &log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot initialize queue")
+	}
+	ib, err = inbox.New(db, cfg.Spool, &log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot initialize inbox")
+	}
+	bs, err = bayes.New(db, &log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot initialize spam classifier")
+	}
+	mxb, err = bot.New(q, ib, bs, lp, &log, mxc, cfg.Proxies, cfg.Prefix, cfg.Domains, cfg.Admins, bot.MBXConfig(cfg.Mailboxes))
 	if err != nil {
 		log.Panic().Err(err).Msg("cannot start matrix bot")
 	}
+	ib.SetReceiver(mxb.IncomingEmail)
 	log.Debug().Msg("bot has been created")
 }
 
 func initSMTP(cfg *config.Config) {
+	relay := &smtp.RelayConfig{
+		Host:         cfg.Relay.Host,
+		Port:         cfg.Relay.Port,
+		Usename:      cfg.Relay.Username,
+		Password:     cfg.Relay.Password,
+		TLS:          cfg.Relay.TLS,
+		Auth:         cfg.Relay.Auth,
+		CA:           cfg.Relay.CA,
+		InsecureAuth: cfg.Relay.InsecureAuth,
+	}
+	if err := relay.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("cannot use relay host")
+	}
+	transports, err := smtp.LoadTransports(cfg.Relay.Transports)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot load transport map")
+	}
 	smtpm = smtp.NewManager(&smtp.Config{
-		Domains:     cfg.Domains,
-		Port:        cfg.Port,
-		TLSCerts:    cfg.TLS.Certs,
-		TLSKeys:     cfg.TLS.Keys,
-		TLSPort:     cfg.TLS.Port,
-		TLSRequired: cfg.TLS.Required,
-		Logger:      &log,
-		MaxSize:     cfg.MaxSize,
-		Bot:         mxb,
-		Callers:     []smtp.Caller{mxb, q},
-		Relay: &smtp.RelayConfig{
-			Host:     cfg.Relay.Host,
-			Port:     cfg.Relay.Port,
-			Usename:  cfg.Relay.Username,
-			Password: cfg.Relay.Password,
+		Domains:       cfg.Domains,
+		Port:          cfg.Port,
+		TLSCerts:      cfg.TLS.Certs,
+		TLSKeys:       cfg.TLS.Keys,
+		TLSPort:       cfg.TLS.Port,
+		TLSRequired:   cfg.TLS.Required,
+		ProxyProtocol: cfg.ProxyProtocol,
+		Limits: smtp.LimitsConfig{
+			Connections: cfg.Limits.Connections,
+			Rate:        cfg.Limits.Rate,
+			Messages:    cfg.Limits.Messages,
+			Ban:         cfg.Limits.Ban,
 		},
+		Scanner: smtp.ScannerConfig{
+			Type:     cfg.Scanner.Type,
+			Address:  cfg.Scanner.Address,
+			Password: cfg.Scanner.Password,
+			Timeout:  time.Duration(cfg.Scanner.Timeout) * time.Second,
+			Greylist: cfg.Scanner.Greylist,
+			Reject:   cfg.Scanner.Reject,
+		},
+		Milters: smtp.MilterConfig{
+			Addresses: cfg.Milters.Addresses,
+			Action:    cfg.Milters.Action,
+			Timeout:   time.Duration(cfg.Milters.Timeout) * time.Second,
+		},
+		LMTP: smtp.LMTPConfig{
+			Addr:       cfg.LMTP.Addr,
+			Skip:       cfg.LMTP.Skip,
+			AuthservID: cfg.LMTP.AuthservID,
+			Allowed:    cfg.LMTP.Allowed,
+		},
+		Logger:     &log,
+		MaxSize:    cfg.MaxSize,
+		Spool:      cfg.Spool,
+		Inbox:      ib,
+		DNS:        cfg.DNS,
+		ARC:        cfg.ARCTrusted,
+		Bot:        mxb,
+		Callers:    []smtp.Caller{mxb, q},
+		Relay:      relay,
+		Transports: transports,
 	})
 }
 
@@ -152,10 +211,20 @@ func initCron() {
 		log.Error().Err(err).Msg("cannot start queue processing cronjob")
 	}
 
+	err = cron.AddJob("* * * * *", ib.Process)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot start inbox processing cronjob")
+	}
+
 	err = cron.AddJob("*/5 * * * *", mxb.SyncRooms)
 	if err != nil {
 		log.Error().Err(err).Msg("cannot start sync rooms cronjob")
 	}
+
+	err = cron.AddJob("0 * * * *", bs.Prune)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot start spam classifier pruning cronjob")
+	}
 }
 
 func initShutdown(quit chan struct{}) {
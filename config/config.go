@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strconv"
 	"time"
 
 	"gitlab.com/etke.cc/go/env"
@@ -13,19 +14,23 @@ func New() *Config {
 	env.SetPrefix(prefix)
 
 	cfg := &Config{
-		Homeserver:   env.String("homeserver", defaultConfig.Homeserver),
-		Login:        env.String("login", defaultConfig.Login),
-		Password:     env.String("password", defaultConfig.Password),
-		SharedSecret: env.String("sharedsecret", defaultConfig.SharedSecret),
-		Prefix:       env.String("prefix", defaultConfig.Prefix),
-		Domains:      migrateDomains("domain", "domains"),
-		Port:         env.String("port", defaultConfig.Port),
-		Proxies:      env.Slice("proxies"),
-		NoEncryption: env.Bool("noencryption"),
-		DataSecret:   env.String("data.secret", defaultConfig.DataSecret),
-		MaxSize:      env.Int("maxsize", defaultConfig.MaxSize),
-		StatusMsg:    env.String("statusmsg", defaultConfig.StatusMsg),
-		Admins:       env.Slice("admins"),
+		Homeserver:    env.String("homeserver", defaultConfig.Homeserver),
+		Login:         env.String("login", defaultConfig.Login),
+		Password:      env.String("password", defaultConfig.Password),
+		SharedSecret:  env.String("sharedsecret", defaultConfig.SharedSecret),
+		Prefix:        env.String("prefix", defaultConfig.Prefix),
+		Domains:       migrateDomains("domain", "domains"),
+		Port:          env.String("port", defaultConfig.Port),
+		Proxies:       env.Slice("proxies"),
+		ProxyProtocol: env.Bool("proxies.protocol"),
+		DNS:           env.String("dns", defaultConfig.DNS),
+		ARCTrusted:    env.Slice("arc.trusted"),
+		NoEncryption:  env.Bool("noencryption"),
+		DataSecret:    env.String("data.secret", defaultConfig.DataSecret),
+		MaxSize:       env.Int("maxsize", defaultConfig.MaxSize),
+		Spool:         env.String("spool", defaultConfig.Spool),
+		StatusMsg:     env.String("statusmsg", defaultConfig.StatusMsg),
+		Admins:        env.Slice("admins"),
 		Mailboxes: Mailboxes{
 			Reserved:   env.Slice("mailboxes.reserved"),
 			Forwarded:  env.Slice("mailboxes.forwarded"),
@@ -43,16 +48,46 @@ func New() *Config {
 			HealchecksUUID:     env.String("monitoring.healthchecks.uuid", ""),
 			HealthechsDuration: time.Duration(env.Int("monitoring.healthchecks.duration", int(defaultConfig.Monitoring.HealthechsDuration))) * time.Second,
 		},
+		Limits: Limits{
+			Connections: env.Int("limits.connections", defaultConfig.Limits.Connections),
+			Rate:        env.Int("limits.rate", defaultConfig.Limits.Rate),
+			Messages:    env.Int("limits.messages", defaultConfig.Limits.Messages),
+			Ban:         env.Int("limits.ban", defaultConfig.Limits.Ban),
+		},
+		Scanner: Scanner{
+			Type:     env.String("scanner.type", defaultConfig.Scanner.Type),
+			Address:  env.String("scanner.addr", defaultConfig.Scanner.Address),
+			Password: env.String("scanner.password", defaultConfig.Scanner.Password),
+			Timeout:  env.Int("scanner.timeout", defaultConfig.Scanner.Timeout),
+			Greylist: envFloat("scanner.greylist", defaultConfig.Scanner.Greylist),
+			Reject:   envFloat("scanner.reject", defaultConfig.Scanner.Reject),
+		},
+		Milters: Milters{
+			Addresses: env.Slice("milters"),
+			Action:    env.String("milters.action", defaultConfig.Milters.Action),
+			Timeout:   env.Int("milters.timeout", defaultConfig.Milters.Timeout),
+		},
+		LMTP: LMTP{
+			Addr:       env.String("lmtp.addr", defaultConfig.LMTP.Addr),
+			Skip:       env.Slice("lmtp.skip"),
+			AuthservID: env.String("lmtp.authserv_id", defaultConfig.LMTP.AuthservID),
+			Allowed:    env.Slice("lmtp.allowed"),
+		},
 		LogLevel: env.String("loglevel", defaultConfig.LogLevel),
 		DB: DB{
 			DSN:     env.String("db.dsn", defaultConfig.DB.DSN),
 			Dialect: env.String("db.dialect", defaultConfig.DB.Dialect),
 		},
 		Relay: Relay{
-			Host:     env.String("relay.host", defaultConfig.Relay.Host),
-			Port:     env.String("relay.port", defaultConfig.Relay.Port),
-			Username: env.String("relay.username", defaultConfig.Relay.Username),
-			Password: env.String("relay.password", defaultConfig.Relay.Password),
+			Host:         env.String("relay.host", defaultConfig.Relay.Host),
+			Port:         env.String("relay.port", defaultConfig.Relay.Port),
+			Username:     env.String("relay.username", defaultConfig.Relay.Username),
+			Password:     env.String("relay.password", defaultConfig.Relay.Password),
+			TLS:          env.String("relay.tls", defaultConfig.Relay.TLS),
+			Auth:         env.String("relay.auth", defaultConfig.Relay.Auth),
+			CA:           env.String("relay.ca", defaultConfig.Relay.CA),
+			InsecureAuth: env.Bool("relay.insecure_auth"),
+			Transports:   env.String("relay.transports", defaultConfig.Relay.Transports),
 		},
 	}
 
@@ -68,3 +103,18 @@ func migrateDomains(oldKey, newKey string) []string {
 
 	return append(domains, env.Slice(newKey)...)
 }
+
+// envFloat returns float vars, env lib supports ints only
+func envFloat(shortkey string, defaultValue float64) float64 {
+	str := env.String(shortkey, "")
+	if str == "" {
+		return defaultValue
+	}
+
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return defaultValue
+	}
+
+	return val
+}
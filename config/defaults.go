@@ -6,6 +6,7 @@ var defaultConfig = &Config{
 	Port:      "25",
 	Prefix:    "!pm",
 	MaxSize:   1024,
+	Spool:     "spool",
 	StatusMsg: "Delivering emails",
 	Mailboxes: Mailboxes{
 		Activation: "none",
@@ -21,4 +22,15 @@ var defaultConfig = &Config{
 	TLS: TLS{
 		Port: "587",
 	},
+	Scanner: Scanner{
+		Timeout: 10,
+	},
+	Relay: Relay{
+		TLS:  "starttls",
+		Auth: "plain",
+	},
+	Milters: Milters{
+		Action:  "tempfail",
+		Timeout: 10,
+	},
 }
@@ -18,6 +18,12 @@ type Config struct {
 	Port string
 	// Proxies is list of trusted SMTP proxies
 	Proxies []string
+	// ProxyProtocol enables PROXY protocol (v1 and v2) for connections from trusted proxies
+	ProxyProtocol bool
+	// DNS server (host:port) used by the email authentication checks
+	DNS string
+	// ARCTrusted is list of ARC sealer domains, trusted to relax SPF/DKIM/DMARC checks of forwarded emails
+	ARCTrusted []string
 	// RoomID of the admin room
 	LogLevel string
 	// DataSecret is account data secret key (password) to encrypt all account data values
@@ -28,6 +34,8 @@ type Config struct {
 	Prefix string
 	// MaxSize of an email (including attachments)
 	MaxSize int
+	// Spool is a directory to store incoming emails while they're processed
+	Spool string
 	// StatusMsg of the bot
 	StatusMsg string
 	// Mailboxes config
@@ -44,6 +52,18 @@ type Config struct {
 	// Monitoring config
 	Monitoring Monitoring
 
+	// Limits config
+	Limits Limits
+
+	// Scanner config
+	Scanner Scanner
+
+	// Milters config
+	Milters Milters
+
+	// LMTP config
+	LMTP LMTP
+
 	Relay Relay
 }
 
@@ -71,6 +91,56 @@ type Monitoring struct {
 	HealthechsDuration time.Duration
 }
 
+// Limits config of SMTP connections, 0 = unlimited
+type Limits struct {
+	// Connections is max concurrent connections per IP
+	Connections int
+	// Rate is max new connections per IP per minute
+	Rate int
+	// Messages is max messages per SMTP session
+	Messages int
+	// Ban is an amount of limit violations, after which the IP will be banned automatically (if automatic banlist is enabled)
+	Ban int
+}
+
+// Scanner config of the external spam scanner
+type Scanner struct {
+	// Type of the scanner, rspamd or spamd, empty = disabled
+	Type string
+	// Address of the scanner, URL of rspamd worker (http://localhost:11333) or host:port of spamd (localhost:783)
+	Address string
+	// Password of rspamd, optional
+	Password string
+	// Timeout of a single scan in seconds
+	Timeout int
+	// Greylist is min score to greylist email, 0 = rely on the scanner's action
+	Greylist float64
+	// Reject is min score to reject email, 0 = rely on the scanner's action
+	Reject float64
+}
+
+// LMTP config
+type LMTP struct {
+	// Addr of LMTP listener, e.g.: unix:/run/postmoogle/lmtp.sock or localhost:24
+	Addr string
+	// Skip checks already performed by the MTA: greylist, auth, scanner, milters
+	Skip []string
+	// AuthservID of the MTA, its Authentication-Results headers are trusted when auth checks are skipped
+	AuthservID string
+	// Allowed IP addresses of the MTA, if it connects over TCP not from loopback
+	Allowed []string
+}
+
+// Milters config
+type Milters struct {
+	// Addresses of milters, e.g.: inet:localhost:8891, unix:/run/opendkim/opendkim.sock
+	Addresses []string
+	// Action on milter failure: accept, tempfail or reject
+	Action string
+	// Timeout of a single milter command in seconds
+	Timeout int
+}
+
 // Mailboxes config
 type Mailboxes struct {
 	Reserved   []string
@@ -80,8 +150,13 @@ type Mailboxes struct {
 
 // Relay config
 type Relay struct {
-	Host     string
-	Port     string
-	Username string
-	Password string
+	Host         string
+	Port         string
+	Username     string
+	Password     string
+	TLS          string
+	Auth         string
+	CA           string
+	InsecureAuth bool
+	Transports   string
 }
@@ -0,0 +1,519 @@
+package email
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+const (
+	arcSeal           = "arc-seal"
+	arcMessage        = "arc-message-signature"
+	arcResults        = "arc-authentication-results"
+	arcMaxInstances   = 50
+	dkimSelector      = "postmoogle"
+	canonicalRelaxed  = "relaxed"
+	canonicalSimple   = "simple"
+	algorithmRSA      = "rsa-sha256"
+	algorithmED25519  = "ed25519-sha256"
+	headerFoldingSize = 72
+)
+
+// arcSignedHeaders are headers signed by ARC-Message-Signature, if present
+var arcSignedHeaders = []string{
+	"from", "reply-to", "subject", "date", "to", "cc", "message-id",
+	"in-reply-to", "references", "mime-version", "content-type",
+	"content-transfer-encoding", "dkim-signature",
+}
+
+var (
+	// ErrARCStructure returned when ARC header sets are malformed
+	ErrARCStructure = errors.New("arc: invalid structure of ARC sets")
+	// ErrARCBodyHash returned when body hash doesn't match
+	ErrARCBodyHash = errors.New("arc: body hash did not verify")
+	// ErrARCChain returned when chain validation status of the seal is invalid
+	ErrARCChain = errors.New("arc: invalid chain validation status")
+)
+
+// ARCResult is a result of the ARC chain validation (RFC 8617)
+type ARCResult struct {
+	Value    authres.ResultValue
+	Instance int
+	Domain   string
+	Err      error
+}
+
+// AuthResult converts ARC result to the Authentication-Results entry
+func (r *ARCResult) AuthResult() authres.Result {
+	result := &authres.GenericResult{Method: "arc", Value: r.Value, Params: map[string]string{}}
+	if r.Instance > 0 {
+		result.Params["header.d"] = r.Domain
+		result.Params["header.i"] = strconv.Itoa(r.Instance)
+	}
+	if r.Err != nil {
+		result.Params["reason"] = r.Err.Error()
+	}
+	return result
+}
+
+type arcSet struct {
+	seal    string
+	message string
+	results string
+}
+
+// VerifyARC validates ARC chain of the raw email
+func VerifyARC(r io.Reader, lookupTXT func(string) ([]string, error)) *ARCResult {
+	br := bufio.NewReader(r)
+	headers, err := readRawHeader(br)
+	if err != nil {
+		return &ARCResult{Value: authres.ResultFail, Err: err}
+	}
+	sets, err := arcSets(headers)
+	if err != nil {
+		return &ARCResult{Value: authres.ResultFail, Err: err}
+	}
+	if len(sets) == 0 {
+		return &ARCResult{Value: authres.ResultNone}
+	}
+
+	latest := sets[len(sets)-1]
+	result := &ARCResult{Value: authres.ResultFail, Instance: len(sets), Domain: parseTags(fieldValue(latest.seal))["d"]}
+	for i, set := range sets {
+		cv := parseTags(fieldValue(set.seal))["cv"]
+		if (i == 0 && cv != "none") || (i > 0 && cv != "pass") {
+			result.Err = ErrARCChain
+			return result
+		}
+	}
+
+	if err := verifyARCMessage(br, headers, latest.message, lookupTXT); err != nil {
+		result.Err = err
+		return result
+	}
+	for i := len(sets); i > 0; i-- {
+		if err := verifyARCSeal(sets[:i], lookupTXT); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	result.Value = authres.ResultPass
+	return result
+}
+
+// SealARC adds new ARC set to the raw email, signed with the DKIM key.
+// The data is returned as-is if it cannot be sealed
+func SealARC(data, domain, privkey, authservID string, results []authres.Result, lookupTXT func(string) ([]string, error)) string {
+	signer, err := parsePrivateKey(privkey)
+	if err != nil {
+		return data
+	}
+
+	chain := VerifyARC(strings.NewReader(data), lookupTXT)
+	if chain.Value == authres.ResultFail && chain.Instance == 0 {
+		// broken ARC structure cannot be sealed
+		return data
+	}
+	instance := chain.Instance + 1
+	if instance > arcMaxInstances {
+		return data
+	}
+	cv := string(chain.Value)
+
+	br := bufio.NewReader(strings.NewReader(data))
+	headers, err := readRawHeader(br)
+	if err != nil {
+		return data
+	}
+	bodyHash, err := hashBody(br, canonicalRelaxed)
+	if err != nil {
+		return data
+	}
+
+	tags := "i=" + strconv.Itoa(instance) + "; a=" + signatureAlgorithm(signer) + "; d=" + domain + "; s=" + dkimSelector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10)
+	aar := "ARC-Authentication-Results: i=" + strconv.Itoa(instance) + "; " + authres.Format(authservID, append(results, chain.AuthResult())) + "\r\n"
+
+	signedHeaders := []string{}
+	for _, name := range arcSignedHeaders {
+		for _, field := range headers {
+			if fieldName(field) == name {
+				signedHeaders = append(signedHeaders, name)
+			}
+		}
+	}
+	ams := "ARC-Message-Signature: " + tags + "; c=relaxed/relaxed; h=" + strings.Join(signedHeaders, ":") + "; bh=" + bodyHash + "; b="
+	signature, err := signHash(signer, hashHeaders(headers, signedHeaders, ams, canonicalRelaxed))
+	if err != nil {
+		return data
+	}
+	ams += foldValue(signature) + "\r\n"
+
+	existing, _ := arcSets(headers) //nolint:errcheck // already checked by VerifyARC
+	seal := "ARC-Seal: " + tags + "; cv=" + cv + "; b="
+	signature, err = signHash(signer, hashSeal(append(existing, &arcSet{seal: seal, message: ams, results: aar})))
+	if err != nil {
+		return data
+	}
+	seal += foldValue(signature) + "\r\n"
+
+	return seal + ams + aar + data
+}
+
+// verifyARCMessage verifies ARC-Message-Signature of the email
+func verifyARCMessage(body io.Reader, headers []string, ams string, lookupTXT func(string) ([]string, error)) error {
+	tags := parseTags(fieldValue(ams))
+	headerCanon, bodyCanon := parseCanonicalization(tags["c"])
+
+	bodyHash, err := hashBody(body, bodyCanon)
+	if err != nil {
+		return err
+	}
+	if bodyHash != tags["bh"] {
+		return ErrARCBodyHash
+	}
+
+	hash := hashHeaders(headers, strings.Split(tags["h"], ":"), ams, headerCanon)
+	return verifySignature(tags, hash, lookupTXT)
+}
+
+// verifyARCSeal verifies ARC-Seal of the latest set
+func verifyARCSeal(sets []*arcSet, lookupTXT func(string) ([]string, error)) error {
+	tags := parseTags(fieldValue(sets[len(sets)-1].seal))
+	return verifySignature(tags, hashSeal(sets), lookupTXT)
+}
+
+// hashSeal returns hash of the ARC sets, signed by the latest ARC-Seal
+func hashSeal(sets []*arcSet) []byte {
+	hasher := sha256.New()
+	for i, set := range sets {
+		hasher.Write([]byte(canonicalizeHeader(set.results, canonicalRelaxed)))
+		hasher.Write([]byte(canonicalizeHeader(set.message, canonicalRelaxed)))
+		if i < len(sets)-1 {
+			hasher.Write([]byte(canonicalizeHeader(set.seal, canonicalRelaxed)))
+			continue
+		}
+		seal := canonicalizeHeader(removeSignature(set.seal), canonicalRelaxed)
+		hasher.Write([]byte(strings.TrimSuffix(seal, "\r\n")))
+	}
+	return hasher.Sum(nil)
+}
+
+// hashHeaders returns hash of the signed headers and the signature header itself, as in DKIM
+func hashHeaders(headers, signed []string, signature, canon string) []byte {
+	hasher := sha256.New()
+	used := make(map[int]bool, len(signed))
+	for _, name := range signed {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || fieldName(headers[i]) != name {
+				continue
+			}
+			used[i] = true
+			hasher.Write([]byte(canonicalizeHeader(headers[i], canon)))
+			break
+		}
+	}
+	field := canonicalizeHeader(removeSignature(signature), canon)
+	hasher.Write([]byte(strings.TrimSuffix(field, "\r\n")))
+	return hasher.Sum(nil)
+}
+
+// verifySignature of the hash using public key from DNS
+func verifySignature(tags map[string]string, hash []byte, lookupTXT func(string) ([]string, error)) error {
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	txts, err := lookupTXT(tags["s"] + "._domainkey." + tags["d"])
+	if err != nil {
+		return err
+	}
+	record := parseTags(strings.Join(txts, ""))
+	key, err := base64.StdEncoding.DecodeString(record["p"])
+	if err != nil || len(key) == 0 {
+		return fmt.Errorf("arc: invalid public key of %s", tags["d"])
+	}
+
+	switch tags["a"] {
+	case algorithmRSA:
+		pub, perr := parseRSAPublicKey(key)
+		if perr != nil {
+			return perr
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash, signature)
+	case algorithmED25519:
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, hash, signature) {
+			return fmt.Errorf("arc: signature of %s did not verify", tags["d"])
+		}
+		return nil
+	default:
+		return fmt.Errorf("arc: unsupported algorithm %q", tags["a"])
+	}
+}
+
+func parseRSAPublicKey(key []byte) (*rsa.PublicKey, error) {
+	if pub, err := x509.ParsePKCS1PublicKey(key); err == nil {
+		return pub, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("arc: not a RSA public key")
+	}
+	return pub, nil
+}
+
+func signatureAlgorithm(signer crypto.Signer) string {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return algorithmED25519
+	}
+	return algorithmRSA
+}
+
+func signHash(signer crypto.Signer, hash []byte) (string, error) {
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	signature, err := signer.Sign(rand.Reader, hash, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// arcSets groups ARC headers by instance
+func arcSets(headers []string) ([]*arcSet, error) {
+	byInstance := map[int]*arcSet{}
+	for _, field := range headers {
+		name := fieldName(field)
+		if name != arcSeal && name != arcMessage && name != arcResults {
+			continue
+		}
+		value := fieldValue(field)
+		if name == arcResults {
+			// AAR is not a tag-list, but instance tag is always the first
+			value = strings.SplitN(value, ";", 2)[0]
+		}
+		instance, err := strconv.Atoi(parseTags(value)["i"])
+		if err != nil || instance < 1 || instance > arcMaxInstances {
+			return nil, ErrARCStructure
+		}
+		set, ok := byInstance[instance]
+		if !ok {
+			set = &arcSet{}
+			byInstance[instance] = set
+		}
+		var target *string
+		switch name {
+		case arcSeal:
+			target = &set.seal
+		case arcMessage:
+			target = &set.message
+		case arcResults:
+			target = &set.results
+		}
+		if *target != "" {
+			return nil, ErrARCStructure
+		}
+		*target = field
+	}
+
+	sets := make([]*arcSet, 0, len(byInstance))
+	for i := 1; i <= len(byInstance); i++ {
+		set, ok := byInstance[i]
+		if !ok || set.seal == "" || set.message == "" || set.results == "" {
+			return nil, ErrARCStructure
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// readRawHeader reads header fields as-is (including folding), each field ends with CRLF
+func readRawHeader(br *bufio.Reader) ([]string, error) {
+	headers := []string{}
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n") + "\r\n"
+			if line == "\r\n" {
+				return headers, nil
+			}
+			if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+				headers[len(headers)-1] += line
+			} else {
+				headers = append(headers, line)
+			}
+		}
+		if err == io.EOF {
+			return headers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func fieldValue(field string) string {
+	_, value, _ := strings.Cut(field, ":")
+	return value
+}
+
+// parseTags parses DKIM-like tag-list, whitespaces are removed from values
+func parseTags(value string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+	return tags
+}
+
+func parseCanonicalization(value string) (header, body string) {
+	header, body, _ = strings.Cut(value, "/")
+	if header == "" {
+		header = canonicalSimple
+	}
+	if body == "" {
+		body = canonicalSimple
+	}
+	return header, body
+}
+
+// removeSignature removes value of the b= tag from the signature header field
+func removeSignature(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	tags := strings.Split(value, ";")
+	for i, tag := range tags {
+		k, _, ok := strings.Cut(tag, "=")
+		if ok && strings.TrimSpace(k) == "b" {
+			tags[i] = tag[:strings.Index(tag, "=")+1]
+		}
+	}
+	return name + ":" + strings.Join(tags, ";")
+}
+
+func canonicalizeHeader(field, canon string) string {
+	if canon != canonicalRelaxed {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// foldValue folds long base64 value to fit into the header line length limits
+func foldValue(value string) string {
+	var folded strings.Builder
+	for len(value) > headerFoldingSize {
+		folded.WriteString(value[:headerFoldingSize])
+		folded.WriteString("\r\n ")
+		value = value[headerFoldingSize:]
+	}
+	folded.WriteString(value)
+	return folded.String()
+}
+
+// hashBody returns base64-encoded sha256 hash of the canonicalized body
+func hashBody(r io.Reader, canon string) (string, error) {
+	hasher := sha256.New()
+	w := &bodyCanonicalizer{w: hasher, relaxed: canon == canonicalRelaxed}
+	if _, err := io.Copy(w, r); err != nil {
+		return "", err
+	}
+	w.Close()
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// bodyCanonicalizer implements simple and relaxed body canonicalization of RFC 6376
+type bodyCanonicalizer struct {
+	w          io.Writer
+	relaxed    bool
+	content    bool // any non-empty line was written
+	pendingCR  bool // CR that may be a part of CRLF
+	pendingWS  bool // whitespaces of relaxed canonicalization
+	pendingEOL int  // line endings, written only if followed by non-empty line
+	buf        []byte
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	c.buf = c.buf[:0]
+	for _, ch := range p {
+		if c.pendingCR {
+			c.pendingCR = false
+			if ch == '\n' {
+				c.eol()
+				continue
+			}
+			c.char('\r')
+		}
+		switch {
+		case ch == '\r':
+			c.pendingCR = true
+		case ch == '\n':
+			c.eol()
+		case c.relaxed && (ch == ' ' || ch == '\t'):
+			c.pendingWS = true
+		default:
+			c.char(ch)
+		}
+	}
+	_, err := c.w.Write(c.buf)
+	return len(p), err
+}
+
+func (c *bodyCanonicalizer) eol() {
+	c.pendingWS = false
+	c.pendingEOL++
+}
+
+func (c *bodyCanonicalizer) char(ch byte) {
+	for ; c.pendingEOL > 0; c.pendingEOL-- {
+		c.buf = append(c.buf, '\r', '\n')
+	}
+	if c.pendingWS {
+		c.buf = append(c.buf, ' ')
+		c.pendingWS = false
+	}
+	c.buf = append(c.buf, ch)
+	c.content = true
+}
+
+// Close writes the final line ending
+func (c *bodyCanonicalizer) Close() {
+	c.buf = c.buf[:0]
+	if c.pendingCR {
+		c.char('\r')
+		c.pendingCR = false
+	}
+	if c.content || !c.relaxed {
+		c.buf = append(c.buf, '\r', '\n')
+	}
+	c.w.Write(c.buf) //nolint:errcheck // hash never fails
+}
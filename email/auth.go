@@ -0,0 +1,66 @@
+package email
+
+import (
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// AuthservID returns authserv-id of the raw Authentication-Results header field (empty if it cannot be parsed),
+// and false if the field is not Authentication-Results
+func AuthservID(field string) (string, bool) {
+	if fieldName(field) != "authentication-results" {
+		return "", false
+	}
+	authservID, _, err := authres.Parse(strings.Join(strings.Fields(fieldValue(field)), " "))
+	if err != nil {
+		return "", true
+	}
+	return authservID, true
+}
+
+// authBadge returns compact pass/fail badge of the Authentication-Results header value
+func authBadge(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, results, err := authres.Parse(header)
+	if err != nil {
+		return ""
+	}
+
+	var spf, dkim, dmarc authres.ResultValue
+	for _, result := range results {
+		switch r := result.(type) {
+		case *authres.SPFResult:
+			spf = r.Value
+		case *authres.DKIMResult:
+			// one valid signature is enough
+			if dkim != authres.ResultPass {
+				dkim = r.Value
+			}
+		case *authres.DMARCResult:
+			dmarc = r.Value
+		}
+	}
+
+	var badge strings.Builder
+	badge.WriteString("SPF ")
+	badge.WriteString(authEmoji(spf))
+	badge.WriteString(" DKIM ")
+	badge.WriteString(authEmoji(dkim))
+	badge.WriteString(" DMARC ")
+	badge.WriteString(authEmoji(dmarc))
+	return badge.String()
+}
+
+func authEmoji(value authres.ResultValue) string {
+	switch value {
+	case authres.ResultPass:
+		return "✅"
+	case authres.ResultFail, authres.ResultSoftFail, authres.ResultHardFail, authres.ResultPermError, authres.ResultPolicy:
+		return "❌"
+	default:
+		return "➖"
+	}
+}
@@ -0,0 +1,166 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"net/textproto"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// DSN actions, see RFC 3464
+const (
+	DSNFailed  = "failed"
+	DSNDelayed = "delayed"
+)
+
+// DSN is a delivery status notification (bounce), see RFC 3464
+type DSN struct {
+	// MessageID of the original email
+	MessageID  string
+	Recipients []*DSNRecipient
+}
+
+// DSNRecipient is a delivery status of the original email's recipient
+type DSNRecipient struct {
+	Recipient  string
+	Action     string
+	Status     string
+	Diagnostic string
+}
+
+// Permanent checks if delivery to the recipient failed permanently (hard bounce)
+func (r *DSNRecipient) Permanent() bool {
+	return r.Action == DSNFailed && strings.HasPrefix(r.Status, "5")
+}
+
+// Failed returns recipients with failed delivery
+func (d *DSN) Failed() []*DSNRecipient {
+	failed := []*DSNRecipient{}
+	for _, rcpt := range d.Recipients {
+		if rcpt.Action == DSNFailed {
+			failed = append(failed, rcpt)
+		}
+	}
+	return failed
+}
+
+// parseDSN parses multipart/report delivery status notification, returns nil if the email is not a DSN
+func parseDSN(envelope *enmime.Envelope) *DSN {
+	if envelope.Root == nil {
+		return nil
+	}
+	status := envelope.Root.DepthMatchFirst(func(p *enmime.Part) bool {
+		return p.ContentType == "message/delivery-status" || p.ContentType == "message/global-delivery-status"
+	})
+	if status == nil {
+		return nil
+	}
+
+	dsn := &DSN{Recipients: parseDSNRecipients(status.Content)}
+	if len(dsn.Recipients) == 0 {
+		return nil
+	}
+	original := envelope.Root.DepthMatchFirst(func(p *enmime.Part) bool {
+		switch p.ContentType {
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			return true
+		default:
+			return false
+		}
+	})
+	if original != nil {
+		header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(original.Content))).ReadMIMEHeader() //nolint:errcheck // partial header is fine
+		dsn.MessageID = strings.TrimSpace(header.Get("Message-Id"))
+	}
+	return dsn
+}
+
+// parseDSNRecipients parses per-recipient fields of the delivery status, per-message fields are skipped
+func parseDSNRecipients(content []byte) []*DSNRecipient {
+	recipients := []*DSNRecipient{}
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		recipient := dsnValue(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = dsnValue(fields.Get("Original-Recipient"))
+		}
+		if recipient != "" {
+			var status string
+			if parts := strings.Fields(fields.Get("Status")); len(parts) > 0 {
+				status = parts[0]
+			}
+			recipients = append(recipients, &DSNRecipient{
+				Recipient:  Address(recipient),
+				Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+				Status:     status,
+				Diagnostic: dsnValue(fields.Get("Diagnostic-Code")),
+			})
+		}
+		if err != nil {
+			return recipients
+		}
+	}
+}
+
+// dsnValue returns value of the typed DSN field, e.g. "rfc822; user@example.com" -> "user@example.com"
+func dsnValue(field string) string {
+	if _, value, ok := strings.Cut(field, ";"); ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(field)
+}
+
+// NewBounce composes delivery status notification (RFC 3464) about permanent delivery failure of the original email,
+// sent by the domain's mail system to the original sender, DKIM-signed with the domain key
+func NewBounce(domain, privkey, sender, rcpt, status, diagnostic, original string) string {
+	fields, _ := splitRaw(toCRLF(original))
+	var originalID string
+	for _, field := range fields {
+		if name, value, _ := strings.Cut(field, ":"); strings.EqualFold(strings.TrimSpace(name), "message-id") {
+			originalID = strings.TrimSpace(value)
+		}
+	}
+	diagnostic = strings.Join(strings.Fields(diagnostic), " ")
+	boundary := strings.Trim(RandomMessageID(domain), "<>")
+
+	var data strings.Builder
+	data.WriteString("From: Mail Delivery System <MAILER-DAEMON@" + domain + ">\r\n")
+	data.WriteString("To: " + sender + "\r\n")
+	data.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	data.WriteString("Date: " + dateNow() + "\r\n")
+	data.WriteString("Message-Id: " + RandomMessageID(domain) + "\r\n")
+	if originalID != "" {
+		data.WriteString("In-Reply-To: " + originalID + "\r\n")
+		data.WriteString("References: " + originalID + "\r\n")
+	}
+	data.WriteString("Auto-Submitted: auto-replied\r\n")
+	data.WriteString("MIME-Version: 1.0\r\n")
+	data.WriteString("Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + boundary + "\"\r\n\r\n")
+
+	data.WriteString("--" + boundary + "\r\n")
+	data.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	data.WriteString("Your message to " + rcpt + " could not be delivered.\r\n")
+	if diagnostic != "" {
+		data.WriteString("The last error was: " + diagnostic + "\r\n")
+	}
+
+	data.WriteString("--" + boundary + "\r\n")
+	data.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	data.WriteString("Reporting-MTA: dns; " + domain + "\r\n\r\n")
+	data.WriteString("Final-Recipient: rfc822; " + rcpt + "\r\n")
+	data.WriteString("Action: " + DSNFailed + "\r\n")
+	data.WriteString("Status: " + status + "\r\n")
+	if diagnostic != "" {
+		data.WriteString("Diagnostic-Code: smtp; " + diagnostic + "\r\n")
+	}
+
+	data.WriteString("--" + boundary + "\r\n")
+	data.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	data.WriteString(strings.Join(fields, ""))
+	data.WriteString("--" + boundary + "--\r\n")
+
+	return sign(domain, privkey, data.String())
+}
@@ -0,0 +1,82 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+func TestParseDSN(t *testing.T) {
+	raw := "From: MAILER-DAEMON@mx.example.org\r\nTo: test@example.com\r\nSubject: Undelivered Mail Returned to Sender\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nThe mail system: user unknown\r\n" +
+		"--b\r\nContent-Type: message/delivery-status\r\n\r\n" +
+		"Reporting-MTA: dns; mx.example.org\r\n\r\n" +
+		"Final-Recipient: rfc822; nobody@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 <nobody@example.org>:\r\n Recipient address rejected\r\n\r\n" +
+		"Final-Recipient: rfc822; slow@example.org\r\nAction: delayed\r\nStatus: 4.4.1\r\n\r\n" +
+		"--b\r\nContent-Type: text/rfc822-headers\r\n\r\n" +
+		"From: test@example.com\r\nMessage-Id: <$event@example.com>\r\nSubject: hello\r\n" +
+		"--b--\r\n"
+	envelope, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsn := parseDSN(envelope)
+	if dsn == nil {
+		t.Fatal("DSN is not parsed")
+	}
+	if dsn.MessageID != "<$event@example.com>" {
+		t.Errorf("unexpected Message-Id: %q", dsn.MessageID)
+	}
+	if len(dsn.Recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(dsn.Recipients))
+	}
+	failed := dsn.Failed()
+	if len(failed) != 1 || failed[0].Recipient != "nobody@example.org" || !failed[0].Permanent() {
+		t.Errorf("unexpected failed recipients: %+v", failed)
+	}
+	if failed[0].Diagnostic != "550 5.1.1 <nobody@example.org>: Recipient address rejected" {
+		t.Errorf("unexpected diagnostic: %q", failed[0].Diagnostic)
+	}
+	if dsn.Recipients[1].Action != DSNDelayed || dsn.Recipients[1].Permanent() {
+		t.Errorf("unexpected delayed recipient: %+v", dsn.Recipients[1])
+	}
+
+	plain, err := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nSubject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parseDSN(plain) != nil {
+		t.Error("regular email is parsed as DSN")
+	}
+}
+
+func TestNewBounce(t *testing.T) {
+	original := "From: app@example.com\r\nTo: user@example.org\r\nMessage-Id: <1@example.com>\r\nSubject: hello\r\n\r\nsecret body\r\n"
+	data := NewBounce("example.com", "", "app@example.com", "user@example.org", "4.4.7", "mx.example.org: 451 4.7.1\ngreylisted", original)
+	if strings.Contains(data, "secret body") {
+		t.Error("bounce contains body of the original email")
+	}
+
+	envelope, err := enmime.ReadEnvelope(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.GetHeader("To") != "app@example.com" || envelope.GetHeader("In-Reply-To") != "<1@example.com>" {
+		t.Errorf("unexpected headers: To=%q, In-Reply-To=%q", envelope.GetHeader("To"), envelope.GetHeader("In-Reply-To"))
+	}
+	dsn := parseDSN(envelope)
+	if dsn == nil {
+		t.Fatal("bounce is not parsed as DSN")
+	}
+	if dsn.MessageID != "<1@example.com>" || len(dsn.Failed()) != 1 {
+		t.Fatalf("unexpected DSN: %+v", dsn)
+	}
+	rcpt := dsn.Failed()[0]
+	if rcpt.Recipient != "user@example.org" || rcpt.Status != "4.4.7" || rcpt.Diagnostic != "mx.example.org: 451 4.7.1 greylisted" {
+		t.Errorf("unexpected recipient: %+v", rcpt)
+	}
+}
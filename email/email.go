@@ -4,6 +4,8 @@ import (
 	"crypto"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"net/textproto"
 	"strings"
 
 	"github.com/emersion/go-msgauth/dkim"
@@ -16,6 +18,33 @@ import (
 	"gitlab.com/etke.cc/postmoogle/utils"
 )
 
+// reservedPrefix is a prefix of postmoogle's trace headers, such headers are removed from incoming emails
+const reservedPrefix = "x-postmoogle-"
+
+// Reserved checks if the raw header field of an incoming email is reserved for postmoogle's trace headers
+func Reserved(field string) bool {
+	return strings.HasPrefix(fieldName(field), reservedPrefix)
+}
+
+// QuarantineHeader is a trace header added to the emails that should be quarantined
+const QuarantineHeader = "X-Postmoogle-Quarantine"
+
+// QuarantineValue returns value of the QuarantineHeader for the specific recipient
+func QuarantineValue(rcptto, reason string) string {
+	return rcptto + "; " + reason
+}
+
+// quarantine returns reason of the quarantine for the specific recipient
+func quarantine(rcptto string, values []string) string {
+	for _, value := range values {
+		to, reason, ok := strings.Cut(value, ";")
+		if ok && strings.EqualFold(strings.TrimSpace(to), rcptto) {
+			return strings.TrimSpace(reason)
+		}
+	}
+	return ""
+}
+
 // Email object
 type Email struct {
 	Date        string
@@ -25,12 +54,23 @@ type Email struct {
 	From        string
 	To          string
 	RcptTo      string
+	MailFrom    string // envelope sender of incoming emails, empty for bounces
 	CC          []string
+	BCC         []string // never composed into headers, used in notices of sent emails only
 	Subject     string
 	Text        string
 	HTML        string
 	Files       []*utils.File
 	InlineFiles []*utils.File
+	Quarantine  string
+	Auth        string
+	Labels      []string
+	Scan        *ScanResult
+	DSN         *DSN
+	Headers     map[string][]string
+	Size        int64
+	// AutoSubmitted header value of the composed automatic emails, see RFC 3834
+	AutoSubmitted string
 }
 
 // New constructs Email object
@@ -81,7 +121,13 @@ func FromEnvelope(rcptto string, envelope *enmime.Envelope) *Email {
 		inlines = append(inlines, file)
 	}
 
+	headers := make(map[string][]string, len(envelope.GetHeaderKeys()))
+	for _, key := range envelope.GetHeaderKeys() {
+		headers[textproto.CanonicalMIMEHeaderKey(key)] = envelope.GetHeaderValues(key)
+	}
+
 	email := &Email{
+		Headers:     headers,
 		Date:        date,
 		MessageID:   envelope.GetHeader("Message-Id"),
 		InReplyTo:   envelope.GetHeader("In-Reply-To"),
@@ -95,11 +141,35 @@ func FromEnvelope(rcptto string, envelope *enmime.Envelope) *Email {
 		HTML:        html,
 		Files:       files,
 		InlineFiles: inlines,
+		Quarantine:  quarantine(rcptto, envelope.GetHeaderValues(QuarantineHeader)),
+		Auth:        envelope.GetHeader("Authentication-Results"),
+		Scan:        parseScanResult(envelope.GetHeader(ScanHeader)),
+		DSN:         parseDSN(envelope),
 	}
 
 	return email
 }
 
+// Automatic checks if the incoming email is sent automatically (bounce, autoreply, mailing list, etc.),
+// so it should never get automatic responses
+func (e *Email) Automatic() bool {
+	if e.DSN != nil {
+		return true
+	}
+	for _, value := range e.Headers["Auto-Submitted"] {
+		if !strings.EqualFold(strings.TrimSpace(value), "no") {
+			return true
+		}
+	}
+	for _, value := range e.Headers["Precedence"] {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "bulk", "list", "junk":
+			return true
+		}
+	}
+	return false
+}
+
 // Mailbox returns postmoogle's mailbox, parsing it from FROM (if incoming=false) or TO (incoming=true)
 func (e *Email) Mailbox(incoming bool) string {
 	if incoming {
@@ -109,26 +179,52 @@ func (e *Email) Mailbox(incoming bool) string {
 }
 
 func (e *Email) contentHeader(threadID id.EventID, text *strings.Builder, options *ContentOptions) {
+	if e.Quarantine != "" {
+		text.WriteString("⚠️ quarantined by the ")
+		text.WriteString(e.Quarantine)
+		text.WriteString("\n\n")
+	}
+	if len(e.Labels) > 0 {
+		text.WriteString("🏷️ ")
+		text.WriteString(strings.Join(e.Labels, ", "))
+		text.WriteString("\n\n")
+	}
 	if options.Sender {
 		text.WriteString(e.From)
 	}
-	if options.Recipient {
-		mailbox, sub, host := utils.EmailParts(e.To)
+	if options.Recipient && e.To != "" { // empty for Bcc-only emails
 		text.WriteString(" ➡️ ")
-		text.WriteString(mailbox)
-		text.WriteString("@")
-		text.WriteString(host)
-		if sub != "" {
-			text.WriteString(" (")
-			text.WriteString(sub)
-			text.WriteString(")")
+		for i, to := range strings.Split(e.To, ",") {
+			if i > 0 {
+				text.WriteString(", ")
+			}
+			mailbox, sub, host := utils.EmailParts(to)
+			text.WriteString(mailbox)
+			text.WriteString("@")
+			text.WriteString(host)
+			if sub != "" {
+				text.WriteString(" (")
+				text.WriteString(sub)
+				text.WriteString(")")
+			}
 		}
 	}
 	if options.CC && len(e.CC) > 0 {
 		text.WriteString("\ncc: ")
 		text.WriteString(strings.Join(e.CC, ", "))
 	}
-	if options.Sender || options.Recipient || options.CC {
+	if options.CC && len(e.BCC) > 0 {
+		text.WriteString("\nbcc: ")
+		text.WriteString(strings.Join(e.BCC, ", "))
+	}
+	badge := strings.TrimSpace(authBadge(e.Auth) + " " + e.Scan.badge())
+	if badge != "" {
+		if options.Sender || options.Recipient || options.CC {
+			text.WriteString("\n")
+		}
+		text.WriteString(badge)
+	}
+	if options.Sender || options.Recipient || options.CC || badge != "" {
 		text.WriteString("\n\n")
 	}
 	if options.Subject && threadID == "" {
@@ -177,9 +273,16 @@ func (e *Email) Content(threadID id.EventID, options *ContentOptions) *event.Con
 			options.FromKey:       e.From,
 			options.ToKey:         e.To,
 			options.CcKey:         cc,
+			options.AuthKey:       e.Auth,
 		},
 		Parsed: &parsed,
 	}
+	if len(e.BCC) > 0 {
+		content.Raw[options.BccKey] = strings.Join(e.BCC, ", ")
+	}
+	if e.Scan != nil {
+		content.Raw[options.ScanKey] = e.Scan.raw()
+	}
 	return &content
 }
 
@@ -215,9 +318,14 @@ func (e *Email) Compose(privkey string) string {
 
 	mail := enmime.Builder().
 		From("", e.From).
-		To("", e.To).
 		Header("Message-Id", e.MessageID).
 		Subject(e.Subject)
+	for _, addr := range strings.Split(e.To, ",") {
+		mail = mail.To("", strings.TrimSpace(addr))
+	}
+	for _, addr := range e.BCC {
+		mail = mail.BCC("", addr) // envelope only, allows emails without To and Cc
+	}
 	if textSize > 0 {
 		mail = mail.Text([]byte(e.Text))
 	}
@@ -230,6 +338,9 @@ func (e *Email) Compose(privkey string) string {
 	if e.References != "" {
 		mail = mail.Header("References", e.References)
 	}
+	if e.AutoSubmitted != "" {
+		mail = mail.Header("Auto-Submitted", e.AutoSubmitted)
+	}
 	if len(e.CC) > 0 {
 		for _, addr := range e.CC {
 			mail = mail.CC("", addr)
@@ -247,37 +358,47 @@ func (e *Email) Compose(privkey string) string {
 	}
 
 	domain := strings.SplitN(e.From, "@", 2)[1]
-	return e.sign(domain, privkey, data)
+	return sign(domain, privkey, data.String())
 }
 
-func (e *Email) sign(domain, privkey string, data strings.Builder) string {
-	if privkey == "" {
-		return data.String()
-	}
-	pemblock, _ := pem.Decode([]byte(privkey))
-	if pemblock == nil {
-		return data.String()
-	}
-	parsedkey, err := x509.ParsePKCS8PrivateKey(pemblock.Bytes)
+// sign raw email with DKIM, returns the email as is if it cannot be signed
+func sign(domain, privkey, data string) string {
+	signer, err := parsePrivateKey(privkey)
 	if err != nil {
-		return data.String()
-	}
-	signer, ok := parsedkey.(crypto.Signer)
-	if !ok {
-		return data.String()
+		return data
 	}
 
 	options := &dkim.SignOptions{
 		Domain:   domain,
-		Selector: "postmoogle",
+		Selector: dkimSelector,
 		Signer:   signer,
 	}
 
 	var msg strings.Builder
-	err = dkim.Sign(&msg, strings.NewReader(data.String()), options)
+	err = dkim.Sign(&msg, strings.NewReader(data), options)
 	if err != nil {
-		return data.String()
+		return data
 	}
 
 	return msg.String()
 }
+
+// parsePrivateKey parses PEM-encoded PKCS8 DKIM private key
+func parsePrivateKey(privkey string) (crypto.Signer, error) {
+	if privkey == "" {
+		return nil, errors.New("private key is not set")
+	}
+	pemblock, _ := pem.Decode([]byte(privkey))
+	if pemblock == nil {
+		return nil, errors.New("private key is not PEM-encoded")
+	}
+	parsedkey, err := x509.ParsePKCS8PrivateKey(pemblock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsedkey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	return signer, nil
+}
@@ -6,7 +6,9 @@ type IncomingFilteringOptions interface {
 	SpamcheckSMTP() bool
 	SpamcheckSPF() bool
 	SpamcheckMX() bool
+	SpamcheckDMARC() bool
 	Spamlist() []string
+	BayesReject() bool
 }
 
 // ContentOptions represents settings that specify how an email is to be converted to a Matrix message
@@ -28,5 +30,8 @@ type ContentOptions struct {
 	FromKey       string
 	ToKey         string
 	CcKey         string
+	BccKey        string
 	RcptToKey     string
+	AuthKey       string
+	ScanKey       string
 }
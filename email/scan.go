@@ -0,0 +1,81 @@
+package email
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ScanHeader is a trace header with the result of the external spam scanner
+const ScanHeader = "X-Postmoogle-Scan"
+
+// spam scanner actions, the same as rspamd uses
+const (
+	ScanNoAction       = "no action"
+	ScanGreylist       = "greylist"
+	ScanAddHeader      = "add header"
+	ScanRewriteSubject = "rewrite subject"
+	ScanSoftReject     = "soft reject"
+	ScanReject         = "reject"
+)
+
+// ScanResult of the external spam scanner
+type ScanResult struct {
+	Score   float64
+	Action  string
+	Symbols []string
+}
+
+// Spam returns true if the scanner suggests to mark the email as spam
+func (r *ScanResult) Spam() bool {
+	if r == nil {
+		return false
+	}
+	return r.Action == ScanAddHeader || r.Action == ScanRewriteSubject || r.Action == ScanReject
+}
+
+// String returns ScanHeader value
+func (r *ScanResult) String() string {
+	return "score=" + strconv.FormatFloat(r.Score, 'f', 2, 64) + "; action=" + r.Action + "; symbols=" + strings.Join(r.Symbols, ",")
+}
+
+// raw returns result as matrix event field
+func (r *ScanResult) raw() map[string]any {
+	return map[string]any{
+		"score":   r.Score,
+		"action":  r.Action,
+		"symbols": r.Symbols,
+	}
+}
+
+func (r *ScanResult) badge() string {
+	if r == nil {
+		return ""
+	}
+	return "spam score " + strconv.FormatFloat(r.Score, 'f', 2, 64)
+}
+
+// parseScanResult parses ScanHeader value
+func parseScanResult(value string) *ScanResult {
+	if value == "" {
+		return nil
+	}
+	result := &ScanResult{}
+	for _, part := range strings.Split(value, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "score":
+			score, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil
+			}
+			result.Score = score
+		case "action":
+			result.Action = val
+		case "symbols":
+			if val != "" {
+				result.Symbols = strings.Split(val, ",")
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,371 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+const (
+	// maxInMemorySize is the max size of email that can be parsed in memory when streaming parser fails
+	maxInMemorySize = 10 << 20
+	// maxSkeletonSize is the max total size of text and message parts kept in memory,
+	// parts that don't fit are saved as attachments
+	maxSkeletonSize = 2 << 20
+)
+
+// FromSpool constructs Email object from the spooled raw email.
+// Attachments are streamed into separate files inside the dir and never loaded into memory,
+// so call Email.Cleanup() when the email is not needed anymore
+func FromSpool(rcptto string, r io.ReadSeeker, dir string) (*Email, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var skeleton bytes.Buffer
+	ex := &extractor{dir: dir, budget: maxSkeletonSize}
+	if err := ex.extract(r, &skeleton); err != nil {
+		// the message structure is too weird to be streamed, fallback to the in-memory parsing of small emails only
+		ex.cleanup()
+		if size > maxInMemorySize {
+			return nil, err
+		}
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		envelope, eerr := enmime.ReadEnvelope(r)
+		if eerr != nil {
+			return nil, eerr
+		}
+		eml := FromEnvelope(rcptto, envelope)
+		eml.Size = size
+		return eml, nil
+	}
+
+	envelope, err := enmime.ReadEnvelope(&skeleton)
+	if err != nil {
+		ex.cleanup()
+		return nil, err
+	}
+	eml := FromEnvelope(rcptto, envelope)
+	eml.Files = append(eml.Files, ex.files...)
+	eml.InlineFiles = append(eml.InlineFiles, ex.inlines...)
+	eml.Size = size
+
+	return eml, nil
+}
+
+// Cleanup removes attachments stored on disk
+func (e *Email) Cleanup() {
+	for _, file := range e.Files {
+		file.Remove()
+	}
+	for _, file := range e.InlineFiles {
+		file.Remove()
+	}
+}
+
+// extractor copies email into a "skeleton" without attachments,
+// while attachments (and text parts that exceed the budget) are decoded and stored in separate files
+type extractor struct {
+	dir     string
+	budget  int64 // remaining size of the parts that can be kept in the skeleton
+	files   []*utils.File
+	inlines []*utils.File
+}
+
+func (ex *extractor) extract(r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	fields, separator, err := ReadHeader(reader)
+	if err != nil {
+		return err
+	}
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.Join(fields, "") + "\r\n"))).ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+
+	mtype, params, _ := mime.ParseMediaType(header.Get("Content-Type")) //nolint:errcheck // empty type is fine
+	if strings.HasPrefix(mtype, "multipart/") {
+		writeHeader(w, fields, separator)
+		return ex.walk(reader, params["boundary"], w)
+	}
+
+	inline, binary := isBinaryRoot(header)
+	if !binary {
+		data, ok, err := ex.keep(header, reader)
+		if err != nil {
+			return err
+		}
+		if ok {
+			writeHeader(w, fields, separator)
+			_, err = w.Write(data)
+			return err
+		}
+	} else if err := ex.save(filename(header), header, reader, inline); err != nil {
+		return err
+	}
+	// the whole body is an attachment, so skeleton contains the headers only
+	fields = dropFields(fields, "content-type", "content-transfer-encoding", "content-disposition")
+	fields = append(fields, "Content-Type: text/plain; charset=utf-8\r\n")
+	writeHeader(w, fields, separator)
+	return nil
+}
+
+func (ex *extractor) walk(r io.Reader, boundary string, w io.Writer) error {
+	mr := multipart.NewReader(r, boundary)
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if inline, ok := isAttachment(part.Header); ok {
+			if err := ex.save(filename(part.Header), part.Header, part, inline); err != nil {
+				return err
+			}
+			continue
+		}
+
+		mtype, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type")) //nolint:errcheck // empty type is fine
+		if strings.HasPrefix(mtype, "multipart/") {
+			pw, err := mw.CreatePart(part.Header)
+			if err != nil {
+				return err
+			}
+			if err := ex.walk(part, params["boundary"], pw); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, ok, err := ex.keep(part.Header, part)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		pw, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		if _, err := pw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// keep reads the part's body, if it fits into the remaining budget of the skeleton,
+// otherwise the part is saved as an attachment and false is returned
+func (ex *extractor) keep(header textproto.MIMEHeader, body io.Reader) ([]byte, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(body, ex.budget+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) <= ex.budget {
+		ex.budget -= int64(len(data))
+		return data, true, nil
+	}
+
+	return nil, false, ex.save(textFilename(header), header, io.MultiReader(bytes.NewReader(data), body), false)
+}
+
+func (ex *extractor) save(name string, header textproto.MIMEHeader, body io.Reader, inline bool) error {
+	fh, err := os.CreateTemp(ex.dir, "postmoogle-*.part")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(fh, decodeBody(header.Get("Content-Transfer-Encoding"), body))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.Name()) //nolint:errcheck // nothing can be done here
+		return err
+	}
+
+	file := utils.NewFileFromPath(name, fh.Name(), int(size))
+	if inline {
+		ex.inlines = append(ex.inlines, file)
+	} else {
+		ex.files = append(ex.files, file)
+	}
+	return nil
+}
+
+func (ex *extractor) cleanup() {
+	for _, file := range ex.files {
+		file.Remove()
+	}
+	for _, file := range ex.inlines {
+		file.Remove()
+	}
+	ex.files = nil
+	ex.inlines = nil
+}
+
+// isAttachment checks if the multipart's part is an attachment (or an inline attachment),
+// the logic is the same as enmime uses
+func isAttachment(header textproto.MIMEHeader) (inline, ok bool) {
+	mtype, _, _ := mime.ParseMediaType(header.Get("Content-Type"))              //nolint:errcheck // empty type is fine
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")) //nolint:errcheck // empty disposition is fine
+	if strings.HasPrefix(mtype, "multipart/") {
+		return false, false
+	}
+	if disposition == "attachment" || mtype == "application/octet-stream" {
+		return false, true
+	}
+	if disposition == "inline" && !isText(mtype) && !strings.HasPrefix(mtype, "message/") {
+		return true, true
+	}
+
+	return false, false
+}
+
+// isBinaryRoot checks if the single-part email body is an attachment, the logic is the same as enmime uses
+func isBinaryRoot(header textproto.MIMEHeader) (inline, ok bool) {
+	ctype := header.Get("Content-Type")
+	mtype, _, _ := mime.ParseMediaType(ctype)                                   //nolint:errcheck // empty type is fine
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")) //nolint:errcheck // empty disposition is fine
+	if ctype == "" || isText(mtype) || strings.HasPrefix(mtype, "message/") {
+		return false, disposition == "attachment"
+	}
+
+	return disposition == "inline", true
+}
+
+func isText(mtype string) bool {
+	return mtype == "text/plain" || mtype == "text/html"
+}
+
+func filename(header textproto.MIMEHeader) string {
+	_, params, _ := mime.ParseMediaType(header.Get("Content-Disposition")) //nolint:errcheck // empty disposition is fine
+	name := params["filename"]
+	if name == "" {
+		_, params, _ = mime.ParseMediaType(header.Get("Content-Type")) //nolint:errcheck // empty type is fine
+		name = params["name"]
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(name)
+	if err != nil {
+		return name
+	}
+	return decoded
+}
+
+// textFilename returns filename of the text part saved as a file
+func textFilename(header textproto.MIMEHeader) string {
+	if name := filename(header); name != "" {
+		return name
+	}
+	mtype, _, _ := mime.ParseMediaType(header.Get("Content-Type")) //nolint:errcheck // empty type is fine
+	switch {
+	case mtype == "text/html":
+		return "part.html"
+	case strings.HasPrefix(mtype, "message/"):
+		return "part.eml"
+	default:
+		return "part.txt"
+	}
+}
+
+func decodeBody(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// ReadHeader reads raw header fields (with folded lines and line endings) and the separator line of the email
+func ReadHeader(reader *bufio.Reader) (fields []string, separator string, err error) {
+	for {
+		line, rerr := reader.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return nil, "", rerr
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return fields, line, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+		if rerr == io.EOF {
+			fields[len(fields)-1] += "\r\n"
+			return fields, "\r\n", nil
+		}
+	}
+}
+
+// dropFields removes raw header fields with the (lowercase) names
+func dropFields(fields []string, names ...string) []string {
+	kept := make([]string, 0, len(fields))
+	for _, field := range fields {
+		name := fieldName(field)
+		var drop bool
+		for _, dropName := range names {
+			if name == dropName {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// writeHeader writes raw header fields in the original order into the writer
+func writeHeader(w io.Writer, fields []string, separator string) {
+	io.WriteString(w, strings.Join(fields, "")+separator) //nolint:errcheck // any write error will pop up on the next write
+}
+
+// base64Cleaner removes whitespaces from the base64-encoded data
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		p[j] = p[i]
+		j++
+	}
+	return j, err
+}
@@ -0,0 +1,33 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromSpoolLargeText(t *testing.T) {
+	html := "<p>" + strings.Repeat("a", maxSkeletonSize) + "</p>"
+	raw := "From: sender@example.com\r\n" +
+		"To: rcpt@example.org\r\n" +
+		"Subject: large\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" + html + "\r\n" +
+		"--b--\r\n"
+
+	eml, err := FromSpool("rcpt@example.org", strings.NewReader(raw), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eml.Cleanup()
+
+	if strings.TrimSpace(eml.Text) != "hello" {
+		t.Errorf("unexpected text %q", eml.Text)
+	}
+	if eml.HTML != "" {
+		t.Errorf("large HTML part is kept in memory (%d bytes)", len(eml.HTML))
+	}
+	if len(eml.Files) != 1 || eml.Files[0].Name != "part.html" || eml.Files[0].Length != len(html) {
+		t.Fatalf("large HTML part is not saved as a file: %+v", eml.Files)
+	}
+}
@@ -0,0 +1,84 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// PrepareSubmission prepares raw email, submitted by an SMTP client, for relaying.
+// The MIME structure is kept intact: only missing Date, Message-Id and From headers are added,
+// Bcc header is removed and the email is DKIM-signed with the sender's domain key
+func PrepareSubmission(raw []byte, from, privkey string) string {
+	fields, body := splitRaw(toCRLF(string(raw)))
+	domain := utils.Hostname(from)
+
+	var hasDate, hasMessageID, hasFrom bool
+	header := make([]string, 0, len(fields)+3)
+	for _, field := range fields {
+		name, _, _ := strings.Cut(field, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "bcc":
+			continue
+		case "date":
+			hasDate = true
+		case "message-id":
+			hasMessageID = true
+		case "from":
+			hasFrom = true
+		}
+		header = append(header, field)
+	}
+	if !hasFrom {
+		header = append(header, "From: "+from+"\r\n")
+	}
+	if !hasDate {
+		header = append(header, "Date: "+dateNow()+"\r\n")
+	}
+	if !hasMessageID {
+		header = append(header, "Message-Id: "+RandomMessageID(domain)+"\r\n")
+	}
+
+	return sign(domain, privkey, strings.Join(header, "")+body)
+}
+
+// RandomMessageID generates random Message-Id, used when there is no matrix event ID
+func RandomMessageID(domain string) string {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck // crypto/rand never fails
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// toCRLF converts line endings to CRLF
+func toCRLF(raw string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// splitRaw splits raw email with CRLF line endings into header fields (with folded lines)
+// and body (including the empty line separating it from the header)
+func splitRaw(raw string) (fields []string, body string) {
+	header := raw
+	body = "\r\n"
+	if strings.HasPrefix(raw, "\r\n") {
+		return nil, raw
+	}
+	if idx := strings.Index(raw, "\r\n\r\n"); idx >= 0 {
+		header, body = raw[:idx+2], raw[idx+2:]
+	} else if !strings.HasSuffix(header, "\r\n") {
+		header += "\r\n"
+	}
+
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields, body
+}
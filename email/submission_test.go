@@ -0,0 +1,39 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrepareSubmission(t *testing.T) {
+	raw := "From: app@example.com\nTo: user@example.org\nBcc: hidden@example.org\nReply-To: support@example.com\n" +
+		"List-Unsubscribe: <mailto:unsubscribe@example.com>,\n <https://example.com/unsubscribe>\n" +
+		"Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nhello\n--b\n" +
+		"Content-Type: application/pdf\nContent-Disposition: attachment; filename=a.pdf\n\nJVBERi0=\n--b--\n"
+
+	data := PrepareSubmission([]byte(raw), "app@example.com", "")
+	header, body, ok := strings.Cut(data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header separator in %q", data)
+	}
+	if strings.Contains(header, "Bcc:") || strings.Contains(header, "hidden@example.org") {
+		t.Error("Bcc header is not removed")
+	}
+	for _, expected := range []string{
+		"Reply-To: support@example.com\r\n",
+		"List-Unsubscribe: <mailto:unsubscribe@example.com>,\r\n <https://example.com/unsubscribe>\r\n",
+		"Content-Type: multipart/mixed; boundary=b\r\n",
+		"\r\nDate: ",
+		"\r\nMessage-Id: <",
+	} {
+		if !strings.Contains(header, expected) {
+			t.Errorf("header %q doesn't contain %q", header, expected)
+		}
+	}
+	if strings.Count(header, "From:") != 1 {
+		t.Errorf("unexpected From headers in %q", header)
+	}
+	if expected := strings.ReplaceAll(strings.SplitN(raw, "\n\n", 2)[1], "\n", "\r\n"); body != expected {
+		t.Errorf("body is changed: expected %q, got %q", expected, body)
+	}
+}
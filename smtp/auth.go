@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// authResults of the incoming email checks
+type authResults struct {
+	mailFrom string
+	helo     string
+
+	SPF      spf.Result
+	DKIM     []*dkim.Verification
+	DKIMErr  error
+	DMARC    *dmarcResult
+	DMARCErr error
+	ARC      *email.ARCResult
+}
+
+// checkAuth performs SPF, DKIM, DMARC and ARC checks of the incoming email, regardless of the room's settings
+func checkAuth(ctx context.Context, resolver Resolver, spool *spoolFile, headerFrom, mailFrom, helo string, ip net.IP) *authResults {
+	lookupTXT := func(domain string) ([]string, error) {
+		return resolver.LookupTXT(ctx, domain)
+	}
+	results := &authResults{mailFrom: mailFrom, helo: helo}
+	results.SPF, _ = spf.CheckHostWithSender(ip, helo, spfSender(mailFrom, helo), spf.WithResolver(resolver), spf.WithContext(ctx)) //nolint:errcheck // result is enough
+	results.DKIM, results.DKIMErr = dkim.VerifyWithOptions(spool.Reader(), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	results.ARC = email.VerifyARC(spool.Reader(), lookupTXT)
+	results.DMARC, results.DMARCErr = checkDMARC(ctx, resolver, headerFrom, mailFrom, helo, results.SPF, results.DKIM)
+
+	return results
+}
+
+// Header returns value of the Authentication-Results header (RFC 8601)
+func (a *authResults) Header(authservID string) string {
+	results := []authres.Result{
+		&authres.SPFResult{Value: authres.ResultValue(a.SPF), From: a.mailFrom, Helo: a.helo},
+	}
+
+	switch {
+	case a.DKIMErr != nil:
+		results = append(results, &authres.DKIMResult{Value: authres.ResultPermError, Reason: a.DKIMErr.Error()})
+	case len(a.DKIM) == 0:
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	for _, verification := range a.DKIM {
+		result := &authres.DKIMResult{Value: authres.ResultPass, Domain: verification.Domain, Identifier: verification.Identifier}
+		if verification.Err != nil {
+			result.Value = authres.ResultFail
+			if dkim.IsTempFail(verification.Err) {
+				result.Value = authres.ResultTempError
+			}
+			result.Reason = verification.Err.Error()
+		}
+		results = append(results, result)
+	}
+
+	if a.DMARCErr != nil {
+		results = append(results, &authres.DMARCResult{Value: authres.ResultTempError, Reason: a.DMARCErr.Error()})
+	} else {
+		results = append(results, &authres.DMARCResult{Value: a.DMARC.Value, From: a.DMARC.Domain})
+	}
+
+	results = append(results, a.ARC.AuthResult())
+
+	return authres.Format(authservID, results)
+}
+
+// TrustedARC returns true if the ARC chain is valid and sealed by one of the trusted domains
+func (a *authResults) TrustedARC(trusted []string) bool {
+	if a.ARC.Value != authres.ResultPass {
+		return false
+	}
+	sealer := strings.ToLower(a.ARC.Domain)
+	for _, domain := range trusted {
+		domain = strings.ToLower(domain)
+		if sealer == domain || strings.HasSuffix(sealer, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,112 +1,317 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
-	"io"
+	"errors"
+	"fmt"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
-	"gitlab.com/etke.cc/go/trysmtp"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
 )
 
+// mxPort is the port of MX servers
+const mxPort = "25"
+
+// dialTimeout is a timeout of a connection to the SMTP server
+const dialTimeout = 30 * time.Second
+
+// ErrNullMX returned when the recipient's domain doesn't accept emails, see RFC 7505
+var ErrNullMX = errors.New("domain does not accept emails (null MX)")
+
 type MailSender interface {
-	Send(from, to, data string) error
+	Send(from string, tos []string, data string) []error
 }
 
 // SMTP client
 type Client struct {
-	config *RelayConfig
-	log    *zerolog.Logger
+	hostname   string
+	transports []*Transport
+	resolver   Resolver
+	log        *zerolog.Logger
+}
+
+// batch of recipients, delivered using one connection with several RCPTs and a single DATA
+type batch struct {
+	domain string         // recipients' domain, used for direct delivery
+	relays []*RelayConfig // empty = direct delivery
+	idxs   []int
 }
 
-func newClient(cfg *RelayConfig, log *zerolog.Logger) *Client {
+func newClient(hostname string, cfg *RelayConfig, transports []*Transport, resolver Resolver, log *zerolog.Logger) *Client {
+	routes := make([]*Transport, 0, len(transports)+1)
+	routes = append(routes, transports...)
+	if cfg != nil && cfg.Host != "" {
+		// relay host is used when nothing in the transport map matches
+		routes = append(routes, &Transport{From: "*", To: "*", Relays: []*RelayConfig{cfg}})
+	}
+
 	return &Client{
-		config: cfg,
-		log:    log,
+		hostname:   hostname,
+		transports: routes,
+		resolver:   resolver,
+		log:        log,
+	}
+}
+
+// Send email to the recipients, using one connection with several RCPTs and a single DATA per destination domain (or relay).
+// Returns result of each recipient, in the same order as tos
+func (c Client) Send(from string, tos []string, data string) []error {
+	results := make([]error, len(tos))
+	keys := []string{}
+	batches := map[string]*batch{}
+	for i, to := range tos {
+		key, b := c.route(from, to)
+		if _, ok := batches[key]; !ok {
+			keys = append(keys, key)
+			batches[key] = b
+		}
+		batches[key].idxs = append(batches[key].idxs, i)
+	}
+
+	for _, key := range keys {
+		b := batches[key]
+		rcpts := make([]string, 0, len(b.idxs))
+		for _, idx := range b.idxs {
+			rcpts = append(rcpts, tos[idx])
+		}
+		for i, err := range c.sendBatch(from, b, rcpts, data) {
+			results[b.idxs[i]] = err
+		}
 	}
+	return results
 }
 
-// Send email
-func (c Client) Send(from, to, data string) error {
-	log := c.log.With().Str("from", from).Str("to", to).Logger()
+// route finds the first matching transport of the email and returns key and (empty) batch of it
+func (c Client) route(from, to string) (string, *batch) {
+	for i, transport := range c.transports {
+		if !transport.Match(from, to) {
+			continue
+		}
+		if len(transport.Relays) > 0 {
+			return "relay:" + strconv.Itoa(i), &batch{relays: transport.Relays}
+		}
+		break
+	}
+	domain := strings.ToLower(utils.Hostname(to))
+	return "mx:" + domain, &batch{domain: domain}
+}
+
+// sendBatch sends email to the recipients of the same domain (or relay), trying servers in priority order.
+// Recipients rejected by a relay with temporary errors are retried via the fallback relays
+func (c Client) sendBatch(from string, b *batch, rcpts []string, data string) []error {
+	log := c.log.With().Str("from", from).Strs("to", rcpts).Logger()
 	log.Debug().Msg("sending email")
 
-	var conn *smtp.Client
-	var err error
-	if c.config.Host != "" {
-		log.Debug().Msg("creating relay client...")
-		conn, err = c.createDirectClient(from, to)
-	} else {
-		log.Debug().Msg("trying direct SMTP connection...")
-		conn, err = trysmtp.Connect(from, to)
+	servers := b.relays
+	if len(servers) == 0 {
+		var err error
+		servers, err = c.mxs(b.domain)
+		if err != nil {
+			log.Error().Err(err).Str("domain", b.domain).Msg("cannot find SMTP servers")
+			return fill(len(rcpts), err)
+		}
 	}
 
-	if conn == nil {
-		log.Error().Err(err).Str("server_of", to).Msg("cannot connect to SMTP server")
-		return err
+	results := make([]error, len(rcpts))
+	pending := make([]int, len(rcpts))
+	for i := range pending {
+		pending[i] = i
 	}
+	for _, server := range servers {
+		batchRcpts := make([]string, 0, len(pending))
+		for _, idx := range pending {
+			batchRcpts = append(batchRcpts, rcpts[idx])
+		}
+		errs, err := c.deliver(from, server, batchRcpts, data)
+		if err != nil {
+			log.Warn().Err(err).Str("host", server.Host).Msg("cannot deliver email via the SMTP server")
+			for _, idx := range pending {
+				results[idx] = err
+			}
+			continue
+		}
+		log.Debug().Str("host", server.Host).Msg("email has been sent")
+
+		next := []int{}
+		for i, idx := range pending {
+			results[idx] = errs[i]
+			if len(b.relays) > 0 && temporary(errs[i]) {
+				log.Warn().Err(errs[i]).Str("host", server.Host).Str("rcpt", rcpts[idx]).Msg("relay temporarily rejected the recipient")
+				next = append(next, idx)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		pending = next
+	}
+	return results
+}
+
+// mxs returns MX servers of the domain in priority order
+func (c Client) mxs(domain string) ([]*RelayConfig, error) {
+	mxs, err := c.resolver.LookupMX(context.Background(), domain)
 	if err != nil {
-		log.Warn().Err(err).Str("server_of", to).Msg("connection to the SMTP server returned non-fatal error(-s)")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	servers := make([]*RelayConfig, 0, len(mxs))
+	for _, mx := range mxs {
+		if mx.Host == "." {
+			return nil, fmt.Errorf("%s: %w", domain, ErrNullMX)
+		}
+		servers = append(servers, &RelayConfig{Host: strings.TrimSuffix(mx.Host, "."), Port: mxPort})
+	}
+	// no MX records, according to https://datatracker.ietf.org/doc/html/rfc5321#section-5.1,
+	// we're supposed to try talking directly to the host.
+	if len(servers) == 0 {
+		servers = append(servers, &RelayConfig{Host: domain, Port: mxPort})
+	}
+	return servers, nil
+}
+
+// deliver email to the recipients via the SMTP server.
+// Returns result of each recipient, or error if the server cannot be used at all
+func (c Client) deliver(from string, server *RelayConfig, rcpts []string, data string) ([]error, error) {
+	host := server.Host
+	localname := utils.Hostname(from)
+	if localname == "" { // null reverse-path of bounces
+		localname = c.hostname
+	}
+	conn, err := c.connect(localname, server)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", host, err)
 	}
 	defer conn.Close()
 
-	var w io.WriteCloser
-	w, err = conn.Data()
+	if err = conn.Mail(from); err != nil {
+		return nil, fmt.Errorf("%s: %w", host, err)
+	}
+
+	results := make([]error, len(rcpts))
+	var accepted int
+	for i, rcpt := range rcpts {
+		if rerr := conn.Rcpt(rcpt); rerr != nil {
+			results[i] = fmt.Errorf("%s: %w", host, rerr)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return results, nil
+	}
+
+	if err = c.data(conn, data); err != nil {
+		err = fmt.Errorf("%s: %w", host, err)
+		for i := range results {
+			if results[i] == nil {
+				results[i] = err
+			}
+		}
+	}
+	conn.Quit() //nolint:errcheck // email has been sent already
+	return results, nil
+}
+
+// data sends DATA command with the email
+func (c Client) data(conn *smtp.Client, data string) error {
+	w, err := conn.Data()
 	if err != nil {
-		log.Error().Err(err).Msg("cannot send DATA command")
 		return err
 	}
-	defer w.Close()
 	c.log.Debug().Str("DATA", data).Msg("sending command")
-	_, err = strings.NewReader(data).WriteTo(w)
-	if err != nil {
-		log.Error().Err(err).Msg("cannot write DATA")
+	if _, err = strings.NewReader(data).WriteTo(w); err != nil {
+		w.Close()
 		return err
 	}
-
-	log.Debug().Msg("email has been sent")
-	return nil
+	return w.Close()
 }
 
-// createDirectClient connects directly to the provided smtp host
-func (c *Client) createDirectClient(from, to string) (*smtp.Client, error) {
-	localname := strings.SplitN(from, "@", 2)[1]
-	target := c.config.Host + ":" + c.config.Port
-	conn, err := smtp.Dial(target)
+// connect to the SMTP server, say hello, start TLS (if supported and not disabled) and authenticate (if credentials are set)
+func (c Client) connect(localname string, server *RelayConfig) (*smtp.Client, error) {
+	host := server.Host
+	config, err := server.tlsConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	err = conn.Hello(localname)
+	var netconn net.Conn
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if server.TLS == RelayTLSImplicit {
+		netconn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, server.Port), config)
+	} else {
+		netconn, err = dialer.Dial("tcp", net.JoinHostPort(host, server.Port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := smtp.NewClient(netconn, host)
 	if err != nil {
+		netconn.Close()
 		return nil, err
 	}
 
-	if ok, _ := conn.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: c.config.Host} //nolint:gosec // it's smtp, even that is too strict sometimes
-		conn.StartTLS(config)                            //nolint:errcheck // if it doesn't work - we can't do anything anyway
+	if err = conn.Hello(localname); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	if c.config.Usename != "" {
-		err = conn.Auth(smtp.PlainAuth("", c.config.Usename, c.config.Password, c.config.Host))
-		if err != nil {
+	if err = c.startTLS(conn, server, config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if server.Usename != "" {
+		if _, encrypted := conn.TLSConnectionState(); !encrypted && !server.InsecureAuth {
+			conn.Close()
+			return nil, ErrInsecureAuth
+		}
+		if err = conn.Auth(server.auth()); err != nil {
 			conn.Close()
 			return nil, err
 		}
 	}
 
-	err = conn.Mail(from)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	return conn, nil
+}
+
+// startTLS upgrades connection with STARTTLS, according to the TLS mode
+func (c Client) startTLS(conn *smtp.Client, server *RelayConfig, config *tls.Config) error {
+	switch server.TLS {
+	case RelayTLSNone, RelayTLSImplicit:
+		return nil
 	}
 
-	err = conn.Rcpt(to)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	if ok, _ := conn.Extension("STARTTLS"); !ok {
+		if server.TLS == RelayTLSRequired {
+			return ErrTLSRequired
+		}
+		return nil
 	}
+	return conn.StartTLS(config)
+}
 
-	return conn, nil
+// temporary checks if the SMTP server rejected with temporary (4xx) error
+func temporary(err error) bool {
+	var tperr *textproto.Error
+	return errors.As(err, &tperr) && tperr.Code >= 400 && tperr.Code < 500
+}
+
+// fill returns results of n recipients with the same error
+func fill(n int, err error) []error {
+	results := make([]error, n)
+	for i := range results {
+		results[i] = err
+	}
+	return results
 }
@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// dmarcResult of the DMARC policy evaluation
+type dmarcResult struct {
+	Domain string
+	Policy dmarc.Policy
+	Value  authres.ResultValue
+	Pass   bool
+}
+
+// checkDMARC evaluates DMARC policy of the header From domain against SPF and DKIM results (RFC 7489)
+func checkDMARC(ctx context.Context, resolver Resolver, headerFrom, mailFrom, helo string, spfResult spf.Result, verifications []*dkim.Verification) (*dmarcResult, error) {
+	from, err := mail.ParseAddress(headerFrom)
+	if err != nil {
+		// the message without valid From header cannot be evaluated, so it cannot be trusted
+		return &dmarcResult{Policy: dmarc.PolicyReject, Value: authres.ResultPermError}, nil //nolint:nilerr // that's the result
+	}
+	domain := strings.ToLower(utils.Hostname(from.Address))
+	result := &dmarcResult{Domain: domain, Policy: dmarc.PolicyNone, Value: authres.ResultNone}
+
+	record, err := lookupDMARC(ctx, resolver, domain)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		result.Pass = true
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Policy = record.Policy
+
+	if dkimAligned(domain, record.DKIMAlignment, verifications) || spfAligned(domain, record.SPFAlignment, mailFrom, helo, spfResult) {
+		result.Pass = true
+		result.Value = authres.ResultPass
+		return result, nil
+	}
+	result.Value = authres.ResultFail
+
+	// pct=N means the policy is applied to N% of messages only, the rest gets the next less strict policy
+	if record.Percent != nil && rand.Intn(100) >= *record.Percent { //nolint:gosec // no need for crypto/rand here
+		switch result.Policy {
+		case dmarc.PolicyReject:
+			result.Policy = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			result.Policy = dmarc.PolicyNone
+		}
+	}
+
+	return result, nil
+}
+
+// lookupDMARC record of the domain, falling back to the organizational domain's record
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (*dmarc.Record, error) {
+	options := &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			return resolver.LookupTXT(ctx, name)
+		},
+	}
+	record, err := dmarc.LookupWithOptions(domain, options)
+	if !errors.Is(err, dmarc.ErrNoPolicy) {
+		return record, err
+	}
+
+	orgDomain := organizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, err
+	}
+	record, err = dmarc.LookupWithOptions(orgDomain, options)
+	if err != nil {
+		return nil, err
+	}
+	if record.SubdomainPolicy != "" {
+		record.Policy = record.SubdomainPolicy
+	}
+	return record, nil
+}
+
+func dkimAligned(domain string, mode dmarc.AlignmentMode, verifications []*dkim.Verification) bool {
+	for _, verification := range verifications {
+		if verification.Err == nil && aligned(verification.Domain, domain, mode) {
+			return true
+		}
+	}
+	return false
+}
+
+func spfAligned(domain string, mode dmarc.AlignmentMode, mailFrom, helo string, result spf.Result) bool {
+	if result != spf.Pass {
+		return false
+	}
+
+	return aligned(utils.Hostname(spfSender(mailFrom, helo)), domain, mode)
+}
+
+// spfSender returns sender identity checked by SPF, RFC 7208 section 2.4
+func spfSender(mailFrom, helo string) string {
+	if mailFrom == "" {
+		return "postmaster@" + helo
+	}
+	return mailFrom
+}
+
+// aligned checks if the identifier's domain is aligned with the header From domain
+func aligned(identifier, domain string, mode dmarc.AlignmentMode) bool {
+	identifier = strings.ToLower(identifier)
+	if mode == dmarc.AlignmentStrict {
+		return identifier == domain
+	}
+
+	return organizationalDomain(identifier) == organizationalDomain(domain)
+}
+
+func organizationalDomain(domain string) string {
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
@@ -0,0 +1,110 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// fakeResolver returns TXT records from the map, other lookups return nothing
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func (r fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	resolver := fakeResolver{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.example.org": {"v=DMARC1; p=quarantine; adkim=s"},
+		"_dmarc.example.net": {"v=DMARC1; p=none"},
+	}
+	tests := map[string]struct {
+		from          string
+		mailFrom      string
+		spf           spf.Result
+		verifications []*dkim.Verification
+		pass          bool
+		policy        dmarc.Policy
+	}{
+		"spf aligned": {
+			from: "user@example.com", mailFrom: "bounce@example.com", spf: spf.Pass,
+			pass: true, policy: dmarc.PolicyReject,
+		},
+		"spf relaxed alignment": {
+			from: "user@example.com", mailFrom: "bounce@mail.example.com", spf: spf.Pass,
+			pass: true, policy: dmarc.PolicyReject,
+		},
+		"spf not aligned": {
+			from: "user@example.com", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			pass: false, policy: dmarc.PolicyReject,
+		},
+		"spf fail": {
+			from: "user@example.com", mailFrom: "bounce@example.com", spf: spf.Fail,
+			pass: false, policy: dmarc.PolicyReject,
+		},
+		"dkim aligned": {
+			from: "user@example.com", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			verifications: []*dkim.Verification{{Domain: "example.com"}},
+			pass:          true, policy: dmarc.PolicyReject,
+		},
+		"dkim strict alignment": {
+			from: "user@example.org", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			verifications: []*dkim.Verification{{Domain: "mail.example.org"}},
+			pass:          false, policy: dmarc.PolicyQuarantine,
+		},
+		"dkim invalid": {
+			from: "user@example.com", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			verifications: []*dkim.Verification{{Domain: "example.com", Err: errors.New("signature did not verify")}},
+			pass:          false, policy: dmarc.PolicyReject,
+		},
+		"subdomain policy": {
+			from: "user@sub.example.com", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			pass: false, policy: dmarc.PolicyQuarantine,
+		},
+		"policy none": {
+			from: "user@example.net", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			pass: false, policy: dmarc.PolicyNone,
+		},
+		"no policy": {
+			from: "user@no-dmarc.example", mailFrom: "bounce@forwarder.example", spf: spf.Pass,
+			pass: true, policy: dmarc.PolicyNone,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := checkDMARC(context.Background(), resolver, test.from, test.mailFrom, "mx.forwarder.example", test.spf, test.verifications)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Pass != test.pass {
+				t.Error("pass", test.pass, "!=", result.Pass)
+			}
+			if result.Policy != test.policy {
+				t.Error("policy", test.policy, "!=", result.Policy)
+			}
+		})
+	}
+}
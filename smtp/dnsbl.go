@@ -0,0 +1,156 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// dnsblCacheTTL is how long DNSBL lookup results are cached
+	dnsblCacheTTL = 30 * time.Minute
+	// dnsblCleanupInterval is how often expired DNSBL lookup results are removed from the cache
+	dnsblCleanupInterval = time.Minute
+	// dnsblTimeout is max time to wait for the DNSBL lookups, unanswered zones are treated as not listed
+	dnsblTimeout = 5 * time.Second
+)
+
+type dnsblEntry struct {
+	listed  bool
+	expires time.Time
+}
+
+// dnsbl checks IP addresses against DNS blocklists
+type dnsbl struct {
+	mu       sync.Mutex
+	log      *zerolog.Logger
+	resolver Resolver
+	cache    map[string]dnsblEntry
+	cleaned  time.Time
+	timeout  time.Duration
+}
+
+func newDNSBL(resolver Resolver, log *zerolog.Logger) *dnsbl {
+	return &dnsbl{
+		log:      log,
+		resolver: resolver,
+		cache:    map[string]dnsblEntry{},
+		timeout:  dnsblTimeout,
+	}
+}
+
+// Check returns total score of the ip and the blocklists it is listed in
+func (d *dnsbl) Check(ctx context.Context, ip net.IP, lists map[string]int) (score int, listed []string) {
+	query := dnsblQuery(ip)
+	if query == "" {
+		return 0, nil
+	}
+
+	zones := make([]string, 0, len(lists))
+	for zone := range lists {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	results := make([]bool, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			results[i] = d.listed(ctx, query, zone)
+		}(i, zone)
+	}
+	wg.Wait()
+
+	for i, zone := range zones {
+		if results[i] {
+			score += lists[zone]
+			listed = append(listed, zone)
+		}
+	}
+	return score, listed
+}
+
+// Listed checks if the address is listed in DNS blocklists configured by admins with total score above the threshold
+func (d *dnsbl) Listed(ctx context.Context, addr net.Addr, lists map[string]int, threshold int) bool {
+	if len(lists) == 0 {
+		return false
+	}
+	score, listed := d.Check(ctx, addrIP(addr), lists)
+	if len(listed) == 0 {
+		return false
+	}
+	d.log.Info().Str("addr", addr.String()).Strs("lists", listed).Int("score", score).Int("threshold", threshold).Msg("address is listed in DNSBL")
+	return score >= threshold
+}
+
+func (d *dnsbl) listed(ctx context.Context, query, zone string) bool {
+	key := query + "." + zone
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.listed
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, key)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			// temporary errors are not cached and don't block anybody
+			d.log.Warn().Err(err).Str("zone", zone).Msg("cannot check DNSBL")
+			return false
+		}
+	}
+
+	entry = dnsblEntry{expires: time.Now().Add(dnsblCacheTTL)}
+	for _, addr := range addrs {
+		// 127.0.0.0/8 is a listing, except 127.255.255.0/24 - error codes (e.g. blocked public resolver)
+		ip4 := addr.IP.To4()
+		if ip4 != nil && ip4[0] == 127 && !(ip4[1] == 255 && ip4[2] == 255) {
+			entry.listed = true
+			break
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cache[key] = entry
+	if time.Since(d.cleaned) > dnsblCleanupInterval {
+		d.cleaned = time.Now()
+		for k, v := range d.cache {
+			if time.Now().After(v.expires) {
+				delete(d.cache, k)
+			}
+		}
+	}
+	return entry.listed
+}
+
+// dnsblQuery returns reversed IP address to use in the DNSBL query
+func dnsblQuery(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." + strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0]))
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, net.IPv6len*2)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[ip16[i]&0x0F]), string(hex[ip16[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// dnsblResolver returns A records from the map, lookups of the zones from the slow map block until the context is done
+type dnsblResolver struct {
+	fakeResolver
+	mu      sync.Mutex
+	records map[string][]net.IPAddr
+	slow    map[string]bool
+	lookups int
+}
+
+func (r *dnsblResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	for zone := range r.slow {
+		if len(host) > len(zone) && host[len(host)-len(zone):] == zone {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	}
+	addrs, ok := r.records[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	listing := []net.IPAddr{{IP: net.IPv4(127, 0, 0, 2)}}
+	resolver := &dnsblResolver{
+		records: map[string][]net.IPAddr{
+			"2.0.0.192.zen.example":   listing,
+			"2.0.0.192.bl.example":    listing,
+			"2.0.0.192.error.example": {{IP: net.IPv4(127, 255, 255, 254)}},
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example": listing,
+		},
+		slow: map[string]bool{"slow.example": true, "slower.example": true},
+	}
+	log := zerolog.Nop()
+	d := newDNSBL(resolver, &log)
+	d.timeout = 100 * time.Millisecond
+	lists := map[string]int{"zen.example": 2, "bl.example": 1, "error.example": 5, "clean.example": 5, "slow.example": 5, "slower.example": 5}
+
+	tests := map[string]struct {
+		ip     string
+		score  int
+		listed []string
+	}{
+		"listed ipv4":     {ip: "192.0.0.2", score: 3, listed: []string{"bl.example", "zen.example"}},
+		"listed ipv6":     {ip: "2001:db8::1", score: 2, listed: []string{"zen.example"}},
+		"not listed ipv4": {ip: "192.0.0.3"},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			score, listed := d.Check(context.Background(), net.ParseIP(test.ip), lists)
+			// zones are queried in parallel, so slow zones don't add up
+			if elapsed := time.Since(start); elapsed > 2*d.timeout {
+				t.Fatalf("expected lookups to time out after %s, took %s", d.timeout, elapsed)
+			}
+			if score != test.score || len(listed) != len(test.listed) {
+				t.Fatalf("expected score %d and lists %v, got %d and %v", test.score, test.listed, score, listed)
+			}
+			for i := range listed {
+				if listed[i] != test.listed[i] {
+					t.Fatalf("expected lists %v, got %v", test.listed, listed)
+				}
+			}
+		})
+	}
+
+	// timed out lookups of the slow zones are not cached, the others are
+	lookups := resolver.lookups
+	d.Check(context.Background(), net.ParseIP("192.0.0.2"), lists)
+	if resolver.lookups != lookups+2 {
+		t.Fatalf("expected 2 lookups of the not cached slow zones, got %d", resolver.lookups-lookups)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.0.2"), Port: 25}
+	if !d.Listed(context.Background(), addr, lists, 3) {
+		t.Fatal("expected the address to be listed with score 3")
+	}
+	if d.Listed(context.Background(), addr, lists, 4) {
+		t.Fatal("expected the address not to be listed with threshold 4")
+	}
+}
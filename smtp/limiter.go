@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// limiterWindow is a window of the connections rate limit
+const limiterWindow = time.Minute
+
+// LimitsConfig of the SMTP server, 0 = unlimited
+type LimitsConfig struct {
+	// Connections is max concurrent connections per IP
+	Connections int
+	// Rate is max new connections per IP per minute
+	Rate int
+	// Messages is max messages per session
+	Messages int
+	// Ban is an amount of limit violations, after which the IP will be banned automatically
+	Ban int
+}
+
+type limiterHost struct {
+	conns      int
+	rate       int
+	since      time.Time
+	violations int
+}
+
+// limiter enforces per-IP limits
+type limiter struct {
+	mu      sync.Mutex
+	cfg     LimitsConfig
+	log     *zerolog.Logger
+	hosts   map[string]*limiterHost
+	ban     func(net.Addr)
+	cleaned time.Time
+}
+
+// limitedConn releases limiter's slot on close
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func newLimiter(cfg LimitsConfig, ban func(net.Addr), log *zerolog.Logger) *limiter {
+	return &limiter{
+		cfg:     cfg,
+		log:     log,
+		hosts:   map[string]*limiterHost{},
+		ban:     ban,
+		cleaned: time.Now(),
+	}
+}
+
+// Accept checks connection against the limits and returns wrapped connection if it's allowed
+func (l *limiter) Accept(conn net.Conn) (net.Conn, bool) {
+	if l.cfg.Connections <= 0 && l.cfg.Rate <= 0 {
+		return conn, true
+	}
+	addr := conn.RemoteAddr()
+	ip := utils.AddrIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanup()
+
+	host, ok := l.hosts[ip]
+	if !ok {
+		host = &limiterHost{since: time.Now()}
+		l.hosts[ip] = host
+	}
+	if time.Since(host.since) > limiterWindow {
+		host.rate = 0
+		host.since = time.Now()
+	}
+	host.rate++
+
+	if l.cfg.Rate > 0 && host.rate > l.cfg.Rate {
+		l.log.Info().Str("addr", ip).Int("rate", host.rate).Msg("connections rate limit exceeded")
+		l.violation(addr, host)
+		return conn, false
+	}
+	if l.cfg.Connections > 0 && host.conns >= l.cfg.Connections {
+		l.log.Info().Str("addr", ip).Int("connections", host.conns).Msg("concurrent connections limit exceeded")
+		l.violation(addr, host)
+		return conn, false
+	}
+
+	host.conns++
+	return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, true
+}
+
+// Violation records limit violation of the address
+func (l *limiter) Violation(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip := utils.AddrIP(addr)
+	host, ok := l.hosts[ip]
+	if !ok {
+		host = &limiterHost{since: time.Now()}
+		l.hosts[ip] = host
+	}
+	l.violation(addr, host)
+}
+
+// violation must be called under the lock
+func (l *limiter) violation(addr net.Addr, host *limiterHost) {
+	host.violations++
+	if l.cfg.Ban <= 0 || host.violations < l.cfg.Ban {
+		return
+	}
+	host.violations = 0
+	go l.ban(addr)
+}
+
+func (l *limiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if host, ok := l.hosts[ip]; ok && host.conns > 0 {
+		host.conns--
+	}
+}
+
+// cleanup removes idle hosts, must be called under the lock
+func (l *limiter) cleanup() {
+	if time.Since(l.cleaned) < limiterWindow {
+		return
+	}
+	l.cleaned = time.Now()
+	for ip, host := range l.hosts {
+		if host.conns == 0 && time.Since(host.since) > limiterWindow {
+			delete(l.hosts, ip)
+		}
+	}
+}
+
+// reject writes SMTP response to the rejected connection and closes it
+func reject(conn net.Conn, err *smtp.SMTPError) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))                                                                            //nolint:errcheck // connection is closed anyway
+	fmt.Fprintf(conn, "%d %d.%d.%d %s\r\n", err.Code, err.EnhancedCode[0], err.EnhancedCode[1], err.EnhancedCode[2], err.Message) //nolint:errcheck // connection is closed anyway
+	conn.Close()
+}
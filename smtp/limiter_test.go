@@ -0,0 +1,125 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+)
+
+type testConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func newTestConn(ip string) net.Conn {
+	return &testConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}
+}
+
+func TestLimiterConnections(t *testing.T) {
+	log := zerolog.Nop()
+	banned := make(chan net.Addr, 1)
+	l := newLimiter(LimitsConfig{Connections: 2, Ban: 2}, func(addr net.Addr) { banned <- addr }, &log)
+
+	first, ok := l.Accept(newTestConn("192.0.2.1"))
+	if !ok {
+		t.Fatal("first connection is rejected")
+	}
+	if _, ok = l.Accept(newTestConn("192.0.2.1")); !ok {
+		t.Fatal("second connection is rejected")
+	}
+	if _, ok = l.Accept(newTestConn("192.0.2.1")); ok {
+		t.Error("third concurrent connection is accepted")
+	}
+	if _, ok = l.Accept(newTestConn("192.0.2.2")); !ok {
+		t.Error("connection from another IP is rejected")
+	}
+
+	first.Close()
+	first.Close() // released only once
+	if _, ok = l.Accept(newTestConn("192.0.2.1")); !ok {
+		t.Error("connection is rejected after the slot was released")
+	}
+	if _, ok = l.Accept(newTestConn("192.0.2.1")); ok {
+		t.Error("connection is accepted over the limit")
+	}
+
+	select {
+	case addr := <-banned:
+		if addr.(*net.TCPAddr).IP.String() != "192.0.2.1" {
+			t.Errorf("wrong address is banned: %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Error("address is not banned after limit violations")
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	log := zerolog.Nop()
+	l := newLimiter(LimitsConfig{Rate: 2}, func(net.Addr) {}, &log)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := l.Accept(newTestConn("192.0.2.1")); !ok {
+			t.Fatalf("connection %d is rejected", i+1)
+		}
+	}
+	if _, ok := l.Accept(newTestConn("192.0.2.1")); ok {
+		t.Error("connection over the rate is accepted")
+	}
+
+	// the rate is refilled when the window has passed
+	l.hosts["192.0.2.1"].since = time.Now().Add(-limiterWindow - time.Second)
+	if _, ok := l.Accept(newTestConn("192.0.2.1")); !ok {
+		t.Error("connection is rejected after the rate window has passed")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	log := zerolog.Nop()
+	l := newLimiter(LimitsConfig{}, func(net.Addr) {}, &log)
+
+	for i := 0; i < 100; i++ {
+		if _, ok := l.Accept(newTestConn("192.0.2.1")); !ok {
+			t.Fatalf("connection %d is rejected without limits", i+1)
+		}
+	}
+}
+
+func TestSessionMessagesLimit(t *testing.T) {
+	log := zerolog.Nop()
+	var violations int
+	s := &incomingSession{
+		log:         &log,
+		ctx:         sentry.SetHubOnContext(context.Background(), sentry.CurrentHub().Clone()),
+		addr:        &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		trusted:     func(net.Addr) bool { return false },
+		listed:      func(context.Context, net.Addr) bool { return false },
+		ban:         func(net.Addr) {},
+		violation:   func(net.Addr) { violations++ },
+		maxMessages: 2,
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Mail("sender@example.com", smtp.MailOptions{}); err != nil {
+			t.Fatalf("message %d is rejected: %v", i+1, err)
+		}
+	}
+	if err := s.Mail("sender@example.com", smtp.MailOptions{}); err != ErrLimit { //nolint:errorlint // exact error is returned
+		t.Errorf("expected limit error, got %v", err)
+	}
+	if violations != 1 {
+		t.Errorf("expected 1 violation, got %d", violations)
+	}
+}
@@ -5,31 +5,42 @@ import (
 	"net"
 	"sync"
 
+	"github.com/emersion/go-smtp"
 	"github.com/rs/zerolog"
 )
 
 // Listener that rejects connections from banned hosts
+// and reads PROXY protocol header of connections from trusted proxies
 type Listener struct {
-	log      *zerolog.Logger
-	done     chan struct{}
-	tls      *tls.Config
-	tlsMu    sync.Mutex
-	listener net.Listener
-	isBanned func(net.Addr) bool
+	log       *zerolog.Logger
+	done      chan struct{}
+	once      sync.Once
+	conns     chan net.Conn
+	tls       *tls.Config
+	tlsMu     sync.Mutex
+	listener  net.Listener
+	isBanned  func(net.Addr) bool
+	isTrusted func(net.Addr) bool
+	proxy     bool
+	limiter   *limiter
 }
 
-func NewListener(port string, tlsConfig *tls.Config, isBanned func(net.Addr) bool, log *zerolog.Logger) (*Listener, error) {
+func NewListener(port string, tlsConfig *tls.Config, isBanned, isTrusted func(net.Addr) bool, proxy bool, limiter *limiter, log *zerolog.Logger) (*Listener, error) {
 	actual, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Listener{
-		log:      log,
-		done:     make(chan struct{}, 1),
-		tls:      tlsConfig,
-		listener: actual,
-		isBanned: isBanned,
+		log:       log,
+		done:      make(chan struct{}, 1),
+		conns:     make(chan net.Conn),
+		tls:       tlsConfig,
+		listener:  actual,
+		isBanned:  isBanned,
+		isTrusted: isTrusted,
+		proxy:     proxy,
+		limiter:   limiter,
 	}, nil
 }
 
@@ -40,38 +51,86 @@ func (l *Listener) SetTLSConfig(cfg *tls.Config) {
 }
 
 // Accept waits for and returns the next connection to the listener.
+// Connections are checked in their own goroutines, so a slow client (e.g. stuck on PROXY header) doesn't block others
 func (l *Listener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.acceptLoop() })
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) acceptLoop() {
 	for {
 		conn, err := l.listener.Accept()
 		if err != nil {
 			select {
 			case <-l.done:
-				return conn, err
+				return
 			default:
 				l.log.Warn().Err(err).Msg("cannot accept connection")
 				continue
 			}
 		}
-		if l.isBanned(conn.RemoteAddr()) {
+		go l.check(conn)
+	}
+}
+
+// check the connection and pass it to Accept, if it's allowed
+func (l *Listener) check(conn net.Conn) {
+	if l.proxy && l.isTrusted(conn.RemoteAddr()) {
+		pconn, perr := newProxyConn(conn)
+		if perr != nil {
 			conn.Close()
-			l.log.Info().Str("addr", conn.RemoteAddr().String()).Msg("rejected connection (already banned)")
-			continue
+			l.log.Warn().Err(perr).Str("proxy", conn.RemoteAddr().String()).Msg("rejected connection (cannot read PROXY header)")
+			return
 		}
+		l.log.Debug().Str("proxy", conn.RemoteAddr().String()).Str("addr", pconn.RemoteAddr().String()).Msg("connection is proxied")
+		conn = pconn
+	}
+	if l.isBanned(conn.RemoteAddr()) {
+		conn.Close()
+		l.log.Info().Str("addr", conn.RemoteAddr().String()).Msg("rejected connection (already banned)")
+		return
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		var allowed bool
+		conn, allowed = l.limiter.Accept(conn)
+		if !allowed {
+			l.reject(conn, ErrLimit)
+			l.log.Info().Str("addr", conn.RemoteAddr().String()).Msg("rejected connection (limits exceeded)")
+			return
+		}
+	}
 
-		l.log.Info().Str("addr", conn.RemoteAddr().String()).Msg("accepted connection")
+	l.log.Info().Str("addr", conn.RemoteAddr().String()).Msg("accepted connection")
 
-		if l.tls != nil {
-			return l.acceptTLS(conn)
-		}
-		return conn, nil
+	if l.tls != nil {
+		conn = l.acceptTLS(conn)
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// reject connection with SMTP error, TLS connections are just closed
+func (l *Listener) reject(conn net.Conn, err *smtp.SMTPError) {
+	if l.tls != nil {
+		conn.Close()
+		return
 	}
+	reject(conn, err)
 }
 
-func (l *Listener) acceptTLS(conn net.Conn) (net.Conn, error) {
+func (l *Listener) acceptTLS(conn net.Conn) net.Conn {
 	l.tlsMu.Lock()
 	defer l.tlsMu.Unlock()
 
-	return tls.Server(conn, l.tls), nil
+	return tls.Server(conn, l.tls)
 }
 
 // Close closes the listener.
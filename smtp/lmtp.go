@@ -0,0 +1,156 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// checks that may be skipped on LMTP, because they were already performed by the MTA in front of postmoogle
+const (
+	LMTPSkipGreylist = "greylist"
+	LMTPSkipAuth     = "auth"
+	LMTPSkipScanner  = "scanner"
+	LMTPSkipMilters  = "milters"
+)
+
+// LMTPConfig of the LMTP listener
+type LMTPConfig struct {
+	// Addr to listen on, e.g.: unix:/run/postmoogle/lmtp.sock or localhost:24, empty = disabled
+	Addr string
+	// Skip is a list of checks already performed by the MTA: greylist, auth (SPF, DKIM, DMARC), scanner, milters
+	Skip []string
+	// AuthservID of the MTA, its Authentication-Results headers are kept when auth checks are skipped
+	AuthservID string
+	// Allowed is a list of IP addresses allowed to connect over TCP in addition to loopback, LMTP has no authentication
+	Allowed []string
+}
+
+// lmtpBackend accepts emails from the trusted MTA over LMTP, using the same incoming sessions as SMTP
+type lmtpBackend struct {
+	srv        *mailServer
+	skip       map[string]bool
+	authservID string
+}
+
+func newLMTPBackend(srv *mailServer, cfg LMTPConfig, log *zerolog.Logger) *lmtpBackend {
+	skip := make(map[string]bool, len(cfg.Skip))
+	for _, check := range cfg.Skip {
+		switch check {
+		case LMTPSkipGreylist, LMTPSkipAuth, LMTPSkipScanner, LMTPSkipMilters:
+			skip[check] = true
+		default:
+			log.Warn().Str("check", check).Msg("unknown LMTP check to skip, ignoring it")
+		}
+	}
+	if !skip[LMTPSkipGreylist] || !skip[LMTPSkipAuth] {
+		log.Warn().Msg("LMTP doesn't pass the address of the original sender, so the MTA's address is used for greylist and auth checks")
+	}
+	return &lmtpBackend{srv: srv, skip: skip, authservID: cfg.AuthservID}
+}
+
+// Login is not supported, LMTP is used for incoming emails only
+func (b *lmtpBackend) Login(_ *smtp.ConnectionState, _, _ string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// AnonymousLogin creates incoming session of the trusted MTA
+func (b *lmtpBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	b.srv.log.Debug().Any("state", state).Msg("LMTP AnonymousLogin")
+	session := b.srv.newIncomingSession(state)
+	// the MTA is never banned or limited and DNSBL checks are its job.
+	// The sender's address is never taken from the headers, because they are written by the sender, not the MTA
+	session.trusted = func(net.Addr) bool { return false }
+	session.listed = func(context.Context, net.Addr) bool { return false }
+	session.ban = func(net.Addr) {}
+	session.violation = func(net.Addr) {}
+	session.maxMessages = 0
+
+	if b.skip[LMTPSkipGreylist] {
+		session.greylisted = func(net.Addr) bool { return false }
+	}
+	if b.skip[LMTPSkipScanner] {
+		session.scanner = nil
+	}
+	if b.skip[LMTPSkipMilters] {
+		session.milters = nil
+	}
+	session.lmtp = true
+	session.skipAuth = b.skip[LMTPSkipAuth]
+	if b.authservID != "" {
+		session.authservIDs = []string{b.authservID}
+	}
+	return session, nil
+}
+
+// listenLMTP creates LMTP listener on unix socket (unix:/path) or TCP address
+func listenLMTP(addr string, allowed []string, log *zerolog.Logger) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if err := removeSocket(path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	allowedIPs := make(map[string]bool, len(allowed))
+	for _, ip := range allowed {
+		allowedIPs[ip] = true
+	}
+	return &lmtpListener{Listener: listener, allowed: allowedIPs, log: log}, nil
+}
+
+// removeSocket removes stale unix socket left by the previous run, any other file is kept
+func removeSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	return os.Remove(path)
+}
+
+// lmtpListener accepts TCP connections from loopback and allowed addresses only
+type lmtpListener struct {
+	net.Listener
+	allowed map[string]bool
+	log     *zerolog.Logger
+}
+
+func (l *lmtpListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.isAllowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.log.Warn().Str("addr", conn.RemoteAddr().String()).Msg("LMTP connection from address that is not allowed, closing it")
+		conn.Close()
+	}
+}
+
+func (l *lmtpListener) isAllowed(addr net.Addr) bool {
+	ip := net.ParseIP(utils.AddrIP(addr))
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || l.allowed[ip.String()]
+}
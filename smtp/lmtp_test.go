@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLMTPListenerAllowed(t *testing.T) {
+	log := zerolog.Nop()
+	l := &lmtpListener{allowed: map[string]bool{"192.0.2.1": true}, log: &log}
+	tests := map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": false,
+	}
+	for ip, expected := range tests {
+		if allowed := l.isAllowed(&net.TCPAddr{IP: net.ParseIP(ip), Port: 24}); allowed != expected {
+			t.Errorf("%s: expected %t, got %t", ip, expected, allowed)
+		}
+	}
+}
+
+func TestListenLMTPSocket(t *testing.T) {
+	log := zerolog.Nop()
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenLMTP("unix:"+path, nil, &log); err == nil {
+		t.Error("regular file is replaced with the socket")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file is removed: %v", err)
+	}
+
+	path = filepath.Join(dir, "lmtp.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenLMTP("unix:"+path, nil, &log)
+	if err != nil {
+		t.Fatalf("stale socket is not replaced: %v", err)
+	}
+	listener.Close()
+}
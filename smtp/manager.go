@@ -1,7 +1,6 @@
 package smtp
 
 import (
-	"context"
 	"crypto/tls"
 	"net"
 	"sync"
@@ -25,11 +24,23 @@ type Config struct {
 	TLSPort     string
 	TLSRequired bool
 
+	ProxyProtocol bool
+	Limits        LimitsConfig
+	Scanner       ScannerConfig
+	Milters       MilterConfig
+	LMTP          LMTPConfig
+
 	Logger  *zerolog.Logger
 	MaxSize int
+	Spool   string
+	Inbox   Inbox
+	DNS     string
+	ARC     []string
 	Bot     matrixbot
 	Callers []Caller
 	Relay   *RelayConfig
+
+	Transports []*Transport
 }
 
 type TLSConfig struct {
@@ -46,6 +57,14 @@ type RelayConfig struct {
 	Port     string
 	Usename  string
 	Password string
+	// TLS mode: none, starttls (default), required or implicit
+	TLS string
+	// Auth mechanism: plain (default), login or cram-md5
+	Auth string
+	// CA is a path to the CA bundle (PEM) to verify relay's certificate, empty = system CAs
+	CA string
+	// InsecureAuth allows sending credentials over unencrypted connection
+	InsecureAuth bool
 }
 
 type Manager struct {
@@ -53,10 +72,15 @@ type Manager struct {
 	bot  matrixbot
 	fsw  *fswatcher.Watcher
 	smtp *smtp.Server
+	lmtp *smtp.Server
 	errs chan error
 
-	port string
-	tls  TLSConfig
+	port        string
+	lmtpAddr    string
+	lmtpAllowed []string
+	proxy       bool
+	limiter     *limiter
+	tls         TLSConfig
 }
 
 type matrixbot interface {
@@ -68,22 +92,42 @@ type matrixbot interface {
 	BanAuth(net.Addr)
 	GetMapping(string) (id.RoomID, bool)
 	GetIFOptions(id.RoomID) email.IncomingFilteringOptions
-	IncomingEmail(context.Context, *email.Email) error
+	IsSpam(id.RoomID, *email.Email) bool
+	SubmitEmail(id.RoomID, string, string, []string, string) (bool, map[string]error)
+	SubmittedEmail(id.RoomID, []string, *email.Email)
+	BounceEmail(string, string, error, string)
 	GetDKIMprivkey() string
+	GetDNSBL() (map[string]int, int)
+}
+
+// Inbox is a durable spool of incoming emails
+type Inbox interface {
+	Add(from string, tos []string, path string) error
 }
 
 // Caller is Sendmail caller
 type Caller interface {
-	SetSendmail(func(string, string, string) error)
+	SetSendmail(func(string, []string, string) []error)
 }
 
 // NewManager creates new SMTP server manager
 func NewManager(cfg *Config) *Manager {
+	limiter := newLimiter(cfg.Limits, cfg.Bot.BanAuto, cfg.Logger)
+	resolver := NewResolver(cfg.DNS)
 	mailsrv := &mailServer{
-		log:     cfg.Logger,
-		bot:     cfg.Bot,
-		domains: cfg.Domains,
-		sender:  newClient(cfg.Relay, cfg.Logger),
+		log:         cfg.Logger,
+		bot:         cfg.Bot,
+		domains:     cfg.Domains,
+		spool:       cfg.Spool,
+		inbox:       cfg.Inbox,
+		resolver:    resolver,
+		dnsbl:       newDNSBL(resolver, cfg.Logger),
+		scanner:     newScanner(cfg.Scanner, cfg.Logger),
+		milters:     cfg.Milters,
+		arcTrusted:  cfg.ARC,
+		sender:      newClient(cfg.Domains[0], cfg.Relay, cfg.Transports, resolver, cfg.Logger),
+		limiter:     limiter,
+		maxMessages: cfg.Limits.Messages,
 	}
 	for _, caller := range cfg.Callers {
 		caller.SetSendmail(mailsrv.sender.Send)
@@ -106,17 +150,35 @@ func NewManager(cfg *Config) *Manager {
 		s.Debug = loggerWriter{func(s string) { cfg.Logger.Info().Msg(s) }}
 	}
 
+	var lmtp *smtp.Server
+	if cfg.LMTP.Addr != "" {
+		lmtp = smtp.NewServer(newLMTPBackend(mailsrv, cfg.LMTP, cfg.Logger))
+		lmtp.LMTP = true
+		lmtp.Domain = cfg.Domains[0]
+		lmtp.ErrorLog = s.ErrorLog
+		lmtp.ReadTimeout = s.ReadTimeout
+		lmtp.WriteTimeout = s.WriteTimeout
+		lmtp.MaxMessageBytes = s.MaxMessageBytes
+		lmtp.EnableSMTPUTF8 = true
+		lmtp.Debug = s.Debug
+	}
+
 	fsw, err := fswatcher.New(append(cfg.TLSCerts, cfg.TLSKeys...), 0)
 	if err != nil {
 		cfg.Logger.Error().Err(err).Msg("cannot start FS watcher")
 	}
 
 	m := &Manager{
-		smtp: s,
-		bot:  cfg.Bot,
-		log:  cfg.Logger,
-		fsw:  fsw,
-		port: cfg.Port,
+		smtp:        s,
+		lmtp:        lmtp,
+		bot:         cfg.Bot,
+		log:         cfg.Logger,
+		fsw:         fsw,
+		port:        cfg.Port,
+		lmtpAddr:    cfg.LMTP.Addr,
+		lmtpAllowed: cfg.LMTP.Allowed,
+		proxy:       cfg.ProxyProtocol,
+		limiter:     limiter,
 		tls: TLSConfig{
 			Certs: cfg.TLSCerts,
 			Keys:  cfg.TLSKeys,
@@ -149,6 +211,9 @@ func (m *Manager) Start() error {
 	if m.tls.Config != nil {
 		go m.listen(m.tls.Port, m.tls.Config)
 	}
+	if m.lmtp != nil {
+		go m.listenLMTP()
+	}
 
 	return <-m.errs
 }
@@ -164,12 +229,17 @@ func (m *Manager) Stop() {
 	if err != nil {
 		m.log.Error().Err(err).Msg("cannot stop SMTP server properly")
 	}
+	if m.lmtp != nil {
+		if err = m.lmtp.Close(); err != nil {
+			m.log.Error().Err(err).Msg("cannot stop LMTP server properly")
+		}
+	}
 
 	m.log.Info().Msg("SMTP server has been stopped")
 }
 
 func (m *Manager) listen(port string, tlsConfig *tls.Config) {
-	lwrapper, err := NewListener(port, tlsConfig, m.bot.IsBanned, m.log)
+	lwrapper, err := NewListener(port, tlsConfig, m.bot.IsBanned, m.bot.IsTrusted, m.proxy, m.limiter, m.log)
 	if err != nil {
 		m.log.Error().Err(err).Str("port", port).Msg("cannot start listener")
 		m.errs <- err
@@ -188,6 +258,22 @@ func (m *Manager) listen(port string, tlsConfig *tls.Config) {
 	}
 }
 
+func (m *Manager) listenLMTP() {
+	listener, err := listenLMTP(m.lmtpAddr, m.lmtpAllowed, m.log)
+	if err != nil {
+		m.log.Error().Err(err).Str("addr", m.lmtpAddr).Msg("cannot start LMTP listener")
+		m.errs <- err
+		return
+	}
+	m.log.Info().Str("addr", m.lmtpAddr).Msg("Starting LMTP server")
+
+	err = m.lmtp.Serve(listener)
+	if err != nil {
+		m.log.Error().Str("addr", m.lmtpAddr).Err(err).Msg("cannot start LMTP server")
+		m.errs <- err
+	}
+}
+
 // loadTLSConfig returns true if certs were loaded and false if not
 func (m *Manager) loadTLSConfig() bool {
 	m.log.Info().Msg("(re)loading TLS config")
@@ -0,0 +1,645 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// milter actions on failure
+const (
+	MilterAccept   = "accept"
+	MilterTempfail = "tempfail"
+	MilterReject   = "reject"
+)
+
+const (
+	milterVersion  = 6
+	milterChunk    = 65535
+	milterMaxReply = 64 * 1024 * 1024
+)
+
+// milter commands (sent by MTA)
+const (
+	milterAbort   = 'A'
+	milterBody    = 'B'
+	milterConnect = 'C'
+	milterMacro   = 'D'
+	milterEOB     = 'E'
+	milterHelo    = 'H'
+	milterHeader  = 'L'
+	milterMail    = 'M'
+	milterEOH     = 'N'
+	milterOptneg  = 'O'
+	milterQuit    = 'Q'
+	milterRcpt    = 'R'
+	milterData    = 'T'
+)
+
+// milter responses
+const (
+	milterRespAccept     = 'a'
+	milterRespContinue   = 'c'
+	milterRespDiscard    = 'd'
+	milterRespReject     = 'r'
+	milterRespTempfail   = 't'
+	milterRespReplycode  = 'y'
+	milterRespProgress   = 'p'
+	milterRespSkip       = 's'
+	milterRespAddHeader  = 'h'
+	milterRespInsHeader  = 'i'
+	milterRespChgHeader  = 'm'
+	milterRespQuarantine = 'q'
+)
+
+// milter actions offered by postmoogle
+const (
+	milterActionAddHeaders = 0x01
+	milterActionChgHeaders = 0x10
+	milterActionQuarantine = 0x20
+)
+
+// milter protocol flags
+const (
+	milterNoConnect = 1 << iota
+	milterNoHelo
+	milterNoMail
+	milterNoRcpt
+	milterNoBody
+	milterNoHeaders
+	milterNoEOH
+	milterNoReplyHeader
+	milterNoUnknown
+	milterNoData
+	milterSkip
+	_ // rejected recipients are not sent to milters
+	milterNoReplyConnect
+	milterNoReplyHelo
+	milterNoReplyMail
+	milterNoReplyRcpt
+	milterNoReplyData
+	milterNoReplyUnknown
+	milterNoReplyEOH
+	milterNoReplyBody
+
+	// milterProtocol is a set of protocol flags supported by postmoogle
+	milterProtocol = milterNoConnect | milterNoHelo | milterNoMail | milterNoRcpt | milterNoBody | milterNoHeaders | milterNoEOH |
+		milterNoReplyHeader | milterNoUnknown | milterNoData | milterSkip |
+		milterNoReplyConnect | milterNoReplyHelo | milterNoReplyMail | milterNoReplyRcpt | milterNoReplyData | milterNoReplyUnknown |
+		milterNoReplyEOH | milterNoReplyBody
+)
+
+var (
+	// ErrMilterReject returned when email is rejected by a milter
+	ErrMilterReject = &smtp.SMTPError{
+		Code:         PolicyCode,
+		EnhancedCode: PolicyEnhancedCode,
+		Message:      "rejected by the mail filter, kupo.",
+	}
+	// ErrMilterTempFailure returned when email is temporary rejected by a milter or milter is not available
+	ErrMilterTempFailure = &smtp.SMTPError{
+		Code:         TempFailureCode,
+		EnhancedCode: TempFailureEnhancedCode,
+		Message:      "mail filter cannot accept email right now, try again a bit later, kupo.",
+	}
+	// ErrMilterProtocol returned when milter violates the protocol
+	ErrMilterProtocol = errors.New("milter protocol error")
+)
+
+// MilterConfig of the milters chain
+type MilterConfig struct {
+	// Addresses of milters, e.g.: inet:localhost:8891, unix:/run/opendkim/opendkim.sock
+	Addresses []string
+	// Action on milter failure: accept, tempfail or reject
+	Action string
+	// Timeout of a single milter command
+	Timeout time.Duration
+}
+
+// milters is a chain of milters, used within one SMTP transaction
+type milters struct {
+	cfg    MilterConfig
+	log    *zerolog.Logger
+	domain string
+	conns  []*milterConn
+
+	// results of the end of body stage
+	discard    bool
+	quarantine string
+	mods       []*milterMod
+}
+
+// milterMod is a header modification requested by milter
+type milterMod struct {
+	action byte
+	index  int
+	name   string
+	value  string
+}
+
+// newMilters creates milters chain, returns nil if there are no milters configured
+func newMilters(cfg MilterConfig, domain string, log *zerolog.Logger) *milters {
+	if len(cfg.Addresses) == 0 {
+		return nil
+	}
+	return &milters{cfg: cfg, domain: domain, log: log}
+}
+
+// Mail starts new transaction: connects to milters and sends connection info, HELO and MAIL FROM
+func (ms *milters) Mail(addr net.Addr, helo, from string) error {
+	ms.Close()
+	for _, address := range ms.cfg.Addresses {
+		conn, err := dialMilter(address, ms.cfg.Timeout)
+		if err != nil {
+			if ferr := ms.failure(address, err); ferr != nil {
+				ms.Close()
+				return ferr
+			}
+			continue
+		}
+		ms.conns = append(ms.conns, conn)
+	}
+
+	return ms.each(func(conn *milterConn) (*milterResponse, error) {
+		macros := map[string]string{"j": ms.domain, "{daemon_name}": "postmoogle", "_": addr.String()}
+		if err := conn.macros(milterConnect, macros); err != nil {
+			return nil, err
+		}
+		resp, err := conn.command(milterConnect, milterNoConnect, milterNoReplyConnect, connectData(addr)...)
+		if err != nil || resp.code != milterRespContinue {
+			return resp, err
+		}
+		resp, err = conn.command(milterHelo, milterNoHelo, milterNoReplyHelo, cstring(helo))
+		if err != nil || resp.code != milterRespContinue {
+			return resp, err
+		}
+		if err = conn.macros(milterMail, map[string]string{"{mail_addr}": from}); err != nil {
+			return nil, err
+		}
+		return conn.command(milterMail, milterNoMail, milterNoReplyMail, cstring("<"+from+">"))
+	})
+}
+
+// Rcpt sends RCPT TO
+func (ms *milters) Rcpt(to string) error {
+	return ms.each(func(conn *milterConn) (*milterResponse, error) {
+		if err := conn.macros(milterRcpt, map[string]string{"{rcpt_addr}": to}); err != nil {
+			return nil, err
+		}
+		return conn.command(milterRcpt, milterNoRcpt, milterNoReplyRcpt, cstring("<"+to+">"))
+	})
+}
+
+// Data sends headers and body of the spooled email and collects modifications
+func (ms *milters) Data(spool *spoolFile, queueID string) error {
+	return ms.each(func(conn *milterConn) (*milterResponse, error) {
+		if err := conn.macros(milterData, map[string]string{"i": queueID}); err != nil {
+			return nil, err
+		}
+		resp, err := conn.command(milterData, milterNoData, milterNoReplyData)
+		if err != nil || resp.code != milterRespContinue {
+			return resp, err
+		}
+
+		reader := bufio.NewReader(spool.Reader())
+		fields, _, err := email.ReadHeader(reader)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			name, value := splitHeader(field)
+			resp, err = conn.command(milterHeader, milterNoHeaders, milterNoReplyHeader, cstring(name), cstring(value))
+			if err != nil || resp.code != milterRespContinue {
+				return resp, err
+			}
+		}
+		resp, err = conn.command(milterEOH, milterNoEOH, milterNoReplyEOH)
+		if err != nil || resp.code != milterRespContinue {
+			return resp, err
+		}
+		if resp, err = ms.body(conn, reader); err != nil || (resp.code != milterRespContinue && resp.code != milterRespSkip) {
+			return resp, err
+		}
+
+		return ms.eob(conn)
+	})
+}
+
+// body sends email body in chunks, converting line endings to CRLF
+func (ms *milters) body(conn *milterConn, reader *bufio.Reader) (*milterResponse, error) {
+	resp := &milterResponse{code: milterRespContinue}
+	if conn.protocol&milterNoBody != 0 {
+		return resp, nil
+	}
+	var chunk []byte
+	send := func(data []byte) error {
+		var err error
+		resp, err = conn.command(milterBody, milterNoBody, milterNoReplyBody, data)
+		return err
+	}
+	for {
+		line, rerr := reader.ReadBytes('\n')
+		if bytes.HasSuffix(line, []byte("\n")) && !bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-1], '\r', '\n')
+		}
+		chunk = append(chunk, line...)
+		for len(chunk) >= milterChunk || (rerr != nil && len(chunk) > 0) {
+			size := len(chunk)
+			if size > milterChunk {
+				size = milterChunk
+			}
+			if err := send(chunk[:size]); err != nil {
+				return nil, err
+			}
+			chunk = chunk[size:]
+			if resp.code != milterRespContinue {
+				return resp, nil
+			}
+		}
+		if rerr == io.EOF {
+			return resp, nil
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+}
+
+// eob sends end of body and collects modifications until the final response
+func (ms *milters) eob(conn *milterConn) (*milterResponse, error) {
+	if err := conn.send(milterEOB); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := conn.read()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.code {
+		case milterRespAddHeader, milterRespInsHeader, milterRespChgHeader:
+			mod, err := parseMilterMod(resp)
+			if err != nil {
+				return nil, err
+			}
+			ms.mods = append(ms.mods, mod)
+		case milterRespQuarantine:
+			ms.quarantine = strings.TrimRight(string(resp.data), "\x00")
+		default:
+			return resp, nil
+		}
+	}
+}
+
+// each sends command to each active milter and handles responses
+func (ms *milters) each(command func(*milterConn) (*milterResponse, error)) error {
+	for _, conn := range ms.conns {
+		if ms.discard {
+			return nil
+		}
+		if conn.done {
+			continue
+		}
+		resp, err := command(conn)
+		if err != nil {
+			conn.done = true
+			if ferr := ms.failure(conn.addr, err); ferr != nil {
+				return ferr
+			}
+			continue
+		}
+
+		switch resp.code {
+		case milterRespContinue, milterRespSkip:
+		case milterRespAccept:
+			conn.done = true
+		case milterRespDiscard:
+			ms.log.Info().Str("milter", conn.addr).Msg("email discarded by milter")
+			ms.discard = true
+			return nil
+		case milterRespReject:
+			ms.log.Info().Str("milter", conn.addr).Msg("email rejected by milter")
+			return ErrMilterReject
+		case milterRespTempfail:
+			ms.log.Info().Str("milter", conn.addr).Msg("email temporary rejected by milter")
+			return ErrMilterTempFailure
+		case milterRespReplycode:
+			ms.log.Info().Str("milter", conn.addr).Str("reply", string(resp.data)).Msg("email rejected by milter")
+			return parseMilterReply(resp.data)
+		default:
+			conn.done = true
+			if ferr := ms.failure(conn.addr, fmt.Errorf("%w: unexpected response %q", ErrMilterProtocol, resp.code)); ferr != nil {
+				return ferr
+			}
+		}
+	}
+	return nil
+}
+
+// failure handles milter failure according to the configured action
+func (ms *milters) failure(addr string, err error) error {
+	ms.log.Error().Err(err).Str("milter", addr).Str("action", ms.cfg.Action).Msg("milter failed")
+	switch ms.cfg.Action {
+	case MilterAccept:
+		return nil
+	case MilterReject:
+		return ErrMilterReject
+	default:
+		return ErrMilterTempFailure
+	}
+}
+
+// Discard returns true if email should be accepted, but dropped silently
+func (ms *milters) Discard() bool {
+	return ms.discard
+}
+
+// Quarantine returns quarantine reason requested by milters
+func (ms *milters) Quarantine() string {
+	return ms.quarantine
+}
+
+// Rewrite applies header modifications to the header fields
+func (ms *milters) Rewrite(fields []string) []string {
+	for _, mod := range ms.mods {
+		field := mod.name + ": " + mod.value + "\r\n"
+		switch mod.action {
+		case milterRespAddHeader:
+			fields = append(fields, field)
+		case milterRespInsHeader:
+			index := mod.index
+			if index > len(fields) {
+				index = len(fields)
+			}
+			fields = append(fields[:index], append([]string{field}, fields[index:]...)...)
+		case milterRespChgHeader:
+			fields = changeHeader(fields, mod, field)
+		}
+	}
+	return fields
+}
+
+// Modified returns true if milters requested header modifications
+func (ms *milters) Modified() bool {
+	return len(ms.mods) > 0
+}
+
+// Close aborts current transaction and closes milter connections
+func (ms *milters) Close() {
+	for _, conn := range ms.conns {
+		conn.close()
+	}
+	ms.conns = nil
+	ms.discard = false
+	ms.quarantine = ""
+	ms.mods = nil
+}
+
+// changeHeader changes (or deletes, if value is empty) N-th occurrence of the header
+func changeHeader(fields []string, mod *milterMod, field string) []string {
+	var occurrence int
+	for i, existing := range fields {
+		name, _ := splitHeader(existing)
+		if !strings.EqualFold(name, mod.name) {
+			continue
+		}
+		occurrence++
+		if occurrence != mod.index {
+			continue
+		}
+		if mod.value == "" {
+			return append(fields[:i], fields[i+1:]...)
+		}
+		fields[i] = field
+		return fields
+	}
+	if mod.value != "" {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// milterConn is a connection to a single milter
+type milterConn struct {
+	addr     string
+	conn     net.Conn
+	reader   *bufio.Reader
+	timeout  time.Duration
+	protocol uint32
+	done     bool
+}
+
+type milterResponse struct {
+	code byte
+	data []byte
+}
+
+// dialMilter connects to the milter and negotiates options
+func dialMilter(addr string, timeout time.Duration) (*milterConn, error) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid address %q", ErrMilterProtocol, addr)
+	}
+	if network == "inet" || network == "inet6" {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &milterConn{addr: addr, conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	if err := mc.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+func (mc *milterConn) negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActionAddHeaders|milterActionChgHeaders|milterActionQuarantine)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+	if err := mc.send(milterOptneg, data); err != nil {
+		return err
+	}
+	resp, err := mc.read()
+	if err != nil {
+		return err
+	}
+	if resp.code != milterOptneg || len(resp.data) < 12 {
+		return fmt.Errorf("%w: invalid options negotiation response", ErrMilterProtocol)
+	}
+	if version := binary.BigEndian.Uint32(resp.data[0:]); version < 2 || version > milterVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrMilterProtocol, version)
+	}
+	mc.protocol = binary.BigEndian.Uint32(resp.data[8:]) & milterProtocol
+	return nil
+}
+
+// command sends the command (unless milter asked to skip it) and reads the response (unless milter doesn't reply to it)
+func (mc *milterConn) command(code byte, skipFlag, noReplyFlag uint32, data ...[]byte) (*milterResponse, error) {
+	if mc.protocol&skipFlag != 0 {
+		return &milterResponse{code: milterRespContinue}, nil
+	}
+	if err := mc.send(code, data...); err != nil {
+		return nil, err
+	}
+	if mc.protocol&noReplyFlag != 0 {
+		return &milterResponse{code: milterRespContinue}, nil
+	}
+	for {
+		resp, err := mc.read()
+		if err != nil || resp.code != milterRespProgress {
+			return resp, err
+		}
+	}
+}
+
+// macros sends macros of the next command
+func (mc *milterConn) macros(code byte, macros map[string]string) error {
+	data := [][]byte{{code}}
+	for name, value := range macros {
+		data = append(data, cstring(name), cstring(value))
+	}
+	return mc.send(milterMacro, data...)
+}
+
+func (mc *milterConn) send(code byte, data ...[]byte) error {
+	size := 1
+	for _, part := range data {
+		size += len(part)
+	}
+	packet := make([]byte, 5, 4+size)
+	binary.BigEndian.PutUint32(packet, uint32(size))
+	packet[4] = code
+	for _, part := range data {
+		packet = append(packet, part...)
+	}
+
+	mc.conn.SetDeadline(time.Now().Add(mc.timeout)) //nolint:errcheck // the write will fail anyway
+	_, err := mc.conn.Write(packet)
+	return err
+}
+
+func (mc *milterConn) read() (*milterResponse, error) {
+	mc.conn.SetDeadline(time.Now().Add(mc.timeout)) //nolint:errcheck // the read will fail anyway
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(mc.reader, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || size > milterMaxReply {
+		return nil, fmt.Errorf("%w: invalid packet size %d", ErrMilterProtocol, size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(mc.reader, packet); err != nil {
+		return nil, err
+	}
+	return &milterResponse{code: packet[0], data: packet[1:]}, nil
+}
+
+func (mc *milterConn) close() {
+	if !mc.done {
+		mc.send(milterAbort) //nolint:errcheck // connection is closing anyway
+	}
+	mc.send(milterQuit) //nolint:errcheck // connection is closing anyway
+	mc.conn.Close()
+}
+
+// connectData returns data of the connect command
+func connectData(addr net.Addr) [][]byte {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return [][]byte{cstring(addr.String()), {'U'}}
+	}
+	family := byte('4')
+	if tcpAddr.IP.To4() == nil {
+		family = '6'
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(tcpAddr.Port))
+	return [][]byte{cstring("[" + tcpAddr.IP.String() + "]"), {family}, port, cstring(tcpAddr.IP.String())}
+}
+
+func parseMilterMod(resp *milterResponse) (*milterMod, error) {
+	mod := &milterMod{action: resp.code}
+	data := resp.data
+	if resp.code != milterRespAddHeader {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: invalid header modification", ErrMilterProtocol)
+		}
+		mod.index = int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	}
+	parts := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	if len(parts) < 1 || parts[0] == "" {
+		return nil, fmt.Errorf("%w: invalid header modification", ErrMilterProtocol)
+	}
+	mod.name = parts[0]
+	if len(parts) > 1 {
+		mod.value = strings.TrimLeft(parts[1], " ")
+	}
+	return mod, nil
+}
+
+// parseMilterReply parses custom SMTP reply, e.g.: 550 5.7.1 Command rejected
+func parseMilterReply(data []byte) error {
+	reply := strings.TrimRight(string(data), "\x00")
+	parts := strings.SplitN(reply, " ", 3)
+	code, err := strconv.Atoi(parts[0])
+	if err != nil || code < 400 || code > 599 {
+		return ErrMilterReject
+	}
+
+	smtpErr := &smtp.SMTPError{Code: code, EnhancedCode: PolicyEnhancedCode, Message: strings.Join(parts[1:], " ")}
+	if code < 500 {
+		smtpErr.EnhancedCode = TempFailureEnhancedCode
+	}
+	if len(parts) > 1 {
+		if enhanced, ok := parseEnhancedCode(parts[1]); ok {
+			smtpErr.EnhancedCode = enhanced
+			smtpErr.Message = strings.Join(parts[2:], " ")
+		}
+	}
+	return smtpErr
+}
+
+func parseEnhancedCode(str string) (smtp.EnhancedCode, bool) {
+	parts := strings.Split(str, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, false
+	}
+	var code smtp.EnhancedCode
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return smtp.EnhancedCode{}, false
+		}
+		code[i] = num
+	}
+	return code, true
+}
+
+// cstring returns null-terminated string
+func cstring(str string) []byte {
+	return append([]byte(str), 0)
+}
+
+// splitHeader splits raw header field into name and value (without leading space and trailing CRLF)
+func splitHeader(field string) (name, value string) {
+	name, value, _ = strings.Cut(field, ":")
+	return name, strings.TrimRight(strings.TrimPrefix(value, " "), "\r\n")
+}
@@ -0,0 +1,127 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// stubMilter rejects the rejected@example.org recipient, adds and changes headers at the end of body
+func stubMilter(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reply := func(code byte, data ...[]byte) {
+		packet := append([]byte{code}, bytes.Join(data, nil)...)
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(packet)))
+		conn.Write(append(size, packet...)) //nolint:errcheck // test
+	}
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(size))
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+		switch packet[0] {
+		case milterOptneg:
+			reply(milterOptneg, packet[1:5], packet[5:9], make([]byte, 4))
+		case milterMacro, milterAbort:
+		case milterQuit:
+			return
+		case milterRcpt:
+			if string(packet[1:]) == "<rejected@example.org>\x00" {
+				reply(milterRespReject)
+				continue
+			}
+			reply(milterRespContinue)
+		case milterHeader:
+			if !strings.HasPrefix(string(packet[1:]), "From\x00") && !strings.HasPrefix(string(packet[1:]), "Subject\x00") {
+				t.Errorf("unexpected header %q", packet[1:])
+			}
+			reply(milterRespContinue)
+		case milterEOB:
+			reply(milterRespAddHeader, cstring("X-Milter"), cstring("checked"))
+			reply(milterRespChgHeader, []byte{0, 0, 0, 1}, cstring("Subject"), cstring("[filtered] test"))
+			reply(milterRespAccept)
+		default:
+			reply(milterRespContinue)
+		}
+	}
+}
+
+func TestMilters(t *testing.T) {
+	stub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stub.Close()
+	go func() {
+		for {
+			conn, aerr := stub.Accept()
+			if aerr != nil {
+				return
+			}
+			go stubMilter(t, conn)
+		}
+	}()
+
+	log := zerolog.Nop()
+	ms := newMilters(MilterConfig{Addresses: []string{"inet:" + stub.Addr().String()}, Timeout: time.Second}, "example.org", &log)
+	defer ms.Close()
+	if err = ms.Mail(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, "mx.example.com", "sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ms.Rcpt("rejected@example.org"); !errors.Is(err, ErrMilterReject) {
+		t.Errorf("expected rejection, got %v", err)
+	}
+	if err = ms.Rcpt("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := newSpoolFile(t.TempDir(), strings.NewReader("From: sender@example.com\nSubject: test\n\nhello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if err = ms.Data(spool, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Discard() || !ms.Modified() {
+		t.Fatalf("unexpected state: discard=%t modified=%t", ms.Discard(), ms.Modified())
+	}
+	if err = spool.RewriteHeaders(ms.Rewrite); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := io.ReadAll(spool.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "From: sender@example.com\nSubject: [filtered] test\r\nX-Milter: checked\r\n\nhello\n"
+	if string(rewritten) != expected {
+		t.Errorf("expected %q, got %q", expected, rewritten)
+	}
+}
+
+func TestMiltersFailure(t *testing.T) {
+	log := zerolog.Nop()
+	tests := map[string]error{
+		MilterAccept:   nil,
+		MilterTempfail: ErrMilterTempFailure,
+		MilterReject:   ErrMilterReject,
+	}
+	for action, expected := range tests {
+		ms := newMilters(MilterConfig{Addresses: []string{"unix:/nonexistent/milter.sock"}, Action: action, Timeout: time.Second}, "example.org", &log)
+		if err := ms.Mail(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, "mx.example.com", "sender@example.com"); !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got %v", action, expected, err)
+		}
+	}
+}
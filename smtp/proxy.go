@@ -0,0 +1,182 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is max time to wait for the PROXY protocol header
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength is max length of the PROXY protocol v1 header, including CRLF
+	proxyV1MaxLength = 107
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrProxyHeader returned when connection from trusted proxy doesn't start with valid PROXY protocol header
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyConn is a connection received through PROXY protocol (v1 or v2),
+// with remote and local addresses of the original client connection
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// Read reads data from the connection, including bytes buffered during the PROXY header parsing
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns address of the original client
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr returns address the original client connected to
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// newProxyConn reads PROXY protocol header of the connection
+func newProxyConn(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	pconn := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	signature, err := pconn.r.Peek(len(proxyV1Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV1Signature) {
+		err = pconn.readV1()
+	} else {
+		err = pconn.readV2()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pconn, conn.SetReadDeadline(time.Time{})
+}
+
+// readV1 parses human-readable header, e.g.: PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return ErrProxyHeader
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	parts := strings.Fields(string(line))
+	if len(parts) < 2 {
+		return ErrProxyHeader
+	}
+	switch parts[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+		if len(parts) != 6 {
+			return ErrProxyHeader
+		}
+	default:
+		return ErrProxyHeader
+	}
+
+	remote, err := parseProxyAddr(parts[2], parts[4])
+	if err != nil {
+		return err
+	}
+	local, err := parseProxyAddr(parts[3], parts[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = remote, local
+	return nil
+}
+
+// readV2 parses binary header
+func (c *proxyConn) readV2() error {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return ErrProxyHeader
+	}
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return ErrProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	// LOCAL command (health checks, etc.) - connection is made by the proxy itself
+	if verCmd&0x0F == 0 {
+		return nil
+	}
+	if verCmd&0x0F != 1 {
+		return ErrProxyHeader
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default: // UNSPEC, UDP and unix sockets are not relevant for SMTP
+		return nil
+	}
+	if len(payload) < size*2+4 {
+		return ErrProxyHeader
+	}
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[size*2:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(payload[size : size*2]),
+		Port: int(binary.BigEndian.Uint16(payload[size*2+2:])),
+	}
+	return nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrProxyHeader
+	}
+	portInt, err := strconv.Atoi(port)
+	if err != nil || portInt < 0 || portInt > 65535 {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: portInt}, nil
+}
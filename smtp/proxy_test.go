@@ -0,0 +1,139 @@
+package smtp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// proxyV2 builds binary PROXY protocol header
+func proxyV2(verCmd, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestNewProxyConn(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0, 25}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:], 25)
+
+	tests := map[string]struct {
+		header []byte
+		remote string // empty = proxy address is kept
+		err    bool
+	}{
+		"v1 tcp4":              {header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"), remote: "192.0.2.1:56324"},
+		"v1 tcp6":              {header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n"), remote: "[2001:db8::1]:56324"},
+		"v1 unknown":           {header: []byte("PROXY UNKNOWN\r\n")},
+		"v1 unknown protocol":  {header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n"), err: true},
+		"v1 missing fields":    {header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), err: true},
+		"v1 invalid ip":        {header: []byte("PROXY TCP4 192.0.2.256 198.51.100.1 56324 25\r\n"), err: true},
+		"v1 invalid port":      {header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n"), err: true},
+		"v1 negative port":     {header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 -1 25\r\n"), err: true},
+		"v1 no signature only": {header: []byte("PROXY \r\n"), err: true},
+		"v1 truncated":         {header: []byte("PROXY TCP4 192.0.2.1"), err: true},
+		"v1 too long":          {header: append([]byte("PROXY TCP4 "), make([]byte, proxyV1MaxLength)...), err: true},
+		"v2 tcp4":              {header: proxyV2(0x21, 0x11, ipv4), remote: "192.0.2.1:56324"},
+		"v2 tcp6":              {header: proxyV2(0x21, 0x21, ipv6), remote: "[2001:db8::1]:56324"},
+		"v2 tlvs":              {header: proxyV2(0x21, 0x11, append(ipv4, 0x04, 0, 1, 0)), remote: "192.0.2.1:56324"},
+		"v2 local":             {header: proxyV2(0x20, 0x00, nil)},
+		"v2 unix":              {header: proxyV2(0x21, 0x31, make([]byte, 216))},
+		"v2 short address":     {header: proxyV2(0x21, 0x21, ipv4), err: true},
+		"v2 wrong version":     {header: proxyV2(0x11, 0x11, ipv4), err: true},
+		"v2 unknown command":   {header: proxyV2(0x22, 0x11, ipv4), err: true},
+		"v2 wrong signature":   {header: append([]byte("\r\n\r\n\x00\r\nQUIT\r"), 0x21, 0x11, 0, 0), err: true},
+		"v2 truncated header":  {header: proxyV2(0x21, 0x11, ipv4)[:14], err: true},
+		"v2 truncated payload": {header: proxyV2(0x21, 0x11, ipv4)[:20], err: true},
+		"v2 length overflow":   {header: append(proxyV2(0x21, 0x11, nil)[:14], 0xFF, 0xFF), err: true},
+		"no header":            {header: []byte("EHLO example.com\r\n"), err: true},
+		"empty":                {header: []byte{}, err: true},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(test.header) //nolint:errcheck // the parser may stop reading early
+				// invalid headers are followed by EOF, so the truncated ones are not completed with the data
+				if !test.err {
+					client.Write([]byte("EHLO example.com\r\n")) //nolint:errcheck // checked by the reader
+				}
+				client.Close()
+			}()
+
+			conn, err := newProxyConn(server)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got remote address %s", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := test.remote
+			if remote == "" {
+				remote = server.RemoteAddr().String()
+			}
+			if conn.RemoteAddr().String() != remote {
+				t.Fatalf("expected remote address %s, got %s", remote, conn.RemoteAddr())
+			}
+			// data after the header is not lost
+			data, err := io.ReadAll(conn)
+			if err != nil || string(data) != "EHLO example.com\r\n" {
+				t.Fatalf("expected data after the header, got %q (%v)", data, err)
+			}
+		})
+	}
+}
+
+func TestListenerSlowProxy(t *testing.T) {
+	log := zerolog.Nop()
+	always := func(net.Addr) bool { return true }
+	never := func(net.Addr) bool { return false }
+	listener, err := NewListener("0", nil, never, always, true, nil, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// stuck proxy connection sends nothing
+	stuck, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		aconn, _ := listener.Accept() //nolint:errcheck // checked below
+		accepted <- aconn
+	}()
+	select {
+	case aconn := <-accepted:
+		if aconn == nil || aconn.RemoteAddr().String() != "192.0.2.1:56324" {
+			t.Fatalf("unexpected connection: %v", aconn)
+		}
+		aconn.Close()
+	case <-time.After(proxyHeaderTimeout / 2):
+		t.Fatal("connection is blocked by the stuck proxy connection")
+	}
+}
@@ -0,0 +1,141 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// TLS modes of the relay
+const (
+	// RelayTLSNone - don't use TLS at all
+	RelayTLSNone = "none"
+	// RelayTLSStartTLS - use STARTTLS if the relay supports it (default)
+	RelayTLSStartTLS = "starttls"
+	// RelayTLSRequired - use STARTTLS, fail if the relay doesn't support it
+	RelayTLSRequired = "required"
+	// RelayTLSImplicit - connect over TLS (usually port 465)
+	RelayTLSImplicit = "implicit"
+)
+
+// implicitTLSPort is the default port of relays with implicit TLS
+const implicitTLSPort = "465"
+
+// AUTH mechanisms of the relay
+const (
+	RelayAuthPlain   = "plain"
+	RelayAuthLogin   = "login"
+	RelayAuthCRAMMD5 = "cram-md5"
+)
+
+var (
+	// ErrInvalidRelay returned when relay config is invalid
+	ErrInvalidRelay = errors.New("invalid relay config")
+	// ErrTLSRequired returned when the relay doesn't support STARTTLS, but TLS is required
+	ErrTLSRequired = errors.New("relay does not support STARTTLS, but TLS is required")
+	// ErrInsecureAuth returned when credentials should be sent over unencrypted connection, but that's not allowed
+	ErrInsecureAuth = errors.New("refusing to send credentials over unencrypted connection")
+)
+
+// Validate relay config
+func (r *RelayConfig) Validate() error {
+	switch r.TLS {
+	case "", RelayTLSNone, RelayTLSStartTLS, RelayTLSRequired, RelayTLSImplicit:
+	default:
+		return fmt.Errorf("%w: unsupported TLS mode %q", ErrInvalidRelay, r.TLS)
+	}
+	switch strings.ToLower(r.Auth) {
+	case "", RelayAuthPlain, RelayAuthLogin, RelayAuthCRAMMD5:
+	default:
+		return fmt.Errorf("%w: unsupported AUTH mechanism %q", ErrInvalidRelay, r.Auth)
+	}
+	if r.CA != "" {
+		if _, err := loadCA(r.CA); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRelay, err) //nolint:errorlint // ErrInvalidRelay is the one to match
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns TLS config to connect to the relay
+func (r *RelayConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: r.Host} //nolint:gosec // it's smtp, even that is too strict sometimes
+	if r.CA != "" {
+		pool, err := loadCA(r.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// auth returns AUTH mechanism of the relay
+func (r *RelayConfig) auth() smtp.Auth {
+	switch strings.ToLower(r.Auth) {
+	case RelayAuthLogin:
+		return &loginAuth{username: r.Usename, password: r.Password}
+	case RelayAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(r.Usename, r.Password)
+	default:
+		return &plainAuth{username: r.Usename, password: r.Password}
+	}
+}
+
+// loadCA reads CA bundle (PEM)
+func loadCA(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// plainAuth is smtp.PlainAuth without the TLS check, because it's done by the client with respect of InsecureAuth
+type plainAuth struct {
+	username string
+	password string
+}
+
+func (a *plainAuth) Start(_ *smtp.ServerInfo) (proto string, toServer []byte, err error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+// loginAuth implements non-standard, but widely used LOGIN mechanism
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(_ *smtp.ServerInfo) (proto string, toServer []byte, err error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %q", fromServer)
+	}
+}
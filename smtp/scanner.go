@@ -0,0 +1,284 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// supported scanner types
+const (
+	ScannerRspamd = "rspamd"
+	ScannerSpamd  = "spamd"
+)
+
+const (
+	// scannerGreylistDelay is min time between the greylisted attempt and the retry that will be accepted
+	scannerGreylistDelay = time.Minute
+	// scannerGreylistTTL is how long the greylisted attempts are remembered
+	scannerGreylistTTL = 24 * time.Hour
+)
+
+// ErrScanner returned when the external spam scanner cannot scan email
+var ErrScanner = errors.New("spam scanner failure")
+
+// ScannerConfig of the external spam scanner
+type ScannerConfig struct {
+	// Type of the scanner, rspamd or spamd, empty = disabled
+	Type string
+	// Address of the scanner, URL of rspamd worker (http://localhost:11333) or host:port of spamd (localhost:783)
+	Address string
+	// Password of rspamd, optional
+	Password string
+	// Timeout of a single scan
+	Timeout time.Duration
+	// Greylist is min score to greylist email, 0 = rely on the scanner's action
+	Greylist float64
+	// Reject is min score to reject email, 0 = rely on the scanner's action
+	Reject float64
+}
+
+// scanRequest is an email with its SMTP envelope
+type scanRequest struct {
+	ip    net.IP
+	helo  string
+	from  string
+	rcpts []string
+	data  *io.SectionReader
+}
+
+type scanClient interface {
+	scan(ctx context.Context, req *scanRequest) (*email.ScanResult, error)
+}
+
+// scanner checks incoming emails with the external spam scanner
+type scanner struct {
+	cfg    ScannerConfig
+	client scanClient
+
+	mu       sync.Mutex
+	attempts map[string]time.Time
+	cleaned  time.Time
+	delay    time.Duration
+}
+
+// newScanner creates new scanner, returns nil if scanner is disabled
+func newScanner(cfg ScannerConfig, log *zerolog.Logger) *scanner {
+	var client scanClient
+	switch cfg.Type {
+	case "":
+		return nil
+	case ScannerRspamd:
+		client = &rspamdClient{url: strings.TrimSuffix(cfg.Address, "/"), password: cfg.Password, http: &http.Client{}}
+	case ScannerSpamd:
+		client = &spamdClient{addr: cfg.Address}
+	default:
+		log.Error().Str("type", cfg.Type).Msg("unsupported spam scanner, scanning is disabled")
+		return nil
+	}
+
+	return &scanner{cfg: cfg, client: client, attempts: map[string]time.Time{}, delay: scannerGreylistDelay}
+}
+
+// Scan email, the result's action respects configured score thresholds
+func (s *scanner) Scan(ctx context.Context, req *scanRequest) (*email.ScanResult, error) {
+	if s.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+	}
+	result, err := s.client.scan(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.cfg.Reject > 0 && result.Score >= s.cfg.Reject:
+		result.Action = email.ScanReject
+	case s.cfg.Greylist > 0 && result.Score >= s.cfg.Greylist && result.Action != email.ScanReject:
+		result.Action = email.ScanGreylist
+	}
+	return result, nil
+}
+
+// Greylisted remembers the greylisted attempt and returns false when the same email is retried after the delay
+func (s *scanner) Greylisted(req *scanRequest) bool {
+	rcpts := append([]string{}, req.rcpts...)
+	sort.Strings(rcpts)
+	key := req.ip.String() + " " + req.from + " " + strings.Join(rcpts, ",")
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.cleaned) > scannerGreylistDelay {
+		for k, attemptedAt := range s.attempts {
+			if now.Sub(attemptedAt) > scannerGreylistTTL {
+				delete(s.attempts, k)
+			}
+		}
+		s.cleaned = now
+	}
+
+	attemptedAt, ok := s.attempts[key]
+	if !ok || now.Sub(attemptedAt) > scannerGreylistTTL {
+		s.attempts[key] = now
+		return true
+	}
+	if now.Sub(attemptedAt) < s.delay {
+		return true
+	}
+	delete(s.attempts, key)
+	return false
+}
+
+// rspamdClient uses rspamd HTTP protocol, see https://rspamd.com/doc/developers/protocol.html
+type rspamdClient struct {
+	url      string
+	password string
+	http     *http.Client
+}
+
+type rspamdResponse struct {
+	Score   float64                    `json:"score"`
+	Action  string                     `json:"action"`
+	Symbols map[string]json.RawMessage `json:"symbols"`
+}
+
+func (c *rspamdClient) scan(ctx context.Context, req *scanRequest) (*email.ScanResult, error) {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/checkv2", req.data)
+	if err != nil {
+		return nil, err
+	}
+	hreq.ContentLength = req.data.Size()
+	if req.ip != nil {
+		hreq.Header.Set("IP", req.ip.String())
+	}
+	hreq.Header.Set("Helo", req.helo)
+	hreq.Header.Set("From", req.from)
+	for _, rcpt := range req.rcpts {
+		hreq.Header.Add("Rcpt", rcpt)
+	}
+	if c.password != "" {
+		hreq.Header.Set("Password", c.password)
+	}
+
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: rspamd returned %s", ErrScanner, resp.Status)
+	}
+
+	var data rspamdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Action == "" {
+		return nil, fmt.Errorf("%w: rspamd returned no action", ErrScanner)
+	}
+	symbols := make([]string, 0, len(data.Symbols))
+	for name := range data.Symbols {
+		symbols = append(symbols, name)
+	}
+	sort.Strings(symbols)
+
+	return &email.ScanResult{Score: data.Score, Action: data.Action, Symbols: symbols}, nil
+}
+
+// spamdClient uses SpamAssassin's spamd protocol
+type spamdClient struct {
+	addr string
+}
+
+func (c *spamdClient) scan(ctx context.Context, req *scanRequest) (*email.ScanResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) //nolint:errcheck // the next read/write will fail anyway
+	}
+
+	if _, err = fmt.Fprintf(conn, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n\r\n", req.data.Size()); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(conn, req.data); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if parts := strings.Fields(status); len(parts) < 3 || parts[1] != "0" {
+		return nil, fmt.Errorf("%w: spamd returned %q", ErrScanner, strings.TrimSpace(status))
+	}
+
+	var result *email.ScanResult
+	for {
+		line, rerr := reader.ReadString('\n')
+		if rerr != nil {
+			return nil, rerr
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Spam") {
+			result = parseSpamdHeader(value)
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("%w: spamd returned no result", ErrScanner)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			result.Symbols = append(result.Symbols, symbol)
+		}
+	}
+	return result, nil
+}
+
+// parseSpamdHeader parses spamd's Spam header value, e.g.: True ; 15.3 / 5.0
+func parseSpamdHeader(value string) *email.ScanResult {
+	spam, scores, ok := strings.Cut(value, ";")
+	if !ok {
+		return nil
+	}
+	score, _, _ := strings.Cut(scores, "/")
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(score), 64)
+	if err != nil {
+		return nil
+	}
+
+	result := &email.ScanResult{Score: parsed, Action: email.ScanNoAction}
+	if strings.EqualFold(strings.TrimSpace(spam), "true") || strings.EqualFold(strings.TrimSpace(spam), "yes") {
+		result.Action = email.ScanAddHeader
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+const testScanEmail = "From: sender@example.com\r\nSubject: test\r\n\r\nhello\r\n"
+
+func testScanRequest() *scanRequest {
+	return &scanRequest{
+		ip:    net.ParseIP("192.0.2.1"),
+		helo:  "mx.example.com",
+		from:  "sender@example.com",
+		rcpts: []string{"test@example.org"},
+		data:  io.NewSectionReader(strings.NewReader(testScanEmail), 0, int64(len(testScanEmail))),
+	}
+}
+
+func TestScannerRspamd(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body) //nolint:errcheck // test
+		if r.URL.Path != "/checkv2" || r.Header.Get("IP") != "192.0.2.1" || r.Header.Get("Rcpt") != "test@example.org" || string(body) != testScanEmail {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"score": 7.5, "required_score": 15, "action": "add header", "symbols": {"MISSING_DATE": {"score": 1}, "BAYES_SPAM": {"score": 6.5}}}`) //nolint:errcheck // test
+	}))
+	defer stub.Close()
+
+	log := zerolog.Nop()
+	tests := []struct {
+		cfg    ScannerConfig
+		action string
+	}{
+		{cfg: ScannerConfig{}, action: email.ScanAddHeader},
+		{cfg: ScannerConfig{Greylist: 5}, action: email.ScanGreylist},
+		{cfg: ScannerConfig{Greylist: 5, Reject: 7}, action: email.ScanReject},
+		{cfg: ScannerConfig{Reject: 10}, action: email.ScanAddHeader},
+	}
+	for _, test := range tests {
+		test.cfg.Type = ScannerRspamd
+		test.cfg.Address = stub.URL + "/"
+		test.cfg.Timeout = time.Second
+		result, err := newScanner(test.cfg, &log).Scan(context.Background(), testScanRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Score != 7.5 || result.Action != test.action || strings.Join(result.Symbols, ",") != "BAYES_SPAM,MISSING_DATE" {
+			t.Errorf("%+v: unexpected result %+v", test.cfg, result)
+		}
+	}
+}
+
+func TestScannerSpamd(t *testing.T) {
+	stub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stub.Close()
+	go func() {
+		conn, aerr := stub.Accept()
+		if aerr != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var size int
+		for {
+			line, _ := reader.ReadString('\n') //nolint:errcheck // test
+			if line = strings.TrimSpace(line); line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "Content-length: ") {
+				size, _ = strconv.Atoi(strings.TrimPrefix(line, "Content-length: ")) //nolint:errcheck // test
+			}
+		}
+		io.CopyN(io.Discard, reader, int64(size)) //nolint:errcheck // test
+		response := "SPAMD/1.1 0 EX_OK\r\nContent-length: 24\r\nSpam: True ; 15.3 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK\r\n"
+		io.WriteString(conn, response) //nolint:errcheck // test
+	}()
+
+	log := zerolog.Nop()
+	cfg := ScannerConfig{Type: ScannerSpamd, Address: stub.Addr().String(), Timeout: time.Second}
+	result, err := newScanner(cfg, &log).Scan(context.Background(), testScanRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Score != 15.3 || result.Action != email.ScanAddHeader || strings.Join(result.Symbols, ",") != "BAYES_99,URIBL_BLACK" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if parsed := result.String(); parsed != "score=15.30; action=add header; symbols=BAYES_99,URIBL_BLACK" {
+		t.Errorf("unexpected header %q", parsed)
+	}
+}
+
+func TestScannerGreylisted(t *testing.T) {
+	log := zerolog.Nop()
+	s := newScanner(ScannerConfig{Type: ScannerSpamd}, &log)
+	req := testScanRequest()
+	other := testScanRequest()
+	other.from = "other@example.com"
+
+	if !s.Greylisted(req) {
+		t.Fatal("first attempt is not greylisted")
+	}
+	if !s.Greylisted(req) {
+		t.Fatal("retry before the delay is not greylisted")
+	}
+
+	s.delay = 0
+	if !s.Greylisted(other) {
+		t.Fatal("first attempt of another sender is not greylisted")
+	}
+	if s.Greylisted(req) {
+		t.Fatal("retry after the delay is greylisted")
+	}
+	if !s.Greylisted(req) {
+		t.Fatal("accepted attempt is remembered")
+	}
+}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"context"
+	"net"
 
 	"github.com/emersion/go-smtp"
 	"github.com/getsentry/sentry-go"
@@ -15,6 +16,14 @@ const (
 	NoUserCode = 550
 	// BannedCode SMTP code
 	BannedCode = 554
+	// TempFailureCode SMTP code
+	TempFailureCode = 451
+	// PolicyCode SMTP code
+	PolicyCode = 550
+	// LimitCode SMTP code
+	LimitCode = 421
+	// TooManyRcptsCode SMTP code
+	TooManyRcptsCode = 452
 )
 
 var (
@@ -22,6 +31,14 @@ var (
 	NoUserEnhancedCode = smtp.EnhancedCode{5, 5, 0}
 	// BannedEnhancedCode enhanced SMTP code
 	BannedEnhancedCode = smtp.EnhancedCode{5, 5, 4}
+	// TempFailureEnhancedCode enhanced SMTP code
+	TempFailureEnhancedCode = smtp.EnhancedCode{4, 3, 0}
+	// PolicyEnhancedCode enhanced SMTP code
+	PolicyEnhancedCode = smtp.EnhancedCode{5, 7, 1}
+	// LimitEnhancedCode enhanced SMTP code
+	LimitEnhancedCode = smtp.EnhancedCode{4, 7, 0}
+	// TooManyRcptsEnhancedCode enhanced SMTP code
+	TooManyRcptsEnhancedCode = smtp.EnhancedCode{4, 5, 3}
 	// ErrBanned returned to banned hosts
 	ErrBanned = &smtp.SMTPError{
 		Code:         BannedCode,
@@ -34,13 +51,59 @@ var (
 		EnhancedCode: NoUserEnhancedCode,
 		Message:      "no such user here, kupo.",
 	}
+	// ErrDMARC returned when email is rejected by the DMARC policy of the sender's domain
+	ErrDMARC = &smtp.SMTPError{
+		Code:         PolicyCode,
+		EnhancedCode: PolicyEnhancedCode,
+		Message:      "rejected by the DMARC policy of the sender's domain, kupo.",
+	}
+	// ErrLimit returned when host exceeds connection or message limits
+	ErrLimit = &smtp.SMTPError{
+		Code:         LimitCode,
+		EnhancedCode: LimitEnhancedCode,
+		Message:      "too many connections or messages, try again a bit later, kupo.",
+	}
+	// ErrTooManyRcpts returned to recipients of another room, they should be sent in a separate transaction
+	ErrTooManyRcpts = &smtp.SMTPError{
+		Code:         TooManyRcptsCode,
+		EnhancedCode: TooManyRcptsEnhancedCode,
+		Message:      "too many recipients, send the rest in a separate transaction, kupo.",
+	}
+	// ErrDNSBL returned when sender's IP address is listed in DNS blocklists
+	ErrDNSBL = &smtp.SMTPError{
+		Code:         PolicyCode,
+		EnhancedCode: PolicyEnhancedCode,
+		Message:      "your IP address is listed in DNS blocklists, kupo.",
+	}
+	// ErrSpam returned when email is classified as spam by the recipient's room
+	ErrSpam = &smtp.SMTPError{
+		Code:         PolicyCode,
+		EnhancedCode: PolicyEnhancedCode,
+		Message:      "your email looks like spam, kupo.",
+	}
+	// ErrTempFailure returned when email cannot be accepted right now
+	ErrTempFailure = &smtp.SMTPError{
+		Code:         TempFailureCode,
+		EnhancedCode: TempFailureEnhancedCode,
+		Message:      "cannot accept email right now, try again a bit later, kupo.",
+	}
 )
 
 type mailServer struct {
-	bot     matrixbot
-	log     *zerolog.Logger
-	domains []string
-	sender  MailSender
+	bot        matrixbot
+	log        *zerolog.Logger
+	domains    []string
+	spool      string
+	inbox      Inbox
+	resolver   Resolver
+	arcTrusted []string
+	sender     MailSender
+	limiter    *limiter
+	dnsbl      *dnsbl
+	scanner    *scanner
+	milters    MilterConfig
+
+	maxMessages int
 }
 
 // Login used for outgoing mail submissions only (when you use postmoogle as smtp server in your scripts)
@@ -65,8 +128,11 @@ func (m *mailServer) Login(state *smtp.ConnectionState, username, password strin
 
 	return &outgoingSession{
 		ctx:       sentry.SetHubOnContext(context.Background(), sentry.CurrentHub().Clone()),
-		sendmail:  m.sender.Send,
+		submit:    m.bot.SubmitEmail,
+		submitted: m.bot.SubmittedEmail,
+		bounce:    m.bot.BounceEmail,
 		privkey:   m.bot.GetDKIMprivkey(),
+		resolver:  m.resolver,
 		from:      username,
 		log:       m.log,
 		domains:   m.domains,
@@ -83,22 +149,38 @@ func (m *mailServer) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session,
 		return nil, ErrBanned
 	}
 
+	return m.newIncomingSession(state), nil
+}
+
+// newIncomingSession creates new incoming session with all checks enabled
+func (m *mailServer) newIncomingSession(state *smtp.ConnectionState) *incomingSession {
 	return &incomingSession{
-		ctx:          sentry.SetHubOnContext(context.Background(), sentry.CurrentHub().Clone()),
-		getRoomID:    m.bot.GetMapping,
-		getFilters:   m.bot.GetIFOptions,
-		receiveEmail: m.ReceiveEmail,
-		ban:          m.bot.BanAuto,
-		greylisted:   m.bot.IsGreylisted,
-		trusted:      m.bot.IsTrusted,
-		log:          m.log,
-		domains:      m.domains,
-		addr:         state.RemoteAddr,
-		tos:          []string{},
-	}, nil
+		ctx:         sentry.SetHubOnContext(context.Background(), sentry.CurrentHub().Clone()),
+		getRoomID:   m.bot.GetMapping,
+		getFilters:  m.bot.GetIFOptions,
+		isSpam:      m.bot.IsSpam,
+		scanner:     m.scanner,
+		milters:     newMilters(m.milters, m.domains[0], m.log),
+		enqueue:     m.inbox.Add,
+		ban:         m.bot.BanAuto,
+		greylisted:  m.bot.IsGreylisted,
+		trusted:     m.bot.IsTrusted,
+		log:         m.log,
+		domains:     m.domains,
+		spool:       m.spool,
+		resolver:    m.resolver,
+		arcTrusted:  m.arcTrusted,
+		violation:   m.limiter.Violation,
+		listed:      m.listedDNSBL,
+		maxMessages: m.maxMessages,
+		helo:        state.Hostname,
+		addr:        state.RemoteAddr,
+		tos:         []string{},
+	}
 }
 
-// ReceiveEmail - incoming mail into matrix room
-func (m *mailServer) ReceiveEmail(ctx context.Context, eml *email.Email) error {
-	return m.bot.IncomingEmail(ctx, eml)
+// listedDNSBL checks if the address is listed in DNS blocklists
+func (m *mailServer) listedDNSBL(ctx context.Context, addr net.Addr) bool {
+	lists, threshold := m.bot.GetDNSBL()
+	return m.dnsbl.Listed(ctx, addr, lists, threshold)
 }
@@ -1,14 +1,18 @@
 package smtp
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"io"
 	"net"
+	"net/mail"
+	"path/filepath"
 	"strconv"
+	"strings"
 
-	"github.com/emersion/go-msgauth/dkim"
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
 	"github.com/emersion/go-smtp"
 	"github.com/getsentry/sentry-go"
 	"github.com/jhillyerd/enmime"
@@ -28,33 +32,77 @@ var (
 	ErrInvalidEmail = errors.New("please, provide valid email address")
 	// GraylistEnhancedCode is GraylistCode in enhanced code notation
 	GraylistEnhancedCode = smtp.EnhancedCode{4, 5, 1}
+	// ErrGreylisted returned to greylisted hosts
+	ErrGreylisted = &smtp.SMTPError{
+		Code:         GraylistCode,
+		EnhancedCode: GraylistEnhancedCode,
+		Message:      "You have been greylisted, try again a bit later.",
+	}
 )
 
+// incomingRcpt is a recipient of the incoming email with its room's settings
+type incomingRcpt struct {
+	to      string
+	roomID  id.RoomID
+	options email.IncomingFilteringOptions
+}
+
 // incomingSession represents an SMTP-submission session receiving emails from remote servers
 type incomingSession struct {
-	log          *zerolog.Logger
-	getRoomID    func(string) (id.RoomID, bool)
-	getFilters   func(id.RoomID) email.IncomingFilteringOptions
-	receiveEmail func(context.Context, *email.Email) error
-	greylisted   func(net.Addr) bool
-	trusted      func(net.Addr) bool
-	ban          func(net.Addr)
-	domains      []string
-	roomID       id.RoomID
-
-	ctx  context.Context //nolint:containedctx // that's session
-	addr net.Addr
-	tos  []string
-	from string
+	log        *zerolog.Logger
+	getRoomID  func(string) (id.RoomID, bool)
+	getFilters func(id.RoomID) email.IncomingFilteringOptions
+	isSpam     func(id.RoomID, *email.Email) bool
+	scanner    *scanner
+	milters    *milters
+	enqueue    func(string, []string, string) error
+	greylisted func(net.Addr) bool
+	trusted    func(net.Addr) bool
+	ban        func(net.Addr)
+	violation  func(net.Addr)
+	listed     func(context.Context, net.Addr) bool
+	resolver   Resolver
+	arcTrusted []string
+	domains    []string
+	spool      string
+	skipAuth   bool
+	lmtp       bool
+	// authservIDs of the MTA in front, in addition to the domains, see forged()
+	authservIDs []string
+
+	ctx   context.Context //nolint:containedctx // that's session
+	addr  net.Addr
+	helo  string
+	tos   []string
+	rcpts []*incomingRcpt
+	from  string
+
+	messages    int
+	maxMessages int
 }
 
 func (s *incomingSession) Mail(from string, opts smtp.MailOptions) error {
 	sentry.GetHubFromContext(s.ctx).Scope().SetTag("from", from)
-	if !email.AddressValid(from) {
+	// null reverse-path is used by delivery status notifications (bounces)
+	if from != "" && !email.AddressValid(from) {
 		s.log.Debug().Str("from", from).Msg("address is invalid")
 		s.ban(s.addr)
 		return ErrBanned
 	}
+	if !s.trusted(s.addr) && s.listed(s.ctx, s.addr) {
+		return ErrDNSBL
+	}
+	if s.maxMessages > 0 && s.messages >= s.maxMessages {
+		s.log.Info().Str("addr", s.addr.String()).Int("messages", s.messages).Msg("messages per session limit exceeded")
+		s.violation(s.addr)
+		return ErrLimit
+	}
+	s.messages++
+	if s.milters != nil {
+		if err := s.milters.Mail(s.addr, s.helo, from); err != nil {
+			return err
+		}
+	}
 	s.from = from
 	s.log.Debug().Str("from", from).Any("options", opts).Msg("incoming mail")
 	return nil
@@ -62,7 +110,6 @@ func (s *incomingSession) Mail(from string, opts smtp.MailOptions) error {
 
 func (s *incomingSession) Rcpt(to string) error {
 	sentry.GetHubFromContext(s.ctx).Scope().SetTag("to", to)
-	s.tos = append(s.tos, to)
 	hostname := utils.Hostname(to)
 	var domainok bool
 	for _, domain := range s.domains {
@@ -76,25 +123,55 @@ func (s *incomingSession) Rcpt(to string) error {
 		return ErrNoUser
 	}
 
-	var ok bool
-	s.roomID, ok = s.getRoomID(utils.Mailbox(to))
+	roomID, ok := s.getRoomID(utils.Mailbox(to))
 	if !ok {
 		s.log.Debug().Str("to", to).Msg("mapping not found")
 		return ErrNoUser
 	}
 
+	// rooms may accept or reject the same email after DATA, but SMTP has a single reply to DATA,
+	// so recipients of other rooms are deferred to a separate transaction. LMTP replies for each recipient
+	if !s.lmtp && len(s.rcpts) > 0 && s.rcpts[0].roomID != roomID {
+		s.log.Debug().Str("to", to).Msg("recipient of another room, deferring it")
+		return ErrTooManyRcpts
+	}
+
+	// SPF is checked after DATA, because trusted ARC chain may relax it.
+	// The real address behind the trusted proxy is known after DATA only, so the sender is validated there
+	options := s.getFilters(roomID)
+	if !s.trusted(s.addr) && !validateIncoming(s.sender(), to, s.addr, s.log, options) {
+		s.ban(s.addr)
+		return ErrBanned
+	}
+	if s.milters != nil {
+		if err := s.milters.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	s.rcpts = append(s.rcpts, &incomingRcpt{to: to, roomID: roomID, options: options})
+	s.tos = append(s.tos, to)
 	s.log.Debug().Str("to", to).Msg("mail")
 	return nil
 }
 
+// sender returns the address to validate, for the null reverse-path of bounces
+// the HELO identity is checked instead, as SPF does (RFC 7208)
+func (s *incomingSession) sender() string {
+	if s.from == "" {
+		return "postmaster@" + s.helo
+	}
+	return s.from
+}
+
 // getAddr gets real address of incoming email serder,
 // including special case of trusted proxy
-func (s *incomingSession) getAddr(envelope *enmime.Envelope) net.Addr {
+func (s *incomingSession) getAddr(header mail.Header) net.Addr {
 	if !s.trusted(s.addr) {
 		return s.addr
 	}
 
-	addrHeader := envelope.GetHeader("X-Real-Addr")
+	addrHeader := header.Get("X-Real-Addr")
 	if addrHeader == "" {
 		return s.addr
 	}
@@ -113,64 +190,270 @@ func (s *incomingSession) getAddr(envelope *enmime.Envelope) net.Addr {
 }
 
 func (s *incomingSession) Data(r io.Reader) error {
-	data, err := io.ReadAll(r)
-	if err != nil {
-		s.log.Error().Err(err).Msg("cannot read DATA")
+	_, err := s.data(r)
+	return err
+}
+
+// LMTPData is the same as Data, but sets status of each recipient
+func (s *incomingSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	results, err := s.data(r)
+	if results == nil {
 		return err
 	}
-	reader := bytes.NewReader(data)
-	parser := enmime.NewParser()
-	envelope, err := parser.ReadEnvelope(reader)
+	for i, rcpt := range s.rcpts {
+		status.SetStatus(rcpt.to, results[i])
+	}
+	return nil
+}
+
+// data spools the email, performs checks for each recipient and enqueues the email for recipients that accepted it.
+// Returns results of the recipients (in the same order as s.rcpts) and error if no recipients accepted the email
+func (s *incomingSession) data(r io.Reader) ([]error, error) {
+	spool, err := newSpoolFile(s.spool, r)
 	if err != nil {
-		return err
+		s.log.Error().Err(err).Msg("cannot spool DATA")
+		return nil, err
 	}
-	addr := s.getAddr(envelope)
-	reader.Seek(0, io.SeekStart) //nolint:errcheck // becase we're sure that's ok
-	validations := s.getFilters(s.roomID)
-	if !validateIncoming(s.from, s.tos[0], addr, s.log, validations) {
-		s.ban(addr)
-		return ErrBanned
+	defer spool.Close()
+
+	msg, err := mail.ReadMessage(spool.Reader())
+	if err != nil {
+		return nil, err
 	}
+	addr := s.getAddr(msg.Header)
 	if s.greylisted(addr) {
-		return &smtp.SMTPError{
-			Code:         GraylistCode,
-			EnhancedCode: GraylistEnhancedCode,
-			Message:      "You have been greylisted, try again a bit later.",
+		return nil, ErrGreylisted
+	}
+	// SPF, DKIM and DMARC checks are relaxed for trusted ARC chains and skipped if they were performed by the MTA in front
+	relaxed := s.skipAuth
+	var auth *authResults
+	var trace []string
+	if !s.skipAuth {
+		auth = checkAuth(s.ctx, s.resolver, spool, msg.Header.Get("From"), s.from, s.helo, addrIP(addr))
+		relaxed = auth.TrustedARC(s.arcTrusted)
+		if relaxed {
+			s.log.Info().Str("sealer", auth.ARC.Domain).Int("instance", auth.ARC.Instance).Msg("trusted ARC chain, SPF, DKIM and DMARC checks are relaxed")
 		}
+		trace = append(trace, "Authentication-Results: "+auth.Header(s.domains[0]))
 	}
-	if validations.SpamcheckDKIM() {
-		results, verr := dkim.Verify(reader)
-		if verr != nil {
-			s.log.Error().Err(verr).Msg("cannot verify DKIM")
-			return verr
+
+	results := make([]error, len(s.rcpts))
+	accepted := []string{}
+	var rejected error
+	var eml *email.Email // parsed only if any recipient's room rejects spam
+	defer func() {
+		if eml != nil {
+			eml.Cleanup()
 		}
-		for _, result := range results {
+	}()
+	for i, rcpt := range s.rcpts {
+		if s.trusted(s.addr) && !validateIncoming(s.sender(), rcpt.to, addr, s.log, rcpt.options) {
+			results[i] = ErrBanned
+		} else {
+			results[i] = s.checkRcpt(rcpt, auth, relaxed, &trace)
+		}
+		if results[i] == nil && rcpt.options.BayesReject() {
+			if eml == nil {
+				if eml, err = email.FromSpool(rcpt.to, spool.Reader(), s.spool); err != nil {
+					s.log.Error().Err(err).Msg("cannot parse email")
+					return nil, ErrTempFailure
+				}
+			}
+			if s.isSpam(rcpt.roomID, eml) {
+				s.log.Info().Str("to", rcpt.to).Msg("email classified as spam")
+				results[i] = ErrSpam
+			}
+		}
+		if results[i] != nil {
+			s.log.Info().Str("to", rcpt.to).Err(results[i]).Msg("email rejected by the recipient's room")
+			if rejected == nil {
+				rejected = results[i]
+			}
+			continue
+		}
+		accepted = append(accepted, rcpt.to)
+	}
+	if len(accepted) == 0 {
+		if errors.Is(rejected, ErrBanned) {
+			s.ban(addr)
+		}
+		return results, rejected
+	}
+	// SMTP cannot reject some recipients after DATA, so the email is not accepted for anybody and the client retries it
+	if !s.lmtp && len(accepted) < len(s.rcpts) {
+		s.log.Warn().Strs("accepted", accepted).Msg("email is rejected for some recipients only, asking to try again")
+		return failAccepted(results, ErrTempFailure)
+	}
+
+	if s.scanner != nil {
+		if err := s.scan(addr, accepted, spool, &trace); err != nil {
+			return failAccepted(results, err)
+		}
+	}
+	if s.milters != nil {
+		if err := s.milters.Data(spool, filepath.Base(spool.Path())); err != nil {
+			return failAccepted(results, err)
+		}
+		if s.milters.Discard() {
+			return results, nil
+		}
+		if s.milters.Modified() {
+			if err := spool.RewriteHeaders(s.milters.Rewrite); err != nil {
+				s.log.Error().Err(err).Msg("cannot apply milters' header modifications")
+				return nil, ErrTempFailure
+			}
+		}
+		if reason := s.milters.Quarantine(); reason != "" {
+			for _, to := range accepted {
+				trace = append(trace, email.QuarantineHeader+": "+email.QuarantineValue(to, "mail filter: "+reason))
+			}
+		}
+	}
+
+	if err := spool.Prepend(trace, s.forged); err != nil {
+		s.log.Error().Err(err).Msg("cannot add trace headers")
+		return nil, ErrTempFailure
+	}
+	if err := spool.Sync(); err != nil {
+		s.log.Error().Err(err).Msg("cannot sync spooled email")
+		return nil, ErrTempFailure
+	}
+	if err := s.enqueue(s.from, accepted, spool.Path()); err != nil {
+		s.log.Error().Err(err).Msg("cannot enqueue email")
+		return nil, ErrTempFailure
+	}
+	spool.Keep()
+	return results, nil
+}
+
+// forged checks if the raw header field of the incoming email cannot be trusted and should be removed:
+// postmoogle's trace headers and Authentication-Results added by anyone but postmoogle
+// (or the MTA in front of it, when the auth checks are skipped on LMTP)
+func (s *incomingSession) forged(field string) bool {
+	if email.Reserved(field) {
+		return true
+	}
+	authservID, ok := email.AuthservID(field)
+	if !ok {
+		return false
+	}
+	if !s.skipAuth { // postmoogle adds its own Authentication-Results
+		return true
+	}
+	for _, trusted := range [][]string{s.domains, s.authservIDs} {
+		for _, trustedID := range trusted {
+			if strings.EqualFold(authservID, trustedID) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// failAccepted sets the error as a result of the recipients that accepted the email
+func failAccepted(results []error, err error) ([]error, error) {
+	for i := range results {
+		if results[i] == nil {
+			results[i] = err
+		}
+	}
+	return results, err
+}
+
+// scan email with the external spam scanner, returns error if email should not be accepted
+func (s *incomingSession) scan(addr net.Addr, rcpts []string, spool *spoolFile, trace *[]string) error {
+	req := &scanRequest{
+		ip:    addrIP(addr),
+		helo:  s.helo,
+		from:  s.from,
+		rcpts: rcpts,
+		data:  spool.Reader(),
+	}
+	result, err := s.scanner.Scan(s.ctx, req)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("cannot scan email, accepting it without scan")
+		return nil
+	}
+
+	s.log.Info().Float64("score", result.Score).Str("action", result.Action).Strs("symbols", result.Symbols).Msg("email scanned")
+	switch result.Action {
+	case email.ScanReject:
+		return ErrSpam
+	case email.ScanGreylist, email.ScanSoftReject:
+		if s.scanner.Greylisted(req) {
+			return ErrGreylisted
+		}
+		s.log.Info().Msg("greylisted email is retried, accepting it")
+	}
+	*trace = append(*trace, email.ScanHeader+": "+result.String())
+	return nil
+}
+
+// checkRcpt performs SPF, DKIM and DMARC checks enabled in the recipient's room
+func (s *incomingSession) checkRcpt(rcpt *incomingRcpt, auth *authResults, relaxed bool, trace *[]string) error {
+	if relaxed {
+		return nil
+	}
+	if rcpt.options.SpamcheckSPF() && auth.SPF == spf.Fail {
+		s.log.Info().Str("from", s.from).Msg("SPF check failed")
+		return ErrBanned
+	}
+	if rcpt.options.SpamcheckDKIM() {
+		if auth.DKIMErr != nil {
+			s.log.Error().Err(auth.DKIMErr).Msg("cannot verify DKIM")
+			return auth.DKIMErr
+		}
+		for _, result := range auth.DKIM {
 			if result.Err != nil {
 				s.log.Info().Str("domain", result.Domain).Err(result.Err).Msg("DKIM verification failed")
 				return result.Err
 			}
 		}
 	}
-
-	eml := email.FromEnvelope(s.tos[0], envelope)
-	for _, to := range s.tos {
-		eml.RcptTo = to
-		err := s.receiveEmail(s.ctx, eml)
-		if err != nil {
-			return err
-		}
+	if !rcpt.options.SpamcheckDMARC() {
+		return nil
+	}
+	if auth.DMARCErr != nil {
+		s.log.Warn().Err(auth.DMARCErr).Msg("cannot evaluate DMARC policy")
+		return ErrTempFailure
+	}
+	if auth.DMARC.Pass {
+		return nil
+	}
+	s.log.Info().Str("domain", auth.DMARC.Domain).Str("policy", string(auth.DMARC.Policy)).Msg("DMARC evaluation failed")
+	switch auth.DMARC.Policy {
+	case dmarc.PolicyReject:
+		return ErrDMARC
+	case dmarc.PolicyQuarantine:
+		*trace = append(*trace, email.QuarantineHeader+": "+email.QuarantineValue(rcpt.to, "DMARC policy of "+auth.DMARC.Domain))
 	}
 	return nil
 }
 
-func (s *incomingSession) Reset()        {}
-func (s *incomingSession) Logout() error { return nil }
+func (s *incomingSession) Reset() {
+	s.from = ""
+	s.tos = []string{}
+	s.rcpts = nil
+	if s.milters != nil {
+		s.milters.Close()
+	}
+}
+
+func (s *incomingSession) Logout() error {
+	if s.milters != nil {
+		s.milters.Close()
+	}
+	return nil
+}
 
 // outgoingSession represents an SMTP-submission session sending emails from external scripts, using postmoogle as SMTP server
 type outgoingSession struct {
 	log       *zerolog.Logger
-	sendmail  func(string, string, string) error
+	submit    func(id.RoomID, string, string, []string, string) (bool, map[string]error)
+	submitted func(id.RoomID, []string, *email.Email)
+	bounce    func(string, string, error, string)
 	privkey   string
+	resolver  Resolver
 	domains   []string
 	getRoomID func(string) (id.RoomID, bool)
 
@@ -218,40 +501,75 @@ func (s *outgoingSession) Rcpt(to string) error {
 	return nil
 }
 
+// Data relays the submitted email as is, with its MIME structure intact, only required headers and signatures are added
 func (s *outgoingSession) Data(r io.Reader) error {
-	parser := enmime.NewParser()
-	envelope, err := parser.ReadEnvelope(r)
+	raw, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	eml := email.FromEnvelope(s.tos[0], envelope)
+	lookupTXT := func(domain string) ([]string, error) {
+		return s.resolver.LookupTXT(s.ctx, domain)
+	}
+	relayed := []authres.Result{&authres.AuthResult{Value: authres.ResultPass, Auth: s.from}}
+	data := email.PrepareSubmission(raw, s.from, s.privkey)
+	data = email.SealARC(data, utils.Hostname(s.from), s.privkey, s.domains[0], relayed, lookupTXT)
+	envelope, err := enmime.ReadEnvelope(strings.NewReader(data))
+	if err != nil {
+		s.log.Warn().Err(err).Msg("cannot parse submitted email, it won't be posted into the room")
+	}
+	var messageID string
+	if envelope != nil {
+		messageID = envelope.GetHeader("Message-Id")
+	}
+
+	// recipients with temporary errors are queued, the sender gets a bounce if they expire
+	_, failed := s.submit(s.fromRoom, messageID, s.from, s.tos, data)
+	var firstErr error
+	sent := make([]string, 0, len(s.tos))
+	undelivered := make([]string, 0, len(failed))
 	for _, to := range s.tos {
-		eml.RcptTo = to
-		err := s.sendmail(eml.From, to, eml.Compose(s.privkey))
-		if err != nil {
-			return err
+		if ferr := failed[to]; ferr != nil {
+			s.log.Warn().Err(ferr).Str("to", to).Msg("cannot send email")
+			if firstErr == nil {
+				firstErr = ferr
+			}
+			undelivered = append(undelivered, to)
+			continue
 		}
+		sent = append(sent, to)
+	}
+	if len(sent) == 0 {
+		return firstErr
+	}
+	// the email is accepted, so the sender gets a bounce for each failed recipient
+	for _, to := range undelivered {
+		s.bounce(s.from, to, failed[to], data)
 	}
 
+	if envelope != nil {
+		s.submitted(s.fromRoom, sent, email.FromEnvelope(sent[0], envelope))
+	}
 	return nil
 }
 func (s *outgoingSession) Reset()        {}
 func (s *outgoingSession) Logout() error { return nil }
 
-func validateIncoming(from, to string, senderAddr net.Addr, log *zerolog.Logger, options email.IncomingFilteringOptions) bool {
-	var sender net.IP
-	switch netaddr := senderAddr.(type) {
-	case *net.TCPAddr:
-		sender = netaddr.IP
-	default:
-		host, _, _ := net.SplitHostPort(senderAddr.String()) //nolint:errcheck // interface constraints
-		sender = net.ParseIP(host)
+// addrIP returns IP address of the net.Addr
+func addrIP(addr net.Addr) net.IP {
+	if netaddr, ok := addr.(*net.TCPAddr); ok {
+		return netaddr.IP
 	}
 
+	host, _, _ := net.SplitHostPort(addr.String()) //nolint:errcheck // interface constraints
+	return net.ParseIP(host)
+}
+
+// validateIncoming checks sender with the room's spamlist, MX and SMTP spamchecks
+func validateIncoming(from, to string, senderAddr net.Addr, log *zerolog.Logger, options email.IncomingFilteringOptions) bool {
+	sender := addrIP(senderAddr)
 	enforce := validator.Enforce{
 		Email: true,
 		MX:    options.SpamcheckMX(),
-		SPF:   options.SpamcheckSPF(),
 		SMTP:  options.SpamcheckSMTP(),
 	}
 	v := validator.New(options.Spamlist(), enforce, to, &validatorLoggerWrapper{log: log})
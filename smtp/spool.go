@@ -0,0 +1,105 @@
+package smtp
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/etke.cc/postmoogle/email"
+)
+
+// spoolFile is a temporary file holding raw email on disk while it's processed
+type spoolFile struct {
+	dir  string
+	fh   *os.File
+	size int64
+	keep bool
+}
+
+// newSpoolFile streams the reader into a new temporary file inside the dir
+func newSpoolFile(dir string, r io.Reader) (*spoolFile, error) {
+	fh, err := os.CreateTemp(dir, "postmoogle-*.eml")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(fh, r)
+	if err != nil {
+		fh.Close()           //nolint:errcheck // the file will be removed anyway
+		os.Remove(fh.Name()) //nolint:errcheck // nothing can be done here
+		return nil, err
+	}
+
+	return &spoolFile{dir: dir, fh: fh, size: size}, nil
+}
+
+// Prepend trace headers to the spooled email, removing header fields matched by the drop func (e.g. forged trace headers)
+func (f *spoolFile) Prepend(headers []string, drop func(field string) bool) error {
+	return f.RewriteHeaders(func(fields []string) []string {
+		rewritten := make([]string, 0, len(headers)+len(fields))
+		for _, header := range headers {
+			rewritten = append(rewritten, header+"\r\n")
+		}
+		for _, field := range fields {
+			if !drop(field) {
+				rewritten = append(rewritten, field)
+			}
+		}
+		return rewritten
+	})
+}
+
+// RewriteHeaders replaces header fields of the spooled email with the result of the rewrite func
+func (f *spoolFile) RewriteHeaders(rewrite func(fields []string) []string) error {
+	reader := bufio.NewReader(f.Reader())
+	fields, separator, err := email.ReadHeader(reader)
+	if err != nil {
+		return err
+	}
+	r := io.MultiReader(strings.NewReader(strings.Join(rewrite(fields), "")+separator), reader)
+	spool, err := newSpoolFile(f.dir, r)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	*f = *spool
+	return nil
+}
+
+// Reader returns new independent reader of the spooled email
+func (f *spoolFile) Reader() *io.SectionReader {
+	return io.NewSectionReader(f.fh, 0, f.size)
+}
+
+// Path of the spool file
+func (f *spoolFile) Path() string {
+	return f.fh.Name()
+}
+
+// Sync flushes the spool file (and its directory entry) to disk, so it survives a crash
+func (f *spoolFile) Sync() error {
+	if err := f.fh.Sync(); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(f.fh.Name()))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Keep the spool file on disk after Close()
+func (f *spoolFile) Keep() {
+	f.keep = true
+}
+
+// Close the spool file and remove it, unless Keep() was called
+func (f *spoolFile) Close() {
+	f.fh.Close() //nolint:errcheck // read-only usage after the spooling
+	if f.keep {
+		return
+	}
+	os.Remove(f.fh.Name()) //nolint:errcheck // nothing can be done here
+}
@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"gitlab.com/etke.cc/postmoogle/utils"
+)
+
+// transportDirect is a transport map relay value, that means direct delivery via MX servers of the recipient's domain
+const transportDirect = "direct"
+
+// ErrInvalidTransport returned when transport map entry cannot be parsed
+var ErrInvalidTransport = errors.New("invalid transport")
+
+// Transport routes emails of the matching senders and recipients via the relays
+type Transport struct {
+	// From is sender's email address or domain, * = any
+	From string
+	// To is recipient's email address or domain, * = any
+	To string
+	// Relays in priority order, the next relay is used when the previous one is unreachable or rejects with 4xx.
+	// Empty = direct delivery via MX servers of the recipient's domain
+	Relays []*RelayConfig
+}
+
+// Match checks if email from the sender to the recipient should be routed via the transport
+func (t *Transport) Match(from, to string) bool {
+	return matchTransport(t.From, from) && matchTransport(t.To, to)
+}
+
+func matchTransport(pattern, addr string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.Contains(pattern, "@") {
+		return strings.EqualFold(pattern, addr)
+	}
+	return strings.EqualFold(pattern, utils.Hostname(addr))
+}
+
+// LoadTransports reads transport map file, empty path = no transports.
+// Each line is "<from> <to> <relay> [fallback relays...]", where from and to are email addresses, domains or * (any),
+// and relay is "direct" or smtp[s]://[username[:password]@]host[:port][?options], see docs/transports.md.
+// The first matching line is used, lines starting with # are ignored
+func LoadTransports(path string) ([]*Transport, error) {
+	if path == "" {
+		return nil, nil
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	transports := []*Transport{}
+	scanner := bufio.NewScanner(fh)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		transport, err := parseTransport(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		transports = append(transports, transport)
+	}
+	return transports, scanner.Err()
+}
+
+func parseTransport(text string) (*Transport, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("%w: expected from, to and relay", ErrInvalidTransport)
+	}
+
+	transport := &Transport{From: fields[0], To: fields[1]}
+	if len(fields) == 3 && fields[2] == transportDirect {
+		return transport, nil
+	}
+	for _, raw := range fields[2:] {
+		relay, err := parseRelay(raw)
+		if err != nil {
+			return nil, err
+		}
+		transport.Relays = append(transport.Relays, relay)
+	}
+	return transport, nil
+}
+
+// parseRelay parses relay URL: smtp[s]://[username[:password]@]host[:port][?tls=&auth=&ca=&insecure_auth=true]
+func parseRelay(raw string) (*RelayConfig, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTransport, err) //nolint:errorlint // ErrInvalidTransport is the one to match
+	}
+	if (parsed.Scheme != "smtp" && parsed.Scheme != "smtps") || parsed.Hostname() == "" {
+		return nil, fmt.Errorf("%w: relay %q should be smtp://host[:port] or smtps://host[:port]", ErrInvalidTransport, parsed.Redacted())
+	}
+
+	query := parsed.Query()
+	relay := &RelayConfig{
+		Host:         parsed.Hostname(),
+		Port:         parsed.Port(),
+		TLS:          query.Get("tls"),
+		Auth:         query.Get("auth"),
+		CA:           query.Get("ca"),
+		InsecureAuth: query.Get("insecure_auth") == "true",
+	}
+	if parsed.Scheme == "smtps" && relay.TLS == "" {
+		relay.TLS = RelayTLSImplicit
+	}
+	if relay.Port == "" {
+		relay.Port = mxPort
+		if relay.TLS == RelayTLSImplicit {
+			relay.Port = implicitTLSPort
+		}
+	}
+	if parsed.User != nil {
+		relay.Usename = parsed.User.Username()
+		relay.Password, _ = parsed.User.Password()
+	}
+	if err := relay.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTransport, err) //nolint:errorlint // ErrInvalidTransport is the one to match
+	}
+	return relay, nil
+}
@@ -2,27 +2,105 @@ package utils
 
 import (
 	"fmt"
+	"net/mail"
 	"strings"
 )
 
-// MinSendCommandParts is minimal count of space-separated parts for !pm send command
+// MinSendCommandParts is minimal count of lines for !pm send command (command with recipients, subject, body)
 const MinSendCommandParts = 3
 
 // ErrInvalidArgs returned when a command's arguments are invalid
 var ErrInvalidArgs = fmt.Errorf("invalid arguments")
 
-// ParseSend parses "!pm send" command, returns to, subject, body, err
-func ParseSend(commandSlice []string) (to, subject, body string, err error) {
+// SendMessage is a parsed "!pm send" command
+type SendMessage struct {
+	To      []string
+	CC      []string
+	BCC     []string
+	Subject string
+	Body    string
+}
+
+// Recipients returns unique envelope recipients of the message (To, Cc and Bcc)
+func (m *SendMessage) Recipients() []string {
+	uniq := make(map[string]struct{}, len(m.To)+len(m.CC)+len(m.BCC))
+	recipients := make([]string, 0, len(m.To)+len(m.CC)+len(m.BCC))
+	for _, group := range [][]string{m.To, m.CC, m.BCC} {
+		for _, addr := range group {
+			if _, ok := uniq[addr]; ok {
+				continue
+			}
+			uniq[addr] = struct{}{}
+			recipients = append(recipients, addr)
+		}
+	}
+	return recipients
+}
+
+// ParseSend parses "!pm send" command.
+// Recipients are listed on the command line (To) and/or on the To:, Cc: and Bcc: lines after it,
+// the next line is subject and the rest is body.
+// A line is a recipients line only if it contains valid addresses, so a subject like "To: the team" stays a subject
+func ParseSend(commandSlice []string) (*SendMessage, error) {
 	message := strings.Join(commandSlice, " ")
 	lines := strings.Split(message, "\n")
 	if len(lines) < MinSendCommandParts {
-		return "", "", "", ErrInvalidArgs
+		return nil, ErrInvalidArgs
+	}
+
+	msg := &SendMessage{}
+	if _, to, ok := strings.Cut(lines[0], " "); ok {
+		msg.To = splitAddresses(to)
+	}
+	lines = lines[1:]
+	for len(lines) > 0 {
+		name, value, _ := strings.Cut(lines[0], ":")
+		addrs, ok := headerAddresses(value)
+		if !ok {
+			name = ""
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "to":
+			msg.To = append(msg.To, addrs...)
+		case "cc":
+			msg.CC = append(msg.CC, addrs...)
+		case "bcc":
+			msg.BCC = append(msg.BCC, addrs...)
+		default:
+			if len(lines) < MinSendCommandParts-1 || len(msg.Recipients()) == 0 {
+				return nil, ErrInvalidArgs
+			}
+			msg.Subject = lines[0]
+			msg.Body = strings.Join(lines[1:], "\n")
+			return msg, nil
+		}
+		lines = lines[1:]
 	}
 
-	commandSlice = strings.Split(lines[0], " ")
-	to = commandSlice[1]
-	subject = lines[1]
-	body = strings.Join(lines[2:], "\n")
+	return nil, ErrInvalidArgs
+}
 
-	return to, subject, body, nil
+// headerAddresses splits value of the recipients line, returns false if it has no addresses or any of them is invalid
+func headerAddresses(value string) ([]string, bool) {
+	addrs := splitAddresses(value)
+	if len(addrs) == 0 {
+		return nil, false
+	}
+	for _, addr := range addrs {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return nil, false
+		}
+	}
+	return addrs, true
+}
+
+// splitAddresses splits comma-separated list of addresses
+func splitAddresses(list string) []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseSend(t *testing.T) {
+	command := "send a@example.com, b@example.com\nCc: c@example.com\nBcc: d@example.com, a@example.com\nSubject\nline 1\nline 2"
+	msg, err := ParseSend(strings.Split(command, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(msg.To, ",") != "a@example.com,b@example.com" || strings.Join(msg.CC, ",") != "c@example.com" || strings.Join(msg.BCC, ",") != "d@example.com,a@example.com" {
+		t.Errorf("unexpected recipients: %+v", msg)
+	}
+	if msg.Subject != "Subject" || msg.Body != "line 1\nline 2" {
+		t.Errorf("unexpected subject or body: %+v", msg)
+	}
+	if recipients := strings.Join(msg.Recipients(), ","); recipients != "a@example.com,b@example.com,c@example.com,d@example.com" {
+		t.Errorf("unexpected envelope recipients: %s", recipients)
+	}
+
+	command = "send a@example.com\nTo: the team, about the meeting\nline 1"
+	msg, err = ParseSend(strings.Split(command, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(msg.To, ",") != "a@example.com" || msg.Subject != "To: the team, about the meeting" || msg.Body != "line 1" {
+		t.Errorf("subject is parsed as recipients: %+v", msg)
+	}
+
+	for _, invalid := range []string{"send\nSubject\nbody", "send a@example.com\nSubject", "send\nBcc: a@example.com\nSubject"} {
+		if _, err := ParseSend(strings.Split(invalid, " ")); !errors.Is(err, ErrInvalidArgs) {
+			t.Errorf("%q: expected invalid arguments, got %v", invalid, err)
+		}
+	}
+}
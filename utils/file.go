@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"os"
 	"strings"
 
 	"github.com/gabriel-vasile/mimetype"
@@ -15,6 +16,9 @@ type File struct {
 	MsgType event.MessageType
 	Length  int
 	Content []byte
+
+	path string
+	fh   *os.File
 }
 
 func NewFile(name string, content []byte) *File {
@@ -31,14 +35,62 @@ func NewFile(name string, content []byte) *File {
 	return file
 }
 
-func (f *File) Convert() *mautrix.ReqUploadMedia {
-	return &mautrix.ReqUploadMedia{
-		ContentBytes:  f.Content,
-		Content:       bytes.NewReader(f.Content),
+// NewFileFromPath creates a file object backed by the file on disk,
+// its content is never loaded into memory
+func NewFileFromPath(name, path string, length int) *File {
+	file := &File{
+		Name:   name,
+		Length: length,
+		path:   path,
+	}
+
+	mtype, err := mimetype.DetectFile(path)
+	if err == nil {
+		file.Type = mtype.String()
+	}
+	file.MsgType = mimeMsgType(file.Type)
+
+	return file
+}
+
+// Convert file to the upload request, don't forget to call Close() after the upload
+func (f *File) Convert() (*mautrix.ReqUploadMedia, error) {
+	req := &mautrix.ReqUploadMedia{
 		ContentLength: int64(f.Length),
 		ContentType:   f.Type,
 		FileName:      f.Name,
 	}
+	if f.path == "" {
+		req.ContentBytes = f.Content
+		req.Content = bytes.NewReader(f.Content)
+		return req, nil
+	}
+
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.fh = fh
+	req.Content = fh
+	return req, nil
+}
+
+// Close file handle opened by Convert()
+func (f *File) Close() {
+	if f.fh == nil {
+		return
+	}
+	f.fh.Close() //nolint:errcheck // read-only file, nothing to flush
+	f.fh = nil
+}
+
+// Remove file from disk (if the file is backed by the file on disk)
+func (f *File) Remove() {
+	f.Close()
+	if f.path == "" {
+		return
+	}
+	os.Remove(f.path) //nolint:errcheck // nothing can be done here
 }
 
 func mimeMsgType(mime string) event.MessageType {